@@ -0,0 +1,354 @@
+package soju
+
+import (
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/irc.v3"
+)
+
+// Connection states reported in the "state" attribute of networks.
+const (
+	bouncerNetworkConnected    = "connected"
+	bouncerNetworkConnecting   = "connecting"
+	bouncerNetworkDisconnected = "disconnected"
+)
+
+// Reference of the batch sent in reply to BOUNCER LISTNETWORKS. Only one such
+// batch is open at a time.
+const bouncerNetworksBatchRef = "networks"
+
+// bouncerNetworkAttrs returns the soju.im/bouncer-networks attributes of a
+// network. Networks are named after their address.
+func bouncerNetworkAttrs(record *Network, state string) irc.Tags {
+	host, port := splitNetworkAddr(record.Addr)
+	attrs := irc.Tags{
+		"name":     irc.TagValue(record.Addr),
+		"host":     irc.TagValue(host),
+		"port":     irc.TagValue(port),
+		"tls":      "1",
+		"nickname": irc.TagValue(record.Nick),
+		"state":    irc.TagValue(state),
+	}
+	if record.Username != "" {
+		attrs["username"] = irc.TagValue(record.Username)
+	}
+	if record.Realname != "" {
+		attrs["realname"] = irc.TagValue(record.Realname)
+	}
+	return attrs
+}
+
+// formatBouncerAttrs formats network attributes, sorted by name. A nil map
+// indicates a deleted network.
+func formatBouncerAttrs(attrs irc.Tags) string {
+	if attrs == nil {
+		return "*"
+	}
+
+	keys := make([]string, 0, len(attrs))
+	for k := range attrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	l := make([]string, len(keys))
+	for i, k := range keys {
+		l[i] = k
+		if v := attrs[k]; v != "" {
+			l[i] += "=" + v.Encode()
+		}
+	}
+	return strings.Join(l, ";")
+}
+
+// splitNetworkAddr splits a network address into a host and a port. The port
+// defaults to 6697.
+func splitNetworkAddr(addr string) (host, port string) {
+	if !strings.ContainsRune(addr, ':') {
+		return addr, "6697"
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr, "6697"
+	}
+	return host, port
+}
+
+type bouncerAttrError struct {
+	code, attr, desc string
+}
+
+func (err bouncerAttrError) Error() string {
+	return err.desc
+}
+
+// applyBouncerAttrs updates a network record with attributes sent by a client.
+func applyBouncerAttrs(record *Network, attrs irc.Tags) error {
+	host, port := splitNetworkAddr(record.Addr)
+	hasPort := strings.ContainsRune(record.Addr, ':')
+	addrChanged := false
+	for k, v := range attrs {
+		switch k {
+		case "name":
+			// Ignore: networks are named after their address
+		case "host":
+			if v == "" {
+				return bouncerAttrError{"INVALID_ATTRIBUTE", k, "Host can't be empty"}
+			}
+			host = string(v)
+			addrChanged = true
+		case "port":
+			if n, err := strconv.ParseUint(string(v), 10, 16); err != nil || n == 0 {
+				return bouncerAttrError{"INVALID_ATTRIBUTE", k, "Invalid port"}
+			}
+			port = string(v)
+			hasPort = true
+			addrChanged = true
+		case "tls":
+			if v != "1" {
+				return bouncerAttrError{"INVALID_ATTRIBUTE", k, "Only TLS connections are supported"}
+			}
+		case "nickname":
+			if v == "" {
+				return bouncerAttrError{"INVALID_ATTRIBUTE", k, "Nickname can't be empty"}
+			}
+			record.Nick = string(v)
+		case "username":
+			record.Username = string(v)
+		case "realname":
+			record.Realname = string(v)
+		case "pass":
+			record.Pass = string(v)
+		case "state":
+			return bouncerAttrError{"READ_ONLY_ATTRIBUTE", k, "Attribute is read-only"}
+		default:
+			return bouncerAttrError{"UNKNOWN_ATTRIBUTE", k, "Unknown attribute"}
+		}
+	}
+
+	if addrChanged {
+		if host == "" {
+			return bouncerAttrError{"NEED_ATTRIBUTE", "host", "Missing host attribute"}
+		}
+		record.Addr = host
+		if hasPort {
+			record.Addr = net.JoinHostPort(host, port)
+		}
+	}
+	return nil
+}
+
+// bouncerState returns the connection state of the network.
+func (net *network) bouncerState() string {
+	net.user.lock.Lock()
+	defer net.user.lock.Unlock()
+	return net.state
+}
+
+// setState records the connection state of the network, and notifies the
+// downstream connections. It must be called from the user goroutine.
+func (net *network) setState(state string) {
+	net.user.lock.Lock()
+	net.state = state
+	net.user.lock.Unlock()
+
+	net.user.notifyBouncerNetwork(net.ID, irc.Tags{"state": irc.TagValue(state)})
+}
+
+// notifyBouncerNetwork sends the attributes of a network to the downstream
+// connections with the soju.im/bouncer-networks-notify capability. A nil map
+// indicates that the network has been deleted.
+func (u *user) notifyBouncerNetwork(id int64, attrs irc.Tags) {
+	attrsStr := formatBouncerAttrs(attrs)
+	u.forEachDownstream(func(dc *downstreamConn) {
+		if !dc.caps["soju.im/bouncer-networks-notify"] {
+			return
+		}
+		dc.SendMessage(&irc.Message{
+			Prefix:  dc.srv.prefix(),
+			Command: "BOUNCER",
+			Params:  []string{"NETWORK", strconv.FormatInt(id, 10), attrsStr},
+		})
+	})
+}
+
+// parseBouncerNetID parses a network ID sent by a client.
+func parseBouncerNetID(s string) (int64, bool) {
+	id, err := strconv.ParseInt(s, 10, 64)
+	return id, err == nil && id > 0
+}
+
+func (dc *downstreamConn) handleBouncer(msg *irc.Message) error {
+	var subcommand string
+	if err := parseMessageParams(msg, &subcommand); err != nil {
+		return err
+	}
+	subcommand = strings.ToUpper(subcommand)
+
+	switch subcommand {
+	case "LISTNETWORKS", "LS":
+		var networks []*network
+		dc.user.forEachNetwork(func(net *network) {
+			networks = append(networks, net)
+		})
+
+		var tags irc.Tags
+		if dc.caps["batch"] {
+			tags = irc.Tags{"batch": bouncerNetworksBatchRef}
+			dc.SendMessage(&irc.Message{
+				Prefix:  dc.srv.prefix(),
+				Command: "BATCH",
+				Params:  []string{"+" + bouncerNetworksBatchRef, "soju.im/bouncer-networks"},
+			})
+		}
+		for _, net := range networks {
+			attrs := bouncerNetworkAttrs(&net.Network, net.bouncerState())
+			dc.SendMessage(&irc.Message{
+				Tags:    tags,
+				Prefix:  dc.srv.prefix(),
+				Command: "BOUNCER",
+				Params:  []string{"NETWORK", strconv.FormatInt(net.ID, 10), formatBouncerAttrs(attrs)},
+			})
+		}
+		if dc.caps["batch"] {
+			dc.SendMessage(&irc.Message{
+				Prefix:  dc.srv.prefix(),
+				Command: "BATCH",
+				Params:  []string{"-" + bouncerNetworksBatchRef},
+			})
+		}
+	case "ADDNETWORK":
+		var attrsStr string
+		if err := parseMessageParams(msg, nil, &attrsStr); err != nil {
+			return err
+		}
+
+		record := &Network{Nick: dc.nick}
+		if err := applyBouncerAttrs(record, irc.ParseTags(attrsStr)); err != nil {
+			return dc.sendBouncerAttrError(subcommand, err)
+		}
+		if record.Addr == "" {
+			dc.sendStandardReply("FAIL", "BOUNCER", "NEED_ATTRIBUTE", []string{subcommand, "host"}, "Missing host attribute")
+			return nil
+		}
+		if dc.user.getNetwork(record.Addr) != nil {
+			dc.sendStandardReply("FAIL", "BOUNCER", "INVALID_ATTRIBUTE", []string{subcommand, "host"}, "A network with this address already exists")
+			return nil
+		}
+
+		dc.logger.Printf("adding network %q", record.Addr)
+		net, err := dc.user.createNetwork(record)
+		if err != nil {
+			return err
+		}
+
+		dc.SendMessage(&irc.Message{
+			Prefix:  dc.srv.prefix(),
+			Command: "BOUNCER",
+			Params:  []string{"ADDNETWORK", strconv.FormatInt(net.ID, 10)},
+		})
+	case "CHANGENETWORK":
+		var idStr, attrsStr string
+		if err := parseMessageParams(msg, nil, &idStr, &attrsStr); err != nil {
+			return err
+		}
+
+		id, _ := parseBouncerNetID(idStr)
+		net := dc.user.getNetworkByID(id)
+		if net == nil {
+			dc.sendStandardReply("FAIL", "BOUNCER", "INVALID_NETID", []string{subcommand, idStr}, "Unknown network ID")
+			return nil
+		}
+
+		record := net.Network
+		if err := applyBouncerAttrs(&record, irc.ParseTags(attrsStr)); err != nil {
+			return dc.sendBouncerAttrError(subcommand, err)
+		}
+		if other := dc.user.getNetwork(record.Addr); other != nil && other != net {
+			dc.sendStandardReply("FAIL", "BOUNCER", "INVALID_ATTRIBUTE", []string{subcommand, "host"}, "A network with this address already exists")
+			return nil
+		}
+
+		if err := dc.user.updateNetwork(&record); err != nil {
+			return err
+		}
+
+		dc.SendMessage(&irc.Message{
+			Prefix:  dc.srv.prefix(),
+			Command: "BOUNCER",
+			Params:  []string{"CHANGENETWORK", idStr},
+		})
+	case "DELNETWORK":
+		var idStr string
+		if err := parseMessageParams(msg, nil, &idStr); err != nil {
+			return err
+		}
+
+		id, _ := parseBouncerNetID(idStr)
+		if dc.user.getNetworkByID(id) == nil {
+			dc.sendStandardReply("FAIL", "BOUNCER", "INVALID_NETID", []string{subcommand, idStr}, "Unknown network ID")
+			return nil
+		}
+
+		// Reply before this connection is closed, if it's bound to the
+		// network
+		dc.SendMessage(&irc.Message{
+			Prefix:  dc.srv.prefix(),
+			Command: "BOUNCER",
+			Params:  []string{"DELNETWORK", idStr},
+		})
+
+		dc.logger.Printf("deleting network %v", id)
+		if err := dc.user.deleteNetwork(id); err != nil {
+			return err
+		}
+	case "BIND", "ATTACH":
+		dc.sendStandardReply("FAIL", "BOUNCER", "REGISTRATION_IS_COMPLETED", []string{subcommand}, "Cannot bind to a network after registration")
+	default:
+		dc.sendStandardReply("FAIL", "BOUNCER", "UNKNOWN_COMMAND", []string{subcommand}, "Unknown subcommand")
+	}
+	return nil
+}
+
+func (dc *downstreamConn) sendBouncerAttrError(subcommand string, err error) error {
+	attrErr, ok := err.(bouncerAttrError)
+	if !ok {
+		return err
+	}
+	dc.sendStandardReply("FAIL", "BOUNCER", attrErr.code, []string{subcommand, attrErr.attr}, attrErr.desc)
+	return nil
+}
+
+// handleBouncerUnregistered handles BOUNCER commands sent before registration.
+// Only BIND is supported: the connection is bound to the network on
+// registration.
+func (dc *downstreamConn) handleBouncerUnregistered(msg *irc.Message) error {
+	var subcommand string
+	if err := parseMessageParams(msg, &subcommand); err != nil {
+		return err
+	}
+	subcommand = strings.ToUpper(subcommand)
+
+	switch subcommand {
+	case "BIND", "ATTACH":
+		var idStr string
+		if err := parseMessageParams(msg, nil, &idStr); err != nil {
+			return err
+		}
+		id, ok := parseBouncerNetID(idStr)
+		if !ok {
+			dc.sendStandardReply("FAIL", "BOUNCER", "INVALID_NETID", []string{subcommand, idStr}, "Invalid network ID")
+			return nil
+		}
+		dc.bindNetworkID = id
+		return nil
+	default:
+		return ircError{&irc.Message{
+			Command: irc.ERR_NOTREGISTERED,
+			Params:  []string{"*", "You have not registered"},
+		}}
+	}
+}
@@ -1,6 +1,10 @@
 package soju
 
 import (
+	"fmt"
+	"strconv"
+	"strings"
+
 	"gopkg.in/irc.v3"
 )
 
@@ -9,13 +13,85 @@ func forwardChannel(dc *downstreamConn, ch *upstreamChannel) {
 		panic("Tried to forward a partial channel")
 	}
 
-	downstreamName := dc.marshalChannel(ch.conn, ch.Name)
-
-	dc.SendMessage(&irc.Message{
+	dc.SendMessage(dc.marshalMessage(&irc.Message{
 		Prefix:  dc.prefix(),
 		Command: "JOIN",
-		Params:  []string{downstreamName},
-	})
+		Params:  []string{dc.marshalChannel(ch.conn, ch.Name)},
+	}, ch.conn))
+
+	dc.sendStoredReadMarker(ch.conn.network, ch.Name)
+	sendTopic(dc, ch)
+
+	// Clients with draft/no-implicit-names will send NAMES if they need
+	// the member list
+	if !dc.caps["draft/no-implicit-names"] {
+		sendNames(dc, ch)
+	}
+}
+
+// forwardChannelUpdate sends the difference between the previous and the
+// current state of a channel to a downstream connection which has already
+// received the previous state, e.g. before an upstream reconnection. Members
+// who left are sent as PART, new members as JOIN, and membership changes as
+// MODE. Channel modes are compared once they are received, see
+// pendingModeQuery.
+func forwardChannelUpdate(dc *downstreamConn, prev, ch *upstreamChannel) {
+	if !ch.complete {
+		panic("Tried to forward a partial channel")
+	}
+
+	if ch.Topic != prev.Topic {
+		sendTopic(dc, ch)
+	}
+
+	uc := ch.conn
+	downstreamName := dc.marshalChannel(uc, ch.Name)
+	for nick := range prev.Members {
+		if _, ok := ch.Members[nick]; ok || nick == prev.conn.nick || nick == uc.nick {
+			continue
+		}
+		dc.SendMessage(&irc.Message{
+			Prefix:  dc.marshalUserPrefix(uc, &irc.Prefix{Name: nick}),
+			Command: "PART",
+			Params:  []string{downstreamName},
+		})
+	}
+	for nick, membership := range ch.Members {
+		prevMembership, ok := prev.Members[nick]
+		if !ok && nick != prev.conn.nick && nick != uc.nick {
+			dc.SendMessage(&irc.Message{
+				Prefix:  dc.marshalUserPrefix(uc, &irc.Prefix{Name: nick}),
+				Command: "JOIN",
+				Params:  []string{downstreamName},
+			})
+		}
+		if membership == prevMembership {
+			continue
+		}
+
+		var modeStr string
+		var params []string
+		if mode := uc.membershipMode(prevMembership); mode != 0 {
+			modeStr += "-" + string(mode)
+			params = append(params, dc.marshalNick(uc, nick))
+		}
+		if mode := uc.membershipMode(membership); mode != 0 {
+			modeStr += "+" + string(mode)
+			params = append(params, dc.marshalNick(uc, nick))
+		}
+		if modeStr == "" {
+			continue
+		}
+		dc.SendMessage(&irc.Message{
+			Prefix:  dc.srv.prefix(),
+			Command: "MODE",
+			Params:  append([]string{downstreamName, modeStr}, params...),
+		})
+	}
+}
+
+func sendTopic(dc *downstreamConn, ch *upstreamChannel) {
+	downstreamName := dc.marshalChannel(ch.conn, ch.Name)
 
 	if ch.Topic != "" {
 		dc.SendMessage(&irc.Message{
@@ -23,6 +99,14 @@ func forwardChannel(dc *downstreamConn, ch *upstreamChannel) {
 			Command: irc.RPL_TOPIC,
 			Params:  []string{dc.nick, downstreamName, ch.Topic},
 		})
+		if ch.TopicWho != "" && !ch.TopicTime.IsZero() {
+			topicWho := dc.marshalUserPrefix(ch.conn, irc.ParsePrefix(ch.TopicWho))
+			dc.SendMessage(&irc.Message{
+				Prefix:  dc.srv.prefix(),
+				Command: rpl_topicwhotime,
+				Params:  []string{dc.nick, downstreamName, topicWho.String(), strconv.FormatInt(ch.TopicTime.Unix(), 10)},
+			})
+		}
 	} else {
 		dc.SendMessage(&irc.Message{
 			Prefix:  dc.srv.prefix(),
@@ -30,22 +114,47 @@ func forwardChannel(dc *downstreamConn, ch *upstreamChannel) {
 			Params:  []string{dc.nick, downstreamName, "No topic is set"},
 		})
 	}
+}
+
+func sendNames(dc *downstreamConn, ch *upstreamChannel) {
+	downstreamName := dc.marshalChannel(ch.conn, ch.Name)
 
-	// TODO: rpl_topicwhotime
+	// Space left for the members in a message, once the prefix, the
+	// command, the parameters and the CRLF are written
+	header := fmt.Sprintf(":%v %v %v %v %v :", dc.srv.prefix(), irc.RPL_NAMREPLY, dc.nick, string(ch.Status), downstreamName)
+	maxLen := 512 - len(header) - 2
+
+	var members strings.Builder
+	flush := func() {
+		if members.Len() == 0 {
+			return
+		}
+		dc.SendMessage(&irc.Message{
+			Prefix:  dc.srv.prefix(),
+			Command: irc.RPL_NAMREPLY,
+			Params:  []string{dc.nick, string(ch.Status), downstreamName, members.String()},
+		})
+		members.Reset()
+	}
 
-	// TODO: send multiple members in each message
 	for nick, membership := range ch.Members {
 		s := dc.marshalNick(ch.conn, nick)
+		if dc.caps["userhost-in-names"] {
+			s = marshalMemberMask(dc, ch.conn, nick)
+		}
 		if membership != 0 {
 			s = string(membership) + s
 		}
 
-		dc.SendMessage(&irc.Message{
-			Prefix:  dc.srv.prefix(),
-			Command: irc.RPL_NAMREPLY,
-			Params:  []string{dc.nick, string(ch.Status), downstreamName, s},
-		})
+		if members.Len() > 0 && members.Len()+1+len(s) > maxLen {
+			flush()
+		}
+		if members.Len() > 0 {
+			members.WriteByte(' ')
+		}
+		members.WriteString(s)
 	}
+	flush()
 
 	dc.SendMessage(&irc.Message{
 		Prefix:  dc.srv.prefix(),
@@ -53,3 +162,18 @@ func forwardChannel(dc *downstreamConn, ch *upstreamChannel) {
 		Params:  []string{dc.nick, downstreamName, "End of /NAMES list"},
 	})
 }
+
+// marshalMemberMask returns the full mask of a channel member, for clients
+// which support userhost-in-names. Falls back to the nick if the username or
+// hostname of the member is unknown.
+func marshalMemberMask(dc *downstreamConn, uc *upstreamConn, nick string) string {
+	u, ok := uc.users[nick]
+	if nick == uc.nick || !ok || u.Username == "" || u.Hostname == "" {
+		return dc.marshalNick(uc, nick)
+	}
+	return dc.marshalUserPrefix(uc, &irc.Prefix{
+		Name: nick,
+		User: u.Username,
+		Host: u.Hostname,
+	}).String()
+}
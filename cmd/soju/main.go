@@ -5,6 +5,7 @@ import (
 	"flag"
 	"log"
 	"net"
+	"net/http"
 
 	"git.sr.ht/~emersion/soju"
 	"git.sr.ht/~emersion/soju/config"
@@ -38,29 +39,57 @@ func main() {
 		log.Fatalf("failed to open database: %v", err)
 	}
 
-	var ln net.Listener
+	var tlsCfg *tls.Config
 	if cfg.TLS != nil {
 		cert, err := tls.LoadX509KeyPair(cfg.TLS.CertPath, cfg.TLS.KeyPath)
 		if err != nil {
 			log.Fatalf("failed to load TLS certificate and key: %v", err)
 		}
 
-		tlsCfg := &tls.Config{Certificates: []tls.Certificate{cert}}
-		ln, err = tls.Listen("tcp", cfg.Addr, tlsCfg)
-		if err != nil {
-			log.Fatalf("failed to start TLS listener: %v", err)
+		tlsCfg = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			// Used for SASL EXTERNAL authentication
+			ClientAuth: tls.RequestClientCert,
 		}
-	} else {
-		var err error
-		ln, err = net.Listen("tcp", cfg.Addr)
+	}
+
+	ln, err := listen(cfg.Addr, cfg.ProxyProtocol, tlsCfg)
+	if err != nil {
+		log.Fatalf("failed to start listener: %v", err)
+	}
+
+	var wsLn net.Listener
+	if cfg.WebSocketAddr != "" {
+		wsLn, err = listen(cfg.WebSocketAddr, cfg.WebSocketProxyProtocol, tlsCfg)
 		if err != nil {
-			log.Fatalf("failed to start listener: %v", err)
+			log.Fatalf("failed to start WebSocket listener: %v", err)
 		}
 	}
 
 	srv := soju.NewServer(db)
 	// TODO: load from config/DB
 	srv.Hostname = cfg.Hostname
+	srv.ServerPassword = cfg.ServerPassword
+	srv.HTTPOrigins = cfg.HTTPOrigins
+	srv.DownstreamFloodRate = cfg.DownstreamFloodRate
+	srv.DownstreamFloodBurst = cfg.DownstreamFloodBurst
+	srv.UpstreamFloodRate = cfg.UpstreamFloodRate
+	srv.UpstreamFloodBurst = cfg.UpstreamFloodBurst
+	srv.CollapseNetsplits = cfg.CollapseNetsplits
+	srv.WHOXOnJoin = cfg.WHOXOnJoin
+	srv.BacklogLimit = soju.BacklogLimit{
+		MaxCount: cfg.BacklogMaxCount,
+		MaxAge:   cfg.BacklogMaxAge,
+	}
+	srv.UpstreamPingInterval = cfg.UpstreamPingInterval
+	srv.UpstreamPingTimeout = cfg.UpstreamPingTimeout
+	srv.DownstreamPingInterval = cfg.DownstreamPingInterval
+	srv.DownstreamPingTimeout = cfg.DownstreamPingTimeout
+	srv.AutoAway = cfg.AutoAway
+	srv.AutoAwayDelay = cfg.AutoAwayDelay
+	srv.PersistForcedNicks = cfg.PersistForcedNicks
+	srv.UniqueClientNames = cfg.UniqueClientNames
+	srv.UpstreamProxy = cfg.UpstreamProxy
 	srv.Debug = debug
 
 	log.Printf("server listening on %q", cfg.Addr)
@@ -69,5 +98,25 @@ func main() {
 			log.Fatal(err)
 		}
 	}()
+	if wsLn != nil {
+		log.Printf("WebSocket server listening on %q", cfg.WebSocketAddr)
+		go func() {
+			log.Fatal(http.Serve(wsLn, srv))
+		}()
+	}
 	log.Fatal(srv.Serve(ln))
 }
+
+func listen(addr string, proxyProtocol bool, tlsCfg *tls.Config) (net.Listener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if proxyProtocol {
+		ln = soju.NewProxyProtocolListener(ln)
+	}
+	if tlsCfg != nil {
+		ln = tls.NewListener(ln, tlsCfg)
+	}
+	return ln, nil
+}
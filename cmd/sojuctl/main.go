@@ -14,8 +14,8 @@ import (
 
 const usage = `usage: sojuctl [-config path] <action> [options...]
 
-  create-user <username>  Create a new user
-  help                    Show this help message
+  create-user <username> [-admin]  Create a new user
+  help                             Show this help message
 `
 
 func init() {
@@ -53,6 +53,10 @@ func main() {
 			os.Exit(1)
 		}
 
+		fs := flag.NewFlagSet("", flag.ExitOnError)
+		admin := fs.Bool("admin", false, "make the new user admin")
+		fs.Parse(flag.Args()[2:])
+
 		fmt.Printf("Password: ")
 		password, err := terminal.ReadPassword(int(os.Stdin.Fd()))
 		if err != nil {
@@ -68,6 +72,7 @@ func main() {
 		user := soju.User{
 			Username: username,
 			Password: string(hashed),
+			Admin:    *admin,
 		}
 		if err := db.CreateUser(&user); err != nil {
 			log.Fatalf("failed to create user: %v", err)
@@ -4,8 +4,11 @@ import (
 	"bufio"
 	"fmt"
 	"io"
+	"net/url"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 	"unicode"
 )
 
@@ -14,11 +17,44 @@ type TLS struct {
 }
 
 type Server struct {
-	Addr      string
-	Hostname  string
-	TLS       *TLS
-	SQLDriver string
-	SQLSource string
+	Addr          string
+	WebSocketAddr string
+	Hostname      string
+	TLS           *TLS
+	SQLDriver     string
+	SQLSource     string
+
+	ServerPassword string
+
+	ProxyProtocol          bool
+	WebSocketProxyProtocol bool
+	HTTPOrigins            []string
+
+	DownstreamFloodRate  float64
+	DownstreamFloodBurst int
+
+	UpstreamFloodRate  float64
+	UpstreamFloodBurst int
+
+	CollapseNetsplits bool
+	WHOXOnJoin        bool
+
+	BacklogMaxCount int
+	BacklogMaxAge   time.Duration
+
+	UpstreamPingInterval time.Duration
+	UpstreamPingTimeout  time.Duration
+
+	DownstreamPingInterval time.Duration
+	DownstreamPingTimeout  time.Duration
+
+	AutoAway      bool
+	AutoAwayDelay time.Duration
+
+	UpstreamProxy *url.URL
+
+	PersistForcedNicks bool
+	UniqueClientNames  bool
 }
 
 func Defaults() *Server {
@@ -31,6 +67,17 @@ func Defaults() *Server {
 		Hostname:  hostname,
 		SQLDriver: "sqlite3",
 		SQLSource: "soju.db",
+
+		DownstreamFloodRate:  2,
+		DownstreamFloodBurst: 30,
+		UpstreamFloodRate:    0.5,
+		UpstreamFloodBurst:   10,
+
+		UpstreamPingInterval: time.Minute,
+		UpstreamPingTimeout:  time.Minute,
+
+		DownstreamPingInterval: time.Minute,
+		DownstreamPingTimeout:  time.Minute,
 	}
 }
 
@@ -55,9 +102,20 @@ func Parse(r io.Reader) (*Server, error) {
 	for _, d := range directives {
 		switch d.Name {
 		case "listen":
-			if err := d.parseParams(&srv.Addr); err != nil {
+			var err error
+			if srv.Addr, srv.ProxyProtocol, err = d.parseListen(); err != nil {
+				return nil, err
+			}
+		case "listen-websocket":
+			var err error
+			if srv.WebSocketAddr, srv.WebSocketProxyProtocol, err = d.parseListen(); err != nil {
 				return nil, err
 			}
+		case "http-origin":
+			if len(d.Params) == 0 {
+				return nil, fmt.Errorf("directive %q: expected at least one origin pattern", d.Name)
+			}
+			srv.HTTPOrigins = append(srv.HTTPOrigins, d.Params...)
 		case "hostname":
 			if err := d.parseParams(&srv.Hostname); err != nil {
 				return nil, err
@@ -72,6 +130,119 @@ func Parse(r io.Reader) (*Server, error) {
 			if err := d.parseParams(&srv.SQLDriver, &srv.SQLSource); err != nil {
 				return nil, err
 			}
+		case "server-password":
+			if err := d.parseParams(&srv.ServerPassword); err != nil {
+				return nil, err
+			}
+		case "downstream-flood":
+			var rateStr, burstStr string
+			if err := d.parseParams(&rateStr, &burstStr); err != nil {
+				return nil, err
+			}
+			var err error
+			if srv.DownstreamFloodRate, err = strconv.ParseFloat(rateStr, 64); err != nil {
+				return nil, fmt.Errorf("directive %q: invalid rate: %v", d.Name, err)
+			}
+			if srv.DownstreamFloodBurst, err = strconv.Atoi(burstStr); err != nil {
+				return nil, fmt.Errorf("directive %q: invalid burst: %v", d.Name, err)
+			}
+			if srv.DownstreamFloodRate > 0 && srv.DownstreamFloodBurst <= 0 {
+				return nil, fmt.Errorf("directive %q: burst must be positive when the rate is limited", d.Name)
+			}
+		case "upstream-flood":
+			var rateStr, burstStr string
+			if err := d.parseParams(&rateStr, &burstStr); err != nil {
+				return nil, err
+			}
+			var err error
+			if srv.UpstreamFloodRate, err = strconv.ParseFloat(rateStr, 64); err != nil {
+				return nil, fmt.Errorf("directive %q: invalid rate: %v", d.Name, err)
+			}
+			if srv.UpstreamFloodBurst, err = strconv.Atoi(burstStr); err != nil {
+				return nil, fmt.Errorf("directive %q: invalid burst: %v", d.Name, err)
+			}
+			if srv.UpstreamFloodRate > 0 && srv.UpstreamFloodBurst <= 0 {
+				return nil, fmt.Errorf("directive %q: burst must be positive when the rate is limited", d.Name)
+			}
+		case "collapse-netsplits":
+			if err := d.parseParams(); err != nil {
+				return nil, err
+			}
+			srv.CollapseNetsplits = true
+		case "backlog-limit":
+			var countStr, ageStr string
+			if err := d.parseParams(&countStr, &ageStr); err != nil {
+				return nil, err
+			}
+			var err error
+			if srv.BacklogMaxCount, err = strconv.Atoi(countStr); err != nil {
+				return nil, fmt.Errorf("directive %q: invalid count: %v", d.Name, err)
+			}
+			if srv.BacklogMaxAge, err = time.ParseDuration(ageStr); err != nil {
+				return nil, fmt.Errorf("directive %q: invalid age: %v", d.Name, err)
+			}
+		case "upstream-ping":
+			var intervalStr, timeoutStr string
+			if err := d.parseParams(&intervalStr, &timeoutStr); err != nil {
+				return nil, err
+			}
+			var err error
+			if srv.UpstreamPingInterval, err = time.ParseDuration(intervalStr); err != nil {
+				return nil, fmt.Errorf("directive %q: invalid interval: %v", d.Name, err)
+			}
+			if srv.UpstreamPingTimeout, err = time.ParseDuration(timeoutStr); err != nil {
+				return nil, fmt.Errorf("directive %q: invalid timeout: %v", d.Name, err)
+			}
+		case "downstream-ping":
+			var intervalStr, timeoutStr string
+			if err := d.parseParams(&intervalStr, &timeoutStr); err != nil {
+				return nil, err
+			}
+			var err error
+			if srv.DownstreamPingInterval, err = time.ParseDuration(intervalStr); err != nil {
+				return nil, fmt.Errorf("directive %q: invalid interval: %v", d.Name, err)
+			}
+			if srv.DownstreamPingTimeout, err = time.ParseDuration(timeoutStr); err != nil {
+				return nil, fmt.Errorf("directive %q: invalid timeout: %v", d.Name, err)
+			}
+		case "auto-away":
+			var delayStr string
+			if err := d.parseParams(&delayStr); err != nil {
+				return nil, err
+			}
+			var err error
+			if srv.AutoAwayDelay, err = time.ParseDuration(delayStr); err != nil {
+				return nil, fmt.Errorf("directive %q: invalid delay: %v", d.Name, err)
+			}
+			srv.AutoAway = true
+		case "persist-forced-nicks":
+			if err := d.parseParams(); err != nil {
+				return nil, err
+			}
+			srv.PersistForcedNicks = true
+		case "upstream-proxy":
+			var proxyStr string
+			if err := d.parseParams(&proxyStr); err != nil {
+				return nil, err
+			}
+			u, err := url.Parse(proxyStr)
+			if err != nil {
+				return nil, fmt.Errorf("directive %q: invalid URL: %v", d.Name, err)
+			}
+			if u.Scheme != "socks5" && u.Scheme != "socks5h" {
+				return nil, fmt.Errorf("directive %q: unsupported proxy scheme %q", d.Name, u.Scheme)
+			}
+			srv.UpstreamProxy = u
+		case "whox-on-join":
+			if err := d.parseParams(); err != nil {
+				return nil, err
+			}
+			srv.WHOXOnJoin = true
+		case "unique-client-names":
+			if err := d.parseParams(); err != nil {
+				return nil, err
+			}
+			srv.UniqueClientNames = true
 		default:
 			return nil, fmt.Errorf("unknown directive %q", d.Name)
 		}
@@ -95,6 +266,26 @@ func (d *directive) parseParams(out ...*string) error {
 	return nil
 }
 
+// parseListen parses the parameters of a listen directive: an address,
+// optionally followed by "proxy-protocol" if connections are prefixed with a
+// PROXY protocol header.
+func (d *directive) parseListen() (addr string, proxyProtocol bool, err error) {
+	var opt string
+	switch len(d.Params) {
+	case 0, 1:
+		err = d.parseParams(&addr)
+	default:
+		err = d.parseParams(&addr, &opt)
+	}
+	if err != nil {
+		return "", false, err
+	}
+	if opt != "" && opt != "proxy-protocol" {
+		return "", false, fmt.Errorf("directive %q: unknown option %q", d.Name, opt)
+	}
+	return addr, opt == "proxy-protocol", nil
+}
+
 type parser struct {
 	br *bufio.Reader
 }
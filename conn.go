@@ -0,0 +1,102 @@
+package soju
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	"gopkg.in/irc.v3"
+	"nhooyr.io/websocket"
+)
+
+// ircConn is a connection carrying IRC messages, either over a raw stream or
+// over WebSocket.
+type ircConn interface {
+	ReadMessage() (*irc.Message, error)
+	WriteMessage(*irc.Message) error
+	Close() error
+	RemoteAddr() net.Addr
+	// TLSConnectionState returns the state of the TLS connection, or nil if
+	// the transport isn't TLS.
+	TLSConnectionState() *tls.ConnectionState
+}
+
+type netIRCConn struct {
+	*irc.Conn
+	net net.Conn
+}
+
+func newNetIRCConn(c net.Conn) ircConn {
+	return netIRCConn{irc.NewConn(c), c}
+}
+
+func (c netIRCConn) Close() error {
+	return c.net.Close()
+}
+
+func (c netIRCConn) RemoteAddr() net.Addr {
+	return c.net.RemoteAddr()
+}
+
+func (c netIRCConn) TLSConnectionState() *tls.ConnectionState {
+	tlsConn, ok := c.net.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	state := tlsConn.ConnectionState()
+	return &state
+}
+
+// websocketIRCConn carries one IRC message per WebSocket text frame, as
+// described in the IRCv3 WebSocket specification.
+type websocketIRCConn struct {
+	conn       *websocket.Conn
+	remoteAddr net.Addr
+	tlsState   *tls.ConnectionState
+}
+
+func (c websocketIRCConn) ReadMessage() (*irc.Message, error) {
+	typ, b, err := c.conn.Read(context.Background())
+	if err != nil {
+		if websocket.CloseStatus(err) == websocket.StatusNormalClosure {
+			err = io.EOF
+		}
+		return nil, err
+	}
+	if typ != websocket.MessageText {
+		return nil, fmt.Errorf("unexpected WebSocket message type: %v", typ)
+	}
+	// Be lenient with clients appending the usual line terminator
+	return irc.ParseMessage(strings.TrimRight(string(b), "\r\n"))
+}
+
+func (c websocketIRCConn) WriteMessage(msg *irc.Message) error {
+	return c.conn.Write(context.Background(), websocket.MessageText, []byte(msg.String()))
+}
+
+func (c websocketIRCConn) Close() error {
+	return c.conn.Close(websocket.StatusNormalClosure, "")
+}
+
+func (c websocketIRCConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+func (c websocketIRCConn) TLSConnectionState() *tls.ConnectionState {
+	return c.tlsState
+}
+
+// websocketAddr is the remote address of an HTTP request, which isn't
+// necessarily an IP address and port.
+type websocketAddr string
+
+func (addr websocketAddr) Network() string {
+	return "ws"
+}
+
+func (addr websocketAddr) String() string {
+	return string(addr)
+}
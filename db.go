@@ -2,19 +2,35 @@ package soju
 
 import (
 	"database/sql"
+	"fmt"
 	"sync"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 )
 
+// BacklogLimit limits the messages sent to a client when it connects. Zero
+// values disable the corresponding limit.
+type BacklogLimit struct {
+	MaxCount int
+	MaxAge   time.Duration
+}
+
 type User struct {
 	Username string
 	Password string // hashed
+	Admin    bool
+	// Overrides the server backlog limit if non-nil
+	BacklogLimit *BacklogLimit
+	// Text sent in reply to direct messages while no client is connected,
+	// disabled if empty
+	AutoReply string
 }
 
 type SASL struct {
 	Mechanism string
 
+	// Username and password, for the PLAIN and SCRAM-SHA-256 mechanisms
 	Plain struct {
 		Username string
 		Password string
@@ -29,11 +45,34 @@ type Network struct {
 	Realname string
 	Pass     string
 	SASL     SASL
+	OnDemand bool // only connect while a downstream connection is attached
+	// CapNegotiation controls when capabilities are negotiated during
+	// registration: "" (before NICK/USER), "late" (after NICK/USER) or "none"
+	// (never, for servers which don't support CAP).
+	CapNegotiation string
+	// SuppressServerNotices prevents NOTICEs sent by the server from being
+	// forwarded to downstream connections.
+	SuppressServerNotices bool
+	// Comma-separated lists of message tag patterns overriding which tags
+	// sent by the server are forwarded to downstream connections, see
+	// network.forwardsTag
+	ForwardTags string
+	DropTags    string
 }
 
 type Channel struct {
 	ID   int64
 	Name string
+	Key  string
+}
+
+// Setting is a user setting. Settings can be scoped to a network, or to a
+// channel of a network.
+type Setting struct {
+	NetworkID int64  // zero if not scoped to a network
+	Channel   string // empty if not scoped to a channel
+	Key       string
+	Value     string
 }
 
 type DB struct {
@@ -41,12 +80,149 @@ type DB struct {
 	db   *sql.DB
 }
 
+// Tables added to schema.sql since the first release. Databases created with
+// an older schema.sql are upgraded when opened.
+var upgradeTables = []string{
+	`CREATE TABLE IF NOT EXISTS CertFingerprint (
+		id INTEGER PRIMARY KEY,
+		user VARCHAR(255) NOT NULL,
+		sha256 VARCHAR(64) NOT NULL,
+		FOREIGN KEY(user) REFERENCES User(username),
+		UNIQUE(sha256)
+	)`,
+	`CREATE TABLE IF NOT EXISTS Setting (
+		id INTEGER PRIMARY KEY,
+		user VARCHAR(255) NOT NULL,
+		network INTEGER,
+		channel VARCHAR(255),
+		key VARCHAR(255) NOT NULL,
+		value VARCHAR(255) NOT NULL,
+		FOREIGN KEY(user) REFERENCES User(username),
+		FOREIGN KEY(network) REFERENCES Network(id)
+	)`,
+	`CREATE TABLE IF NOT EXISTS IgnoreMask (
+		id INTEGER PRIMARY KEY,
+		network INTEGER NOT NULL,
+		mask VARCHAR(255) NOT NULL,
+		FOREIGN KEY(network) REFERENCES Network(id),
+		UNIQUE(network, mask)
+	)`,
+	`CREATE TABLE IF NOT EXISTS ReadMarker (
+		id INTEGER PRIMARY KEY,
+		network INTEGER NOT NULL,
+		target VARCHAR(255) NOT NULL,
+		client VARCHAR(255) NOT NULL,
+		timestamp VARCHAR(255) NOT NULL,
+		FOREIGN KEY(network) REFERENCES Network(id),
+		UNIQUE(network, target, client)
+	)`,
+	`CREATE TABLE IF NOT EXISTS Metadata (
+		id INTEGER PRIMARY KEY,
+		user VARCHAR(255) NOT NULL,
+		network INTEGER,
+		target VARCHAR(255),
+		key VARCHAR(255) NOT NULL,
+		value TEXT NOT NULL,
+		FOREIGN KEY(user) REFERENCES User(username),
+		FOREIGN KEY(network) REFERENCES Network(id),
+		UNIQUE(user, network, target, key)
+	)`,
+}
+
+// Columns added to existing tables of schema.sql since the first release.
+var upgradeColumns = []struct {
+	table, column, def string
+}{
+	{"User", "admin", "INTEGER NOT NULL DEFAULT 0"},
+	{"User", "backlog_max_count", "INTEGER"},
+	{"User", "backlog_max_age", "INTEGER"},
+	{"User", "auto_reply", "VARCHAR(255)"},
+	{"Network", "on_demand", "INTEGER NOT NULL DEFAULT 0"},
+	{"Network", "cap_negotiation", "VARCHAR(255)"},
+	{"Network", "suppress_server_notices", "INTEGER NOT NULL DEFAULT 0"},
+	{"Network", "forward_tags", "VARCHAR(255)"},
+	{"Network", "drop_tags", "VARCHAR(255)"},
+}
+
 func OpenSQLDB(driver, source string) (*DB, error) {
-	db, err := sql.Open(driver, source)
+	sqlDB, err := sql.Open(driver, source)
+	if err != nil {
+		return nil, err
+	}
+	db := &DB{db: sqlDB}
+	if err := db.upgrade(); err != nil {
+		sqlDB.Close()
+		return nil, fmt.Errorf("failed to upgrade database: %v", err)
+	}
+	return db, nil
+}
+
+// upgrade adds the tables and columns missing from databases created with an
+// older schema.sql.
+func (db *DB) upgrade() error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	if columns, err := db.tableColumns("User"); err != nil {
+		return err
+	} else if len(columns) == 0 {
+		// The database hasn't been initialized with schema.sql yet
+		return nil
+	}
+
+	for _, stmt := range upgradeTables {
+		if _, err := db.db.Exec(stmt); err != nil {
+			return err
+		}
+	}
+
+	for _, col := range upgradeColumns {
+		columns, err := db.tableColumns(col.table)
+		if err != nil {
+			return err
+		}
+		if columns[col.column] {
+			continue
+		}
+		stmt := fmt.Sprintf("ALTER TABLE %v ADD COLUMN %v %v", col.table, col.column, col.def)
+		if _, err := db.db.Exec(stmt); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// tableColumns returns the names of the columns of a table. The map is empty
+// if the table doesn't exist. The caller must hold the lock.
+func (db *DB) tableColumns(table string) (map[string]bool, error) {
+	rows, err := db.db.Query(fmt.Sprintf("PRAGMA table_info(%v)", table))
 	if err != nil {
 		return nil, err
 	}
-	return &DB{db: db}, nil
+	defer rows.Close()
+
+	fields, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	columns := make(map[string]bool)
+	for rows.Next() {
+		values := make([]interface{}, len(fields))
+		var name string
+		for i := range values {
+			if fields[i] == "name" {
+				values[i] = &name
+			} else {
+				values[i] = new(interface{})
+			}
+		}
+		if err := rows.Scan(values...); err != nil {
+			return nil, err
+		}
+		columns[name] = true
+	}
+	return columns, rows.Err()
 }
 
 func (db *DB) Close() error {
@@ -73,7 +249,9 @@ func (db *DB) ListUsers() ([]User, error) {
 	db.lock.RLock()
 	defer db.lock.RUnlock()
 
-	rows, err := db.db.Query("SELECT username, password FROM User")
+	rows, err := db.db.Query(`SELECT username, password, admin,
+			backlog_max_count, backlog_max_age, auto_reply
+		FROM User`)
 	if err != nil {
 		return nil, err
 	}
@@ -82,11 +260,19 @@ func (db *DB) ListUsers() ([]User, error) {
 	var users []User
 	for rows.Next() {
 		var user User
-		var password *string
-		if err := rows.Scan(&user.Username, &password); err != nil {
+		var password, autoReply *string
+		var backlogMaxCount, backlogMaxAge *int64
+		if err := rows.Scan(&user.Username, &password, &user.Admin, &backlogMaxCount, &backlogMaxAge, &autoReply); err != nil {
 			return nil, err
 		}
 		user.Password = fromStringPtr(password)
+		user.AutoReply = fromStringPtr(autoReply)
+		if backlogMaxCount != nil && backlogMaxAge != nil {
+			user.BacklogLimit = &BacklogLimit{
+				MaxCount: int(*backlogMaxCount),
+				MaxAge:   time.Duration(*backlogMaxAge) * time.Second,
+			}
+		}
 		users = append(users, user)
 	}
 	if err := rows.Err(); err != nil {
@@ -96,12 +282,191 @@ func (db *DB) ListUsers() ([]User, error) {
 	return users, nil
 }
 
+// GetUser returns the user with the specified username, or nil if it doesn't
+// exist.
+func (db *DB) GetUser(username string) (*User, error) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	user := &User{Username: username}
+	var password, autoReply *string
+	var backlogMaxCount, backlogMaxAge *int64
+	err := db.db.QueryRow(`SELECT password, admin, backlog_max_count,
+			backlog_max_age, auto_reply
+		FROM User
+		WHERE username = ?`, username).Scan(&password, &user.Admin, &backlogMaxCount, &backlogMaxAge, &autoReply)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	user.Password = fromStringPtr(password)
+	user.AutoReply = fromStringPtr(autoReply)
+	if backlogMaxCount != nil && backlogMaxAge != nil {
+		user.BacklogLimit = &BacklogLimit{
+			MaxCount: int(*backlogMaxCount),
+			MaxAge:   time.Duration(*backlogMaxAge) * time.Second,
+		}
+	}
+	return user, nil
+}
+
 func (db *DB) CreateUser(user *User) error {
 	db.lock.Lock()
 	defer db.lock.Unlock()
 
 	password := toStringPtr(user.Password)
-	_, err := db.db.Exec("INSERT INTO User(username, password) VALUES (?, ?)", user.Username, password)
+	autoReply := toStringPtr(user.AutoReply)
+	backlogMaxCount, backlogMaxAge := backlogLimitToDB(user.BacklogLimit)
+	_, err := db.db.Exec(`INSERT INTO User(username, password, admin,
+			backlog_max_count, backlog_max_age, auto_reply)
+		VALUES (?, ?, ?, ?, ?, ?)`,
+		user.Username, password, user.Admin, backlogMaxCount, backlogMaxAge, autoReply)
+	return err
+}
+
+func (db *DB) UpdateUser(user *User) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	password := toStringPtr(user.Password)
+	autoReply := toStringPtr(user.AutoReply)
+	backlogMaxCount, backlogMaxAge := backlogLimitToDB(user.BacklogLimit)
+	_, err := db.db.Exec(`UPDATE User
+		SET password = ?, admin = ?, backlog_max_count = ?, backlog_max_age = ?,
+			auto_reply = ?
+		WHERE username = ?`,
+		password, user.Admin, backlogMaxCount, backlogMaxAge, autoReply, user.Username)
+	return err
+}
+
+func backlogLimitToDB(limit *BacklogLimit) (maxCount, maxAge *int64) {
+	if limit == nil {
+		return nil, nil
+	}
+	count := int64(limit.MaxCount)
+	age := int64(limit.MaxAge / time.Second)
+	return &count, &age
+}
+
+// ListCertFingerprints returns the SHA-256 fingerprints of the TLS client
+// certificates a user can authenticate with, hex-encoded.
+func (db *DB) ListCertFingerprints(username string) ([]string, error) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	rows, err := db.db.Query("SELECT sha256 FROM CertFingerprint WHERE user = ?", username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var fingerprints []string
+	for rows.Next() {
+		var fp string
+		if err := rows.Scan(&fp); err != nil {
+			return nil, err
+		}
+		fingerprints = append(fingerprints, fp)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return fingerprints, nil
+}
+
+// GetCertFingerprintUser returns the user owning a TLS client certificate
+// fingerprint. An empty username is returned if there is none.
+func (db *DB) GetCertFingerprintUser(fingerprint string) (string, error) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	var username string
+	err := db.db.QueryRow("SELECT user FROM CertFingerprint WHERE sha256 = ?", fingerprint).Scan(&username)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return username, err
+}
+
+func (db *DB) StoreCertFingerprint(username, fingerprint string) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	_, err := db.db.Exec("INSERT INTO CertFingerprint(user, sha256) VALUES (?, ?)", username, fingerprint)
+	return err
+}
+
+func (db *DB) DeleteCertFingerprint(username, fingerprint string) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	_, err := db.db.Exec("DELETE FROM CertFingerprint WHERE user = ? AND sha256 = ?", username, fingerprint)
+	return err
+}
+
+func (db *DB) ListSettings(username string) ([]Setting, error) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	rows, err := db.db.Query("SELECT network, channel, key, value FROM Setting WHERE user = ?", username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var settings []Setting
+	for rows.Next() {
+		var s Setting
+		var networkID sql.NullInt64
+		var channel *string
+		if err := rows.Scan(&networkID, &channel, &s.Key, &s.Value); err != nil {
+			return nil, err
+		}
+		s.NetworkID = networkID.Int64
+		s.Channel = fromStringPtr(channel)
+		settings = append(settings, s)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return settings, nil
+}
+
+func (db *DB) StoreSetting(username string, s *Setting) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	tx, err := db.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	networkID := sql.NullInt64{Int64: s.NetworkID, Valid: s.NetworkID != 0}
+	channel := toStringPtr(s.Channel)
+	_, err = tx.Exec("DELETE FROM Setting WHERE user = ? AND network IS ? AND channel IS ? AND key = ?",
+		username, networkID, channel, s.Key)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO Setting(user, network, channel, key, value) VALUES (?, ?, ?, ?, ?)",
+		username, networkID, channel, s.Key, s.Value)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (db *DB) DeleteSetting(username string, networkID int64, channel, key string) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	_, err := db.db.Exec("DELETE FROM Setting WHERE user = ? AND network IS ? AND channel IS ? AND key = ?",
+		username, sql.NullInt64{Int64: networkID, Valid: networkID != 0}, toStringPtr(channel), key)
 	return err
 }
 
@@ -110,7 +475,8 @@ func (db *DB) ListNetworks(username string) ([]Network, error) {
 	defer db.lock.RUnlock()
 
 	rows, err := db.db.Query(`SELECT id, addr, nick, username, realname, pass,
-			sasl_mechanism, sasl_plain_username, sasl_plain_password
+			sasl_mechanism, sasl_plain_username, sasl_plain_password, on_demand,
+			cap_negotiation, suppress_server_notices, forward_tags, drop_tags
 		FROM Network
 		WHERE user = ?`,
 		username)
@@ -124,8 +490,11 @@ func (db *DB) ListNetworks(username string) ([]Network, error) {
 		var net Network
 		var username, realname, pass *string
 		var saslMechanism, saslPlainUsername, saslPlainPassword *string
+		var capNegotiation, forwardTags, dropTags *string
 		err := rows.Scan(&net.ID, &net.Addr, &net.Nick, &username, &realname,
-			&pass, &saslMechanism, &saslPlainUsername, &saslPlainPassword)
+			&pass, &saslMechanism, &saslPlainUsername, &saslPlainPassword,
+			&net.OnDemand, &capNegotiation, &net.SuppressServerNotices,
+			&forwardTags, &dropTags)
 		if err != nil {
 			return nil, err
 		}
@@ -135,6 +504,9 @@ func (db *DB) ListNetworks(username string) ([]Network, error) {
 		net.SASL.Mechanism = fromStringPtr(saslMechanism)
 		net.SASL.Plain.Username = fromStringPtr(saslPlainUsername)
 		net.SASL.Plain.Password = fromStringPtr(saslPlainPassword)
+		net.CapNegotiation = fromStringPtr(capNegotiation)
+		net.ForwardTags = fromStringPtr(forwardTags)
+		net.DropTags = fromStringPtr(dropTags)
 		networks = append(networks, net)
 	}
 	if err := rows.Err(); err != nil {
@@ -151,12 +523,15 @@ func (db *DB) StoreNetwork(username string, network *Network) error {
 	netUsername := toStringPtr(network.Username)
 	realname := toStringPtr(network.Realname)
 	pass := toStringPtr(network.Pass)
+	capNegotiation := toStringPtr(network.CapNegotiation)
+	forwardTags := toStringPtr(network.ForwardTags)
+	dropTags := toStringPtr(network.DropTags)
 
 	var saslMechanism, saslPlainUsername, saslPlainPassword *string
 	if network.SASL.Mechanism != "" {
 		saslMechanism = &network.SASL.Mechanism
 		switch network.SASL.Mechanism {
-		case "PLAIN":
+		case "PLAIN", "SCRAM-SHA-256":
 			saslPlainUsername = toStringPtr(network.SASL.Plain.Username)
 			saslPlainPassword = toStringPtr(network.SASL.Plain.Password)
 		}
@@ -166,18 +541,24 @@ func (db *DB) StoreNetwork(username string, network *Network) error {
 	if network.ID != 0 {
 		_, err = db.db.Exec(`UPDATE Network
 			SET addr = ?, nick = ?, username = ?, realname = ?, pass = ?,
-				sasl_mechanism = ?, sasl_plain_username = ?, sasl_plain_password = ?
+				sasl_mechanism = ?, sasl_plain_username = ?, sasl_plain_password = ?,
+				on_demand = ?, cap_negotiation = ?, suppress_server_notices = ?,
+				forward_tags = ?, drop_tags = ?
 			WHERE id = ?`,
 			network.Addr, network.Nick, netUsername, realname, pass,
-			saslMechanism, saslPlainUsername, saslPlainPassword, network.ID)
+			saslMechanism, saslPlainUsername, saslPlainPassword,
+			network.OnDemand, capNegotiation, network.SuppressServerNotices,
+			forwardTags, dropTags, network.ID)
 	} else {
 		var res sql.Result
 		res, err = db.db.Exec(`INSERT INTO Network(user, addr, nick, username,
 				realname, pass, sasl_mechanism, sasl_plain_username,
-				sasl_plain_password)
-			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+				sasl_plain_password, on_demand, cap_negotiation,
+				suppress_server_notices, forward_tags, drop_tags)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
 			username, network.Addr, network.Nick, netUsername, realname, pass,
-			saslMechanism, saslPlainUsername, saslPlainPassword)
+			saslMechanism, saslPlainUsername, saslPlainPassword, network.OnDemand,
+			capNegotiation, network.SuppressServerNotices, forwardTags, dropTags)
 		if err != nil {
 			return err
 		}
@@ -186,11 +567,45 @@ func (db *DB) StoreNetwork(username string, network *Network) error {
 	return err
 }
 
+// DeleteNetwork deletes a network, along with its channels, settings, ignore
+// masks, read markers and channel metadata.
+func (db *DB) DeleteNetwork(id int64) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	tx, err := db.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM Setting WHERE network = ?", id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM Channel WHERE network = ?", id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM IgnoreMask WHERE network = ?", id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM ReadMarker WHERE network = ?", id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM Metadata WHERE network = ?", id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM Network WHERE id = ?", id); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
 func (db *DB) ListChannels(networkID int64) ([]Channel, error) {
 	db.lock.RLock()
 	defer db.lock.RUnlock()
 
-	rows, err := db.db.Query("SELECT id, name FROM Channel WHERE network = ?", networkID)
+	rows, err := db.db.Query("SELECT id, name, key FROM Channel WHERE network = ?", networkID)
 	if err != nil {
 		return nil, err
 	}
@@ -199,9 +614,11 @@ func (db *DB) ListChannels(networkID int64) ([]Channel, error) {
 	var channels []Channel
 	for rows.Next() {
 		var ch Channel
-		if err := rows.Scan(&ch.ID, &ch.Name); err != nil {
+		var key *string
+		if err := rows.Scan(&ch.ID, &ch.Name, &key); err != nil {
 			return nil, err
 		}
+		ch.Key = fromStringPtr(key)
 		channels = append(channels, ch)
 	}
 	if err := rows.Err(); err != nil {
@@ -215,7 +632,8 @@ func (db *DB) StoreChannel(networkID int64, ch *Channel) error {
 	db.lock.Lock()
 	defer db.lock.Unlock()
 
-	_, err := db.db.Exec("INSERT OR REPLACE INTO Channel(network, name) VALUES (?, ?)", networkID, ch.Name)
+	key := toStringPtr(ch.Key)
+	_, err := db.db.Exec("INSERT OR REPLACE INTO Channel(network, name, key) VALUES (?, ?, ?)", networkID, ch.Name, key)
 	return err
 }
 
@@ -226,3 +644,134 @@ func (db *DB) DeleteChannel(networkID int64, name string) error {
 	_, err := db.db.Exec("DELETE FROM Channel WHERE network = ? AND name = ?", networkID, name)
 	return err
 }
+
+// ListIgnoreMasks returns the nick!user@host masks ignored on a network.
+func (db *DB) ListIgnoreMasks(networkID int64) ([]string, error) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	rows, err := db.db.Query("SELECT mask FROM IgnoreMask WHERE network = ?", networkID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var masks []string
+	for rows.Next() {
+		var mask string
+		if err := rows.Scan(&mask); err != nil {
+			return nil, err
+		}
+		masks = append(masks, mask)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return masks, nil
+}
+
+func (db *DB) StoreIgnoreMask(networkID int64, mask string) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	_, err := db.db.Exec("INSERT OR REPLACE INTO IgnoreMask(network, mask) VALUES (?, ?)", networkID, mask)
+	return err
+}
+
+func (db *DB) DeleteIgnoreMask(networkID int64, mask string) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	_, err := db.db.Exec("DELETE FROM IgnoreMask WHERE network = ? AND mask = ?", networkID, mask)
+	return err
+}
+
+// GetReadMarker returns the time up to which a target has been read by a
+// client. A zero time is returned if there is no read marker.
+func (db *DB) GetReadMarker(networkID int64, target, client string) (time.Time, error) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	var s string
+	err := db.db.QueryRow("SELECT timestamp FROM ReadMarker WHERE network = ? AND target = ? AND client = ?",
+		networkID, target, client).Scan(&s)
+	if err == sql.ErrNoRows {
+		return time.Time{}, nil
+	} else if err != nil {
+		return time.Time{}, err
+	}
+	return time.Parse(time.RFC3339Nano, s)
+}
+
+func (db *DB) StoreReadMarker(networkID int64, target, client string, t time.Time) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	_, err := db.db.Exec("INSERT OR REPLACE INTO ReadMarker(network, target, client, timestamp) VALUES (?, ?, ?, ?)",
+		networkID, target, client, t.UTC().Format(time.RFC3339Nano))
+	return err
+}
+
+// ListMetadata returns the metadata keys and values set on a target. The
+// user's own nick is designated by a zero network ID and an empty target.
+func (db *DB) ListMetadata(username string, networkID int64, target string) (map[string]string, error) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	rows, err := db.db.Query("SELECT key, value FROM Metadata WHERE user = ? AND network IS ? AND target IS ?",
+		username, sql.NullInt64{Int64: networkID, Valid: networkID != 0}, toStringPtr(target))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	values := make(map[string]string)
+	for rows.Next() {
+		var key, value string
+		if err := rows.Scan(&key, &value); err != nil {
+			return nil, err
+		}
+		values[key] = value
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return values, nil
+}
+
+func (db *DB) StoreMetadata(username string, networkID int64, target, key, value string) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	tx, err := db.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	networkIDValue := sql.NullInt64{Int64: networkID, Valid: networkID != 0}
+	targetValue := toStringPtr(target)
+	_, err = tx.Exec("DELETE FROM Metadata WHERE user = ? AND network IS ? AND target IS ? AND key = ?",
+		username, networkIDValue, targetValue, key)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO Metadata(user, network, target, key, value) VALUES (?, ?, ?, ?, ?)",
+		username, networkIDValue, targetValue, key, value)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (db *DB) DeleteMetadata(username string, networkID int64, target, key string) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	_, err := db.db.Exec("DELETE FROM Metadata WHERE user = ? AND network IS ? AND target IS ? AND key = ?",
+		username, sql.NullInt64{Int64: networkID, Valid: networkID != 0}, toStringPtr(target), key)
+	return err
+}
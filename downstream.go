@@ -1,11 +1,16 @@
 package soju
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
 	"crypto/tls"
-	"encoding/base64"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"net"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -13,6 +18,7 @@ import (
 
 	"github.com/emersion/go-sasl"
 	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/time/rate"
 	"gopkg.in/irc.v3"
 )
 
@@ -51,57 +57,85 @@ var errAuthFailed = ircError{&irc.Message{
 	Params:  []string{"*", "Invalid username or password"},
 }}
 
+var errServerPasswordMismatch = ircError{&irc.Message{
+	Command: irc.ERR_PASSWDMISMATCH,
+	Params:  []string{"*", "Invalid server password"},
+}}
+
+var errClientNameInUse = ircError{&irc.Message{
+	Command: irc.ERR_PASSWDMISMATCH,
+	Params:  []string{"*", "Client name already in use"},
+}}
+
 type ringMessage struct {
 	consumer     *RingConsumer
 	upstreamConn *upstreamConn
 }
 
 type downstreamConn struct {
-	net          net.Conn
-	irc          *irc.Conn
+	conn         ircConn
 	srv          *Server
 	logger       Logger
 	outgoing     chan *irc.Message
 	ringMessages chan ringMessage
 	closed       chan struct{}
+	floodLimiter *rate.Limiter
 
 	registered  bool
 	user        *user
-	nick        string
+	nick        string // see updateNick
 	username    string
 	rawUsername string
+	clientName  string // see unmarshalUsername
 	realname    string
 	password    string   // empty after authentication
 	network     *network // can be nil
 
+	// Network ID requested with BOUNCER BIND, applied on registration
+	bindNetworkID int64
+
 	negociatingCaps bool
 	capVersion      int
 	caps            map[string]bool
 
-	saslServer sasl.Server
+	saslServer   sasl.Server
+	saslResponse saslPayloadDecoder
+
+	monitored map[string]*downstreamMonitor
+	// Metadata keys the client is subscribed to
+	metadataSubs map[string]struct{}
 
-	lock        sync.Mutex
-	ourMessages map[*irc.Message]struct{}
+	lock         sync.Mutex
+	ourMessages  map[*irc.Message]struct{}
+	lastReceived time.Time
 }
 
-func newDownstreamConn(srv *Server, netConn net.Conn) *downstreamConn {
+func newDownstreamConn(srv *Server, ic ircConn) *downstreamConn {
+	floodLimit := rate.Inf
+	if srv.DownstreamFloodRate > 0 {
+		floodLimit = rate.Limit(srv.DownstreamFloodRate)
+	}
+
 	dc := &downstreamConn{
-		net:          netConn,
-		irc:          irc.NewConn(netConn),
+		conn:         ic,
 		srv:          srv,
-		logger:       &prefixLogger{srv.Logger, fmt.Sprintf("downstream %q: ", netConn.RemoteAddr())},
+		logger:       &prefixLogger{srv.Logger, fmt.Sprintf("downstream %q: ", ic.RemoteAddr())},
 		outgoing:     make(chan *irc.Message, 64),
 		ringMessages: make(chan ringMessage),
 		closed:       make(chan struct{}),
+		floodLimiter: rate.NewLimiter(floodLimit, srv.DownstreamFloodBurst),
 		caps:         make(map[string]bool),
 		ourMessages:  make(map[*irc.Message]struct{}),
+		monitored:    make(map[string]*downstreamMonitor),
+		metadataSubs: make(map[string]struct{}),
+		lastReceived: time.Now(),
 	}
 
 	go func() {
 		if err := dc.writeMessages(); err != nil {
 			dc.logger.Printf("failed to write message: %v", err)
 		}
-		if err := dc.net.Close(); err != nil {
+		if err := dc.conn.Close(); err != nil {
 			dc.logger.Printf("failed to close connection: %v", err)
 		} else {
 			dc.logger.Printf("connection closed")
@@ -154,6 +188,25 @@ func (dc *downstreamConn) upstream() *upstreamConn {
 	return upstream
 }
 
+// updateNick synchronizes the downstream nick with the nick of the upstream
+// connection uc.
+//
+// In single-upstream mode, the downstream nick follows the upstream nick. In
+// multi-upstream mode, each network may use a different nick: dc.nick is the
+// nick chosen by the client and is never changed by upstream nick changes,
+// upstream nicks are marshaled to it instead.
+func (dc *downstreamConn) updateNick(uc *upstreamConn) {
+	if dc.network != uc.network || uc.nick == dc.nick {
+		return
+	}
+	dc.SendMessage(&irc.Message{
+		Prefix:  dc.prefix(),
+		Command: "NICK",
+		Params:  []string{uc.nick},
+	})
+	dc.nick = uc.nick
+}
+
 func (dc *downstreamConn) unmarshalChannel(name string) (*upstreamConn, string, error) {
 	if uc := dc.upstream(); uc != nil {
 		return uc, name, nil
@@ -177,12 +230,54 @@ func (dc *downstreamConn) unmarshalChannel(name string) (*upstreamConn, string,
 	if channel == nil {
 		return nil, "", ircError{&irc.Message{
 			Command: irc.ERR_NOSUCHCHANNEL,
-			Params:  []string{name, "No such channel"},
+			Params:  []string{dc.nick, name, "No such channel"},
 		}}
 	}
 	return channel.conn, channel.Name, nil
 }
 
+func (dc *downstreamConn) unmarshalNick(nick string) (*upstreamConn, string, error) {
+	if uc := dc.upstream(); uc != nil {
+		if nick == dc.nick {
+			return uc, uc.nick, nil
+		}
+		return uc, nick, nil
+	}
+
+	// TODO: extract network name from nick if dc.upstream == nil
+	var conn *upstreamConn
+	var err error
+	dc.forEachUpstream(func(uc *upstreamConn) {
+		if err != nil {
+			return
+		}
+		for _, ch := range uc.channels {
+			if _, ok := ch.Members[nick]; !ok {
+				continue
+			}
+			if conn != nil && conn != uc {
+				err = fmt.Errorf("ambiguous nick %q", nick)
+			} else {
+				conn = uc
+			}
+			break
+		}
+	})
+	if err != nil {
+		return nil, "", ircError{&irc.Message{
+			Command: irc.ERR_NOSUCHNICK,
+			Params:  []string{dc.nick, nick, err.Error()},
+		}}
+	}
+	if conn == nil {
+		return nil, "", ircError{&irc.Message{
+			Command: irc.ERR_NOSUCHNICK,
+			Params:  []string{dc.nick, nick, "No such nick"},
+		}}
+	}
+	return conn, nick, nil
+}
+
 func (dc *downstreamConn) marshalNick(uc *upstreamConn, nick string) string {
 	if nick == uc.nick {
 		return dc.nick
@@ -190,6 +285,75 @@ func (dc *downstreamConn) marshalNick(uc *upstreamConn, nick string) string {
 	return nick
 }
 
+// channelTypes returns the channel types to advertise in RPL_ISUPPORT. In
+// multi-upstream mode, this is the union of the channel types of all upstream
+// connections.
+func (dc *downstreamConn) channelTypes() string {
+	var types []byte
+	dc.forEachUpstream(func(uc *upstreamConn) {
+		for i := 0; i < len(uc.availableChannelTypes); i++ {
+			t := uc.availableChannelTypes[i]
+			if bytes.IndexByte(types, t) < 0 {
+				types = append(types, t)
+			}
+		}
+	})
+	if len(types) == 0 {
+		return stdChannelTypes
+	}
+	return string(types)
+}
+
+// isupport returns the RPL_ISUPPORT parameters to send to the client. WHOX is
+// only advertised if all upstream connections support it.
+func (dc *downstreamConn) isupport() []string {
+	supportsWHOX := true
+	dc.forEachUpstream(func(uc *upstreamConn) {
+		if !uc.supportsWHOX {
+			supportsWHOX = false
+		}
+	})
+
+	params := []string{dc.nick, "CHANTYPES=" + dc.channelTypes(), "ELIST=U", fmt.Sprintf("MONITOR=%v", monitorLimit)}
+	if supportsWHOX {
+		params = append(params, "WHOX")
+	}
+	if dc.network != nil {
+		params = append(params, fmt.Sprintf("BOUNCER_NETID=%v", dc.network.ID))
+	}
+	return append(params, "are supported")
+}
+
+// sendStandardReply sends a FAIL, WARN or NOTE standard reply. Clients which
+// don't support standard replies get a NOTICE instead.
+func (dc *downstreamConn) sendStandardReply(typ, cmd, code string, context []string, description string) {
+	if !dc.caps["draft/standard-replies"] {
+		dc.SendMessage(&irc.Message{
+			Prefix:  dc.srv.prefix(),
+			Command: "NOTICE",
+			Params:  []string{dc.nick, description},
+		})
+		return
+	}
+
+	params := append([]string{cmd, code}, context...)
+	params = append(params, description)
+	dc.SendMessage(&irc.Message{
+		Prefix:  dc.srv.prefix(),
+		Command: typ,
+		Params:  params,
+	})
+}
+
+// marshalTarget marshals a PRIVMSG or NOTICE target, which is either a channel
+// or a nick.
+func (dc *downstreamConn) marshalTarget(uc *upstreamConn, target string) string {
+	if uc.isChannel(target) {
+		return dc.marshalChannel(uc, target)
+	}
+	return dc.marshalNick(uc, target)
+}
+
 func (dc *downstreamConn) marshalUserPrefix(uc *upstreamConn, prefix *irc.Prefix) *irc.Prefix {
 	if prefix.Name == uc.nick {
 		return dc.prefix()
@@ -197,6 +361,30 @@ func (dc *downstreamConn) marshalUserPrefix(uc *upstreamConn, prefix *irc.Prefix
 	return prefix
 }
 
+// marshalMessage prepares a message forwarded from an upstream connection to
+// be sent to the downstream connection.
+func (dc *downstreamConn) marshalMessage(msg *irc.Message, uc *upstreamConn) *irc.Message {
+	addNetworkTag := dc.caps["message-tags"] && dc.caps["soju.im/network"]
+	if len(msg.Tags) == 0 && !addNetworkTag {
+		return msg
+	}
+
+	msg = msg.Copy()
+	for name := range msg.Tags {
+		supported := dc.caps["message-tags"]
+		if name == "account" {
+			supported = dc.caps["account-tag"]
+		}
+		if !supported || !uc.network.forwardsTag(name) {
+			delete(msg.Tags, name)
+		}
+	}
+	if addNetworkTag {
+		msg.Tags["soju.im/network"] = irc.TagValue(uc.network.Addr)
+	}
+	return msg
+}
+
 func (dc *downstreamConn) isClosed() bool {
 	select {
 	case <-dc.closed:
@@ -206,11 +394,73 @@ func (dc *downstreamConn) isClosed() bool {
 	}
 }
 
+// readMessage reads a message from the client, and records when it was
+// received for sendPings.
+func (dc *downstreamConn) readMessage() (*irc.Message, error) {
+	msg, err := dc.conn.ReadMessage()
+	if err != nil {
+		return nil, err
+	}
+
+	dc.lock.Lock()
+	dc.lastReceived = time.Now()
+	dc.lock.Unlock()
+	return msg, nil
+}
+
+// sendPings sends a PING to the client whenever the connection has been idle
+// for DownstreamPingInterval, and closes the connection if nothing is
+// received within DownstreamPingTimeout after that, until the connection is
+// closed.
+func (dc *downstreamConn) sendPings() {
+	interval := dc.srv.DownstreamPingInterval
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+
+	var pingTime time.Time
+	for {
+		select {
+		case <-timer.C:
+		case <-dc.closed:
+			return
+		}
+
+		dc.lock.Lock()
+		lastReceived := dc.lastReceived
+		dc.lock.Unlock()
+
+		if !pingTime.IsZero() {
+			if lastReceived.Before(pingTime) {
+				dc.logger.Printf("ping timeout")
+				// Makes readMessages fail, which closes the connection
+				if err := dc.conn.Close(); err != nil {
+					dc.logger.Printf("failed to close connection: %v", err)
+				}
+				return
+			}
+			pingTime = time.Time{}
+		}
+
+		if idle := time.Since(lastReceived); idle < interval {
+			timer.Reset(interval - idle)
+			continue
+		}
+
+		dc.SendMessage(&irc.Message{
+			Prefix:  dc.srv.prefix(),
+			Command: "PING",
+			Params:  []string{keepAlivePingToken},
+		})
+		pingTime = time.Now()
+		timer.Reset(dc.srv.DownstreamPingTimeout)
+	}
+}
+
 func (dc *downstreamConn) readMessages(ch chan<- downstreamIncomingMessage) error {
 	dc.logger.Printf("new connection")
 
 	for {
-		msg, err := dc.irc.ReadMessage()
+		msg, err := dc.readMessage()
 		if err == io.EOF {
 			break
 		} else if err != nil {
@@ -221,6 +471,12 @@ func (dc *downstreamConn) readMessages(ch chan<- downstreamIncomingMessage) erro
 			dc.logger.Printf("received: %v", msg)
 		}
 
+		// Delay commands exceeding the flood limit, to avoid hogging the
+		// user's goroutine
+		if err := dc.floodLimiter.Wait(context.Background()); err != nil {
+			return fmt.Errorf("flood limiter failed: %v", err)
+		}
+
 		ch <- downstreamIncomingMessage{msg, dc}
 	}
 
@@ -236,7 +492,7 @@ func (dc *downstreamConn) writeMessages() error {
 			if dc.srv.Debug {
 				dc.logger.Printf("sent: %v", msg)
 			}
-			err = dc.irc.WriteMessage(msg)
+			err = dc.conn.WriteMessage(msg)
 		case ringMessage := <-dc.ringMessages:
 			consumer, uc := ringMessage.consumer, ringMessage.upstreamConn
 			for {
@@ -261,13 +517,20 @@ func (dc *downstreamConn) writeMessages() error {
 				case "PRIVMSG":
 					// TODO: detect whether it's a user or a channel
 					msg.Params[0] = dc.marshalChannel(uc, msg.Params[0])
+				case "TAGMSG":
+					if !dc.caps["message-tags"] {
+						consumer.Consume()
+						continue
+					}
+					msg.Params[0] = dc.marshalTarget(uc, msg.Params[0])
 				default:
-					panic("expected to consume a PRIVMSG message")
+					panic("expected to consume a PRIVMSG or TAGMSG message")
 				}
+				msg = dc.marshalMessage(msg, uc)
 				if dc.srv.Debug {
 					dc.logger.Printf("sent: %v", msg)
 				}
-				err = dc.irc.WriteMessage(msg)
+				err = dc.conn.WriteMessage(msg)
 				if err != nil {
 					break
 				}
@@ -300,9 +563,18 @@ func (dc *downstreamConn) Close() error {
 			}
 		}
 		u.lock.Unlock()
+
+		u.forEachNetwork(func(net *network) {
+			net.notifyDownstreamsChanged()
+		})
+
+		u.cancelPendingLISTs(dc)
 	}
 
 	close(dc.closed)
+	if u := dc.user; u != nil {
+		u.notifyDownstreamClosed()
+	}
 	return nil
 }
 
@@ -314,9 +586,18 @@ func (dc *downstreamConn) handleMessage(msg *irc.Message) error {
 	switch msg.Command {
 	case "QUIT":
 		return dc.Close()
+	case "PONG":
+		// Ignore: replies to the PINGs sent by sendPings
+		return nil
 	default:
 		if dc.registered {
-			return dc.handleMessageRegistered(msg)
+			err := dc.handleMessageRegistered(msg)
+			if err == errUpstreamFlooded {
+				dc.sendStandardReply("FAIL", msg.Command, "TEMPORARILY_UNAVAILABLE", nil,
+					"Too many messages are waiting to be sent to the server, try again later")
+				return nil
+			}
+			return err
 		} else {
 			return dc.handleMessageUnregistered(msg)
 		}
@@ -370,11 +651,20 @@ func (dc *downstreamConn) handleMessageUnregistered(msg *irc.Message) error {
 		var resp []byte
 		if dc.saslServer == nil {
 			mech := strings.ToUpper(msg.Params[0])
+			if !dc.hasSASLMechanism(mech) {
+				return ircError{&irc.Message{
+					Command: err_saslfail,
+					Params:  []string{"*", fmt.Sprintf("Unsupported SASL mechanism %q", mech)},
+				}}
+			}
+
 			switch mech {
 			case "PLAIN":
 				dc.saslServer = sasl.NewPlainServer(sasl.PlainAuthenticator(func(identity, username, password string) error {
 					return dc.authenticate(username, password)
 				}))
+			case "EXTERNAL":
+				dc.saslServer = &saslExternalServer{authenticate: dc.authenticateCert}
 			default:
 				return ircError{&irc.Message{
 					Command: err_saslfail,
@@ -383,22 +673,30 @@ func (dc *downstreamConn) handleMessageUnregistered(msg *irc.Message) error {
 			}
 		} else if msg.Params[0] == "*" {
 			dc.saslServer = nil
+			dc.saslResponse.reset()
 			return ircError{&irc.Message{
 				Command: err_saslaborted,
 				Params:  []string{"*", "SASL authentication aborted"},
 			}}
-		} else if msg.Params[0] == "+" {
-			resp = nil
 		} else {
-			// TODO: multi-line messages
+			var more bool
 			var err error
-			resp, err = base64.StdEncoding.DecodeString(msg.Params[0])
+			resp, more, err = dc.saslResponse.decode(msg.Params[0])
 			if err != nil {
 				dc.saslServer = nil
+				if err == errSASLTooLong {
+					return ircError{&irc.Message{
+						Command: err_sasltoolong,
+						Params:  []string{"*", "SASL message too long"},
+					}}
+				}
 				return ircError{&irc.Message{
 					Command: err_saslfail,
 					Params:  []string{"*", "Invalid base64-encoded response"},
 				}}
+			} else if more {
+				// Wait for the rest of the response
+				return nil
 			}
 		}
 
@@ -430,17 +728,17 @@ func (dc *downstreamConn) handleMessageUnregistered(msg *irc.Message) error {
 				Params:  []string{dc.nick, "SASL authentication successful"},
 			})
 		} else {
-			challengeStr := "+"
-			if challenge != nil {
-				challengeStr = base64.StdEncoding.EncodeToString(challenge)
+			for _, chunk := range encodeSASLPayload(challenge) {
+				dc.SendMessage(&irc.Message{
+					Prefix:  dc.srv.prefix(),
+					Command: "AUTHENTICATE",
+					Params:  []string{chunk},
+				})
 			}
-
-			// TODO: multi-line messages
-			dc.SendMessage(&irc.Message{
-				Prefix:  dc.srv.prefix(),
-				Command: "AUTHENTICATE",
-				Params:  []string{challengeStr},
-			})
+		}
+	case "BOUNCER":
+		if err := dc.handleBouncerUnregistered(msg); err != nil {
+			return err
 		}
 	default:
 		dc.logger.Printf("unhandled message: %v", msg)
@@ -452,6 +750,167 @@ func (dc *downstreamConn) handleMessageUnregistered(msg *irc.Message) error {
 	return nil
 }
 
+// saslMechanisms returns the list of SASL mechanisms offered to this
+// downstream connection. The list depends on the transport and on the server
+// configuration, and is advertised in the "sasl" capability value.
+func (dc *downstreamConn) saslMechanisms() []string {
+	mechs := []string{"PLAIN"}
+	if dc.isTLS() {
+		mechs = append(mechs, "EXTERNAL")
+	}
+	return mechs
+}
+
+func (dc *downstreamConn) isTLS() bool {
+	return dc.conn.TLSConnectionState() != nil
+}
+
+// saslExternalServer implements the server side of the SASL EXTERNAL
+// mechanism. The client is authenticated by its TLS certificate, the response
+// only contains the optional authorization identity.
+type saslExternalServer struct {
+	authenticate func(identity string) error
+	started      bool
+}
+
+func (s *saslExternalServer) Next(response []byte) (challenge []byte, done bool, err error) {
+	if !s.started {
+		s.started = true
+		return nil, false, nil
+	}
+	return nil, true, s.authenticate(string(response))
+}
+
+// supportedCaps returns the capabilities supported for this downstream
+// connection, with their values.
+func (dc *downstreamConn) supportedCaps() map[string]string {
+	caps := map[string]string{
+		"batch":                           "",
+		"message-tags":                    "",
+		"soju.im/bouncer-networks":        "",
+		"soju.im/bouncer-networks-notify": "",
+		"soju.im/network":                 "",
+		"draft/metadata":                  fmt.Sprintf("max-subs=%v,max-keys=%v", metadataMaxSubs, metadataMaxKeys),
+		"draft/no-implicit-names":         "",
+		"draft/read-marker":               "",
+		"draft/standard-replies":          "",
+		"userhost-in-names":               "",
+	}
+	if mechs := dc.saslMechanisms(); len(mechs) > 0 {
+		caps["sasl"] = strings.Join(mechs, ",")
+	}
+	if dc.srv.CollapseNetsplits {
+		caps["soju.im/raw-netsplits"] = ""
+	}
+	for _, name := range upstreamDependentCaps {
+		if dc.upstreamsSupportCap(name) {
+			caps[name] = ""
+		}
+	}
+	return caps
+}
+
+// Client tags carrying typing notifications and reactions, relayed between the
+// downstream connections of a user. The +draft/reply tag is relayed along with
+// them, to indicate which message a reaction refers to.
+var relayedClientTags = []string{"+typing", "+draft/typing", "+draft/react"}
+
+// Capabilities only offered to downstream connections if all upstream
+// connections have enabled them.
+var upstreamDependentCaps = []string{"account-notify", "account-tag", "away-notify", "chghost", "setname"}
+
+// capRejectionReason explains why a capability requested by the client isn't
+// supported.
+func (dc *downstreamConn) capRejectionReason(name string) (code, description string) {
+	dependent := false
+	for _, c := range upstreamDependentCaps {
+		if c == name {
+			dependent = true
+			break
+		}
+	}
+	if !dependent {
+		return "UNKNOWN_CAP", fmt.Sprintf("Capability %q is not supported", name)
+	}
+
+	var networks []string
+	dc.forEachUpstream(func(uc *upstreamConn) {
+		if !uc.enabledCaps[name] {
+			networks = append(networks, uc.network.Addr)
+		}
+	})
+	return "UPSTREAM_UNSUPPORTED", fmt.Sprintf("Capability %q is not supported by these networks: %v", name, strings.Join(networks, ", "))
+}
+
+// upstreamsSupportCap checks whether all upstream connections have enabled a
+// capability. Before authentication, the upstream connections aren't known
+// and the capability is assumed to be supported.
+func (dc *downstreamConn) upstreamsSupportCap(name string) bool {
+	if dc.user == nil {
+		return true
+	}
+	supported := true
+	dc.forEachUpstream(func(uc *upstreamConn) {
+		if !uc.enabledCaps[name] {
+			supported = false
+		}
+	})
+	return supported
+}
+
+func (dc *downstreamConn) hasSASLMechanism(mech string) bool {
+	for _, m := range dc.saslMechanisms() {
+		if m == mech {
+			return true
+		}
+	}
+	return false
+}
+
+// sendCapReply sends a CAP LS or LIST reply. Clients which support CAP
+// version 302 get multiple messages if the list doesn't fit in one.
+func (dc *downstreamConn) sendCapReply(replyTo, subCmd string, caps []string) {
+	if dc.capVersion < 302 {
+		dc.SendMessage(&irc.Message{
+			Prefix:  dc.srv.prefix(),
+			Command: "CAP",
+			Params:  []string{replyTo, subCmd, strings.Join(caps, " ")},
+		})
+		return
+	}
+
+	// Space left for the list of capabilities in a message, once the
+	// prefix, the command, the parameters and the CRLF are written
+	header := fmt.Sprintf(":%v CAP %v %v * :", dc.srv.prefix(), replyTo, subCmd)
+	maxLen := 512 - len(header) - 2
+
+	var lines []string
+	var cur string
+	for _, c := range caps {
+		if cur != "" && len(cur)+1+len(c) > maxLen {
+			lines = append(lines, cur)
+			cur = ""
+		}
+		if cur != "" {
+			cur += " "
+		}
+		cur += c
+	}
+	lines = append(lines, cur)
+
+	for i, line := range lines {
+		params := []string{replyTo, subCmd, line}
+		if i < len(lines)-1 {
+			params = []string{replyTo, subCmd, "*", line}
+		}
+		dc.SendMessage(&irc.Message{
+			Prefix:  dc.srv.prefix(),
+			Command: "CAP",
+			Params:  params,
+		})
+	}
+}
+
 func (dc *downstreamConn) handleCapCommand(cmd string, args []string) error {
 	cmd = strings.ToUpper(cmd)
 
@@ -470,34 +929,29 @@ func (dc *downstreamConn) handleCapCommand(cmd string, args []string) error {
 		}
 
 		var caps []string
-		if dc.capVersion >= 302 {
-			caps = append(caps, "sasl=PLAIN")
-		} else {
-			caps = append(caps, "sasl")
+		for name, value := range dc.supportedCaps() {
+			if dc.capVersion >= 302 && value != "" {
+				name += "=" + value
+			}
+			caps = append(caps, name)
 		}
+		sort.Strings(caps)
 
-		// TODO: multi-line replies
-		dc.SendMessage(&irc.Message{
-			Prefix:  dc.srv.prefix(),
-			Command: "CAP",
-			Params:  []string{replyTo, "LS", strings.Join(caps, " ")},
-		})
+		dc.sendCapReply(replyTo, "LS", caps)
 
 		if !dc.registered {
 			dc.negociatingCaps = true
 		}
 	case "LIST":
 		var caps []string
-		for name := range dc.caps {
-			caps = append(caps, name)
+		for name, enabled := range dc.caps {
+			if enabled {
+				caps = append(caps, name)
+			}
 		}
+		sort.Strings(caps)
 
-		// TODO: multi-line replies
-		dc.SendMessage(&irc.Message{
-			Prefix:  dc.srv.prefix(),
-			Command: "CAP",
-			Params:  []string{replyTo, "LIST", strings.Join(caps, " ")},
-		})
+		dc.sendCapReply(replyTo, "LIST", caps)
 	case "REQ":
 		if len(args) == 0 {
 			return ircError{&irc.Message{
@@ -506,31 +960,41 @@ func (dc *downstreamConn) handleCapCommand(cmd string, args []string) error {
 			}}
 		}
 
-		caps := strings.Fields(args[0])
+		// The request is atomic: validate all the changes before applying
+		// any of them
+		supportedCaps := dc.supportedCaps()
+		changes := make(map[string]bool)
 		ack := true
-		for _, name := range caps {
+		for _, name := range strings.Fields(args[0]) {
 			name = strings.ToLower(name)
 			enable := !strings.HasPrefix(name, "-")
 			if !enable {
 				name = strings.TrimPrefix(name, "-")
 			}
 
-			enabled := dc.caps[name]
-			if enable == enabled {
-				continue
+			if name == "cap-notify" && !enable && dc.capVersion >= 302 {
+				// cap-notify is implicitly enabled with CAP LS 302, and
+				// can't be disabled
+				ack = false
+				break
 			}
-
-			switch name {
-			case "sasl":
-				dc.caps[name] = enable
-			default:
+			if _, ok := supportedCaps[name]; !ok && enable {
 				ack = false
+				if dc.caps["draft/standard-replies"] {
+					code, description := dc.capRejectionReason(name)
+					dc.sendStandardReply("NOTE", "CAP", code, []string{name}, description)
+				}
+				break
 			}
+			changes[name] = enable
 		}
 
 		reply := "NAK"
 		if ack {
 			reply = "ACK"
+			for name, enable := range changes {
+				dc.caps[name] = enable
+			}
 		}
 		dc.SendMessage(&irc.Message{
 			Prefix:  dc.srv.prefix(),
@@ -557,15 +1021,23 @@ func sanityCheckServer(addr string) error {
 	return conn.Close()
 }
 
-func unmarshalUsername(rawUsername string) (username, network string) {
+// unmarshalUsername splits a username of the form "username/network@client"
+// into its parts. The network and client names are optional. For
+// compatibility, "username@network" designates a network.
+func unmarshalUsername(rawUsername string) (username, network, client string) {
 	username = rawUsername
-	if i := strings.LastIndexAny(username, "/@"); i >= 0 {
+	if i := strings.IndexByte(username, '/'); i >= 0 {
+		network = username[i+1:]
+		username = username[:i]
+		if i := strings.LastIndexByte(network, '@'); i >= 0 {
+			client = network[i+1:]
+			network = network[:i]
+		}
+	} else if i := strings.IndexByte(username, '@'); i >= 0 {
 		network = username[i+1:]
-	}
-	if i := strings.IndexAny(username, "/@"); i >= 0 {
 		username = username[:i]
 	}
-	return username, network
+	return username, network, client
 }
 
 func (dc *downstreamConn) setNetwork(networkName string) error {
@@ -591,7 +1063,10 @@ func (dc *downstreamConn) setNetwork(networkName string) error {
 
 		dc.logger.Printf("auto-saving network %q", networkName)
 		var err error
-		network, err = dc.user.createNetwork(networkName, dc.nick)
+		network, err = dc.user.createNetwork(&Network{
+			Addr: networkName,
+			Nick: dc.nick,
+		})
 		if err != nil {
 			return err
 		}
@@ -602,7 +1077,7 @@ func (dc *downstreamConn) setNetwork(networkName string) error {
 }
 
 func (dc *downstreamConn) authenticate(username, password string) error {
-	username, networkName := unmarshalUsername(username)
+	username, networkName, clientName := unmarshalUsername(username)
 
 	u := dc.srv.getUser(username)
 	if u == nil {
@@ -610,51 +1085,221 @@ func (dc *downstreamConn) authenticate(username, password string) error {
 		return errAuthFailed
 	}
 
-	err := bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(password))
+	u.lock.Lock()
+	hashed := u.Password
+	u.lock.Unlock()
+
+	err := bcrypt.CompareHashAndPassword([]byte(hashed), []byte(password))
 	if err != nil {
 		dc.logger.Printf("failed authentication for %q: %v", username, err)
 		return errAuthFailed
 	}
 
 	dc.user = u
+	dc.clientName = clientName
 
 	return dc.setNetwork(networkName)
 }
 
-func (dc *downstreamConn) register() error {
-	password := dc.password
-	dc.password = ""
-	if dc.user == nil {
-		if err := dc.authenticate(dc.rawUsername, password); err != nil {
-			return err
-		}
-	} else if dc.network == nil {
-		_, networkName := unmarshalUsername(dc.rawUsername)
-		if err := dc.setNetwork(networkName); err != nil {
-			return err
-		}
+// certFingerprint returns the hex-encoded SHA-256 fingerprint of the TLS
+// client certificate.
+func (dc *downstreamConn) certFingerprint() (string, error) {
+	state := dc.conn.TLSConnectionState()
+	if state == nil {
+		return "", fmt.Errorf("not a TLS connection")
 	}
+	if len(state.PeerCertificates) == 0 {
+		return "", fmt.Errorf("no client certificate")
+	}
+	sum := sha256.Sum256(state.PeerCertificates[0].Raw)
+	return hex.EncodeToString(sum[:]), nil
+}
 
-	dc.registered = true
-	dc.username = dc.user.Username
+// authenticateCert authenticates the user owning the TLS client certificate.
+// If non-empty, the identity must match the user, and may contain a network
+// name as in "username/network".
+func (dc *downstreamConn) authenticateCert(identity string) error {
+	fingerprint, err := dc.certFingerprint()
+	if err != nil {
+		dc.logger.Printf("failed certificate authentication: %v", err)
+		return errAuthFailed
+	}
 
-	dc.user.lock.Lock()
-	firstDownstream := len(dc.user.downstreamConns) == 0
-	dc.user.downstreamConns = append(dc.user.downstreamConns, dc)
-	dc.user.lock.Unlock()
+	owner, err := dc.srv.db.GetCertFingerprintUser(fingerprint)
+	if err != nil {
+		return err
+	}
+	if owner == "" {
+		dc.logger.Printf("failed certificate authentication: unknown fingerprint %v", fingerprint)
+		return errAuthFailed
+	}
 
-	dc.SendMessage(&irc.Message{
-		Prefix:  dc.srv.prefix(),
-		Command: irc.RPL_WELCOME,
-		Params:  []string{dc.nick, "Welcome to soju, " + dc.nick},
-	})
-	dc.SendMessage(&irc.Message{
-		Prefix:  dc.srv.prefix(),
-		Command: irc.RPL_YOURHOST,
-		Params:  []string{dc.nick, "Your host is " + dc.srv.Hostname},
-	})
-	dc.SendMessage(&irc.Message{
-		Prefix:  dc.srv.prefix(),
+	username, networkName, clientName := unmarshalUsername(identity)
+	if username != "" && username != owner {
+		dc.logger.Printf("failed certificate authentication for %q: certificate belongs to %q", username, owner)
+		return errAuthFailed
+	}
+
+	u := dc.srv.getUser(owner)
+	if u == nil {
+		dc.logger.Printf("failed certificate authentication for %q: unknown username", owner)
+		return errAuthFailed
+	}
+
+	dc.user = u
+	dc.clientName = clientName
+
+	return dc.setNetwork(networkName)
+}
+
+// checkServerPassword checks the server password sent via PASS, if the server
+// requires one. If the client has already authenticated with SASL, PASS must
+// contain the server password. Otherwise, PASS must be of the form
+// "<server password>:<user password>". The user password is returned.
+func (dc *downstreamConn) checkServerPassword(pass string) (string, error) {
+	serverPass := dc.srv.ServerPassword
+	if serverPass == "" {
+		return pass, nil
+	}
+
+	var ok bool
+	if dc.user != nil {
+		ok = subtle.ConstantTimeCompare([]byte(pass), []byte(serverPass)) == 1
+		pass = ""
+	} else if len(pass) > len(serverPass) && pass[len(serverPass)] == ':' {
+		ok = subtle.ConstantTimeCompare([]byte(pass[:len(serverPass)]), []byte(serverPass)) == 1
+		pass = pass[len(serverPass)+1:]
+	}
+	if !ok {
+		dc.logger.Printf("failed authentication: invalid server password")
+		return "", errServerPasswordMismatch
+	}
+	return pass, nil
+}
+
+// passCredentials returns the username and password to authenticate with when
+// SASL isn't used. The username is normally taken from USER and the password
+// from PASS. For compatibility with other bouncers, PASS may also contain the
+// username, in one of these formats:
+//
+//	<username>:<password>
+//	<username>/<network>:<password>
+//
+// Since network names may contain colons, the password can't contain any in
+// the second format. The username from USER takes precedence if it refers to
+// an existing user, and network and client suffixes in USER take precedence
+// over the ones in PASS.
+func (dc *downstreamConn) passCredentials(pass string) (username, password string) {
+	username, network, client := unmarshalUsername(dc.rawUsername)
+	if dc.srv.getUser(username) != nil {
+		return dc.rawUsername, pass
+	}
+
+	i := strings.Index(pass, ":")
+	if strings.ContainsAny(pass[:i+1], "/@") {
+		i = strings.LastIndex(pass, ":")
+	}
+	if i < 0 {
+		return dc.rawUsername, pass
+	}
+	passUsername, passNetwork, passClient := unmarshalUsername(pass[:i])
+	if dc.srv.getUser(passUsername) == nil {
+		return dc.rawUsername, pass
+	}
+
+	if network == "" {
+		network = passNetwork
+	}
+	if client == "" {
+		client = passClient
+	}
+	username = passUsername
+	if network != "" || client != "" {
+		username += "/" + network
+	}
+	if client != "" {
+		username += "@" + client
+	}
+	return username, pass[i+1:]
+}
+
+func (dc *downstreamConn) register() error {
+	password, err := dc.checkServerPassword(dc.password)
+	dc.password = ""
+	if err != nil {
+		return err
+	}
+
+	if dc.user == nil {
+		username, password := dc.passCredentials(password)
+		if err := dc.authenticate(username, password); err != nil {
+			return err
+		}
+	} else {
+		_, networkName, clientName := unmarshalUsername(dc.rawUsername)
+		if dc.clientName == "" {
+			dc.clientName = clientName
+		}
+		if dc.network == nil {
+			if err := dc.setNetwork(networkName); err != nil {
+				return err
+			}
+		}
+	}
+
+	if dc.bindNetworkID != 0 {
+		network := dc.user.getNetworkByID(dc.bindNetworkID)
+		if network == nil {
+			return ircError{&irc.Message{
+				Command: "FAIL",
+				Params:  []string{"BOUNCER", "INVALID_NETID", "BIND", strconv.FormatInt(dc.bindNetworkID, 10), "Unknown network ID"},
+			}}
+		}
+		dc.network = network
+	}
+
+	backlogLimit := dc.srv.BacklogLimit
+
+	dc.user.lock.Lock()
+	if dc.srv.UniqueClientNames && dc.clientName != "" {
+		for _, other := range dc.user.downstreamConns {
+			if other.clientName == dc.clientName && other.network == dc.network {
+				dc.user.lock.Unlock()
+				dc.logger.Printf("client name %q already in use", dc.clientName)
+				return errClientNameInUse
+			}
+		}
+	}
+	firstDownstream := len(dc.user.downstreamConns) == 0
+	dc.user.downstreamConns = append(dc.user.downstreamConns, dc)
+	if dc.user.BacklogLimit != nil {
+		backlogLimit = *dc.user.BacklogLimit
+	}
+	dc.user.lock.Unlock()
+
+	dc.registered = true
+	dc.username = dc.user.Username
+
+	dc.user.forEachNetwork(func(net *network) {
+		net.notifyDownstreamsChanged()
+	})
+
+	if uc := dc.upstream(); uc != nil {
+		dc.nick = uc.nick
+	}
+
+	dc.SendMessage(&irc.Message{
+		Prefix:  dc.srv.prefix(),
+		Command: irc.RPL_WELCOME,
+		Params:  []string{dc.nick, "Welcome to soju, " + dc.nick},
+	})
+	dc.SendMessage(&irc.Message{
+		Prefix:  dc.srv.prefix(),
+		Command: irc.RPL_YOURHOST,
+		Params:  []string{dc.nick, "Your host is " + dc.srv.Hostname},
+	})
+	dc.SendMessage(&irc.Message{
+		Prefix:  dc.srv.prefix(),
 		Command: irc.RPL_CREATED,
 		Params:  []string{dc.nick, "Who cares when the server was created?"},
 	})
@@ -663,7 +1308,11 @@ func (dc *downstreamConn) register() error {
 		Command: irc.RPL_MYINFO,
 		Params:  []string{dc.nick, dc.srv.Hostname, "soju", "aiwroO", "OovaimnqpsrtklbeI"},
 	})
-	// TODO: RPL_ISUPPORT
+	dc.SendMessage(&irc.Message{
+		Prefix:  dc.srv.prefix(),
+		Command: irc.RPL_ISUPPORT,
+		Params:  dc.isupport(),
+	})
 	dc.SendMessage(&irc.Message{
 		Prefix:  dc.srv.prefix(),
 		Command: irc.ERR_NOMOTD,
@@ -685,6 +1334,7 @@ func (dc *downstreamConn) register() error {
 			seq, ok := uc.history[historyName]
 			uc.lock.Unlock()
 			if ok {
+				seq = uc.ring.LimitSeq(seq, backlogLimit.MaxCount, backlogLimit.MaxAge)
 				seqPtr = &seq
 			}
 		}
@@ -723,7 +1373,7 @@ func (dc *downstreamConn) register() error {
 
 func (dc *downstreamConn) runUntilRegistered() error {
 	for !dc.registered {
-		msg, err := dc.irc.ReadMessage()
+		msg, err := dc.readMessage()
 		if err != nil {
 			return fmt.Errorf("failed to read IRC command: %v", err)
 		}
@@ -744,6 +1394,64 @@ func (dc *downstreamConn) runUntilRegistered() error {
 	return nil
 }
 
+// sendLinkStats sends the state of the upstream connections of the user, for
+// "STATS l". Admins get the state of all users' connections, and the number
+// of users and downstream connections.
+func (dc *downstreamConn) sendLinkStats() {
+	var users []*user
+	if dc.user.Admin {
+		dc.srv.forEachUser(func(u *user) {
+			users = append(users, u)
+		})
+	} else {
+		users = []*user{dc.user}
+	}
+
+	downstreams := 0
+	for _, u := range users {
+		// Only read the state protected by the user lock: other users'
+		// connections are handled by their own goroutine
+		var links [][]string
+		u.lock.Lock()
+		for _, net := range u.networks {
+			links = append(links, []string{u.Username + "/" + net.Addr, net.state})
+		}
+		downstreams += len(u.downstreamConns)
+		u.lock.Unlock()
+
+		for _, link := range links {
+			dc.SendMessage(&irc.Message{
+				Prefix:  dc.srv.prefix(),
+				Command: irc.RPL_STATSLINKINFO,
+				Params:  append([]string{dc.nick}, link...),
+			})
+		}
+	}
+
+	if dc.user.Admin {
+		dc.SendMessage(&irc.Message{
+			Prefix:  dc.srv.prefix(),
+			Command: rpl_statsdebug,
+			Params:  []string{dc.nick, fmt.Sprintf("%v users, %v downstream connections", len(users), downstreams)},
+		})
+	}
+}
+
+// joinOnReconnect saves a channel the client tried to join on a disconnected
+// network, so that it's joined when the network reconnects.
+func (dc *downstreamConn) joinOnReconnect(net *network, name, key string) error {
+	err := dc.srv.db.StoreChannel(net.ID, &Channel{
+		Name: name,
+		Key:  key,
+	})
+	if err != nil {
+		return err
+	}
+	dc.sendStandardReply("WARN", "JOIN", "NETWORK_DISCONNECTED", []string{name},
+		fmt.Sprintf("Network %q is disconnected, channel will be joined when it reconnects", net.Addr))
+	return nil
+}
+
 func (dc *downstreamConn) handleMessageRegistered(msg *irc.Message) error {
 	switch msg.Command {
 	case "CAP":
@@ -773,57 +1481,254 @@ func (dc *downstreamConn) handleMessageRegistered(msg *irc.Message) error {
 		}
 
 		var err error
+		dc.forEachUpstream(func(uc *upstreamConn) {
+			if err != nil {
+				return
+			}
+			err = uc.SendMessageLimited(msg)
+		})
+		if err != nil {
+			return err
+		}
+
 		dc.forEachNetwork(func(n *network) {
 			if err != nil {
 				return
 			}
-			n.Nick = nick
-			err = dc.srv.db.StoreNetwork(dc.user.Username, &n.Network)
+			err = n.updateRecord(func(record *Network) {
+				record.Nick = nick
+			})
 		})
 		if err != nil {
 			return err
 		}
 
-		dc.forEachUpstream(func(uc *upstreamConn) {
-			uc.SendMessage(msg)
+		if dc.network == nil && nick != dc.nick {
+			// In multi-upstream mode, the nick is changed right away: upstream
+			// nick changes aren't reflected to the client
+			dc.SendMessage(&irc.Message{
+				Prefix:  dc.prefix(),
+				Command: "NICK",
+				Params:  []string{nick},
+			})
+			dc.nick = nick
+		}
+	case "SETNAME":
+		var realname string
+		if err := parseMessageParams(msg, &realname); err != nil {
+			return err
+		}
+
+		var networks []*network
+		dc.forEachNetwork(func(net *network) {
+			networks = append(networks, net)
 		})
+
+		sent := false
+		for _, net := range networks {
+			dc.user.lock.Lock()
+			uc := net.conn
+			dc.user.lock.Unlock()
+
+			if uc != nil && uc.registered && !uc.closed && uc.enabledCaps["setname"] {
+				// The realname is stored once the server has accepted it
+				err := uc.SendMessageLimited(&irc.Message{
+					Command: "SETNAME",
+					Params:  []string{realname},
+				})
+				if err != nil {
+					return err
+				}
+				sent = true
+				continue
+			}
+
+			// Used on the next connection
+			err := net.updateRecord(func(record *Network) {
+				record.Realname = realname
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		if dc.network == nil || !sent {
+			// In multi-upstream mode or if the server can't change the
+			// realname before the next connection, the change is echoed
+			// right away
+			dc.realname = realname
+			if dc.caps["setname"] {
+				dc.SendMessage(&irc.Message{
+					Prefix:  dc.prefix(),
+					Command: "SETNAME",
+					Params:  []string{realname},
+				})
+			}
+		}
 	case "JOIN", "PART":
 		var name string
 		if err := parseMessageParams(msg, &name); err != nil {
 			return err
 		}
 
+		var key string
+		if msg.Command == "JOIN" && len(msg.Params) > 1 {
+			key = msg.Params[1]
+		}
+
 		uc, upstreamName, err := dc.unmarshalChannel(name)
-		if err != nil {
-			return ircError{&irc.Message{
-				Command: irc.ERR_NOSUCHCHANNEL,
-				Params:  []string{name, err.Error()},
-			}}
+		if err != nil && dc.network != nil && msg.Command == "JOIN" {
+			// The network is disconnected: save the channel, it'll be
+			// joined when the network reconnects
+			return dc.joinOnReconnect(dc.network, name, key)
+		} else if err != nil {
+			if _, ok := err.(ircError); ok && dc.network == nil {
+				var disconnected []*network
+				connected := false
+				dc.forEachNetwork(func(net *network) {
+					if uc := net.conn; uc == nil || !uc.registered || uc.closed {
+						disconnected = append(disconnected, net)
+					} else {
+						connected = true
+					}
+				})
+				if len(disconnected) == 1 && !connected && msg.Command == "JOIN" {
+					// The channel can only belong to the only network
+					return dc.joinOnReconnect(disconnected[0], name, key)
+				}
+				if len(disconnected) > 0 {
+					addrs := make([]string, len(disconnected))
+					for i, net := range disconnected {
+						addrs[i] = net.Addr
+					}
+					return ircError{&irc.Message{
+						Command: irc.ERR_NOSUCHCHANNEL,
+						Params:  []string{dc.nick, name, fmt.Sprintf("No such channel on connected networks (disconnected: %v)", strings.Join(addrs, ", "))},
+					}}
+				}
+			}
+			return err
 		}
 
-		uc.SendMessage(&irc.Message{
+		params := []string{upstreamName}
+		if key != "" {
+			params = append(params, key)
+		}
+		err = uc.SendMessageLimited(&irc.Message{
 			Command: msg.Command,
-			Params:  []string{upstreamName},
+			Params:  params,
 		})
+		if err != nil {
+			return err
+		}
 
 		switch msg.Command {
 		case "JOIN":
+			uc.addPendingJoins(upstreamName)
+
 			err := dc.srv.db.StoreChannel(uc.network.ID, &Channel{
 				Name: upstreamName,
+				Key:  key,
 			})
 			if err != nil {
 				dc.logger.Printf("failed to create channel %q in DB: %v", upstreamName, err)
 			}
 		case "PART":
+			delete(uc.network.joinErrors, upstreamName)
+
 			if err := dc.srv.db.DeleteChannel(uc.network.ID, upstreamName); err != nil {
 				dc.logger.Printf("failed to delete channel %q in DB: %v", upstreamName, err)
 			}
 		}
-	case "MODE":
-		if msg.Prefix == nil {
-			return fmt.Errorf("missing prefix")
+	case "LIST":
+		pl := &pendingLIST{
+			downstream:      dc,
+			pendingCommands: make(map[*upstreamConn]*irc.Message),
+		}
+
+		var channels []string
+		if len(msg.Params) > 0 {
+			var err error
+			pl.filter, channels, err = parseListFilter(msg.Params[0])
+			if err != nil {
+				dc.sendStandardReply("FAIL", "LIST", "INVALID_PARAMS", []string{msg.Params[0]}, err.Error())
+				return nil
+			}
+		}
+
+		dc.forEachUpstream(func(uc *upstreamConn) {
+			params := msg.Params
+			if pl.filter != nil {
+				// The filter is applied to the replies, only forward the
+				// conditions the server understands
+				elems := channels
+				if strings.Contains(uc.elist, "U") {
+					elems = append(pl.filter.userConditions(), channels...)
+				}
+				params = nil
+				if len(elems) > 0 {
+					params = append([]string{strings.Join(elems, ",")}, msg.Params[1:]...)
+				}
+			}
+
+			// TODO: unmarshal channel names in multi-upstream mode
+			pl.pendingCommands[uc] = &irc.Message{
+				Command: "LIST",
+				Params:  params,
+			}
+		})
+
+		dc.user.pendingLISTsLock.Lock()
+		dc.user.pendingLISTs = append(dc.user.pendingLISTs, pl)
+		cmds := make(map[*upstreamConn]*irc.Message)
+		for uc, cmd := range pl.pendingCommands {
+			if uc.getPendingLIST() == pl {
+				cmds[uc] = cmd
+			}
+		}
+		// Replies immediately if there is no upstream connection
+		completed := dc.user.removeCompletedLISTs()
+		dc.user.pendingLISTsLock.Unlock()
+
+		sendListEnd(completed)
+		for uc, cmd := range cmds {
+			uc.sendLIST(cmd)
+		}
+	case "NAMES":
+		if len(msg.Params) == 0 {
+			dc.SendMessage(&irc.Message{
+				Prefix:  dc.srv.prefix(),
+				Command: irc.RPL_ENDOFNAMES,
+				Params:  []string{dc.nick, "*", "End of /NAMES list"},
+			})
+			return nil
 		}
 
+		for _, name := range strings.Split(msg.Params[0], ",") {
+			var ch *upstreamChannel
+			if uc, upstreamName, err := dc.unmarshalChannel(name); err == nil {
+				ch = uc.channels[upstreamName]
+			}
+
+			if ch != nil && ch.complete {
+				sendNames(dc, ch)
+			} else if ch != nil {
+				// We're still receiving the member list, reply once
+				// it's complete
+				if ch.pendingNAMES == nil {
+					ch.pendingNAMES = make(map[*downstreamConn]struct{})
+				}
+				ch.pendingNAMES[dc] = struct{}{}
+			} else {
+				// TODO: fetch the member list of channels we aren't in
+				dc.SendMessage(&irc.Message{
+					Prefix:  dc.srv.prefix(),
+					Command: irc.RPL_ENDOFNAMES,
+					Params:  []string{dc.nick, name, "End of /NAMES list"},
+				})
+			}
+		}
+	case "MODE":
 		var name string
 		if err := parseMessageParams(msg, &name); err != nil {
 			return err
@@ -834,31 +1739,46 @@ func (dc *downstreamConn) handleMessageRegistered(msg *irc.Message) error {
 			modeStr = msg.Params[1]
 		}
 
-		if msg.Prefix.Name != name {
+		if name != "" && strings.IndexByte(dc.channelTypes(), name[0]) >= 0 {
 			uc, upstreamName, err := dc.unmarshalChannel(name)
 			if err != nil {
 				return err
 			}
 
+			// Channel mode queries are forwarded as well: the upstream
+			// server replies with RPL_CHANNELMODEIS and RPL_CREATIONTIME,
+			// or with the requested lists
+			params := []string{upstreamName}
 			if modeStr != "" {
-				uc.SendMessage(&irc.Message{
-					Command: "MODE",
-					Params:  []string{upstreamName, modeStr},
-				})
-			} else {
-				ch, ok := uc.channels[upstreamName]
-				if !ok {
-					return ircError{&irc.Message{
-						Command: irc.ERR_NOSUCHCHANNEL,
-						Params:  []string{name, "No such channel"},
-					}}
-				}
+				params = append(params, modeStr)
+				params = append(params, msg.Params[2:]...)
+			}
+			err = uc.SendMessageLimited(&irc.Message{
+				Command: "MODE",
+				Params:  params,
+			})
+			if err != nil {
+				return err
+			}
+			if modeStr == "" || (len(msg.Params) == 2 && isModeListQuery(modeStr)) {
+				uc.addModeQuery(dc, upstreamName, modeStr)
+			}
 
-				dc.SendMessage(&irc.Message{
-					Prefix:  dc.srv.prefix(),
-					Command: irc.RPL_CHANNELMODEIS,
-					Params:  []string{name, string(ch.modes)},
-				})
+			// Keep the stored key up-to-date, so that the channel can be
+			// rejoined on reconnection
+			if modeStr == "" {
+				break
+			}
+			if key, ok := uc.channelKeyChange(modeStr, msg.Params[2:]); ok {
+				if _, joined := uc.channels[upstreamName]; joined {
+					err := dc.srv.db.StoreChannel(uc.network.ID, &Channel{
+						Name: upstreamName,
+						Key:  key,
+					})
+					if err != nil {
+						dc.logger.Printf("failed to update key of channel %q in DB: %v", upstreamName, err)
+					}
+				}
 			}
 		} else {
 			if name != dc.nick {
@@ -869,17 +1789,30 @@ func (dc *downstreamConn) handleMessageRegistered(msg *irc.Message) error {
 			}
 
 			if modeStr != "" {
+				var err error
 				dc.forEachUpstream(func(uc *upstreamConn) {
-					uc.SendMessage(&irc.Message{
+					if err != nil {
+						return
+					}
+					err = uc.SendMessageLimited(&irc.Message{
 						Command: "MODE",
 						Params:  []string{uc.nick, modeStr},
 					})
 				})
+				if err != nil {
+					return err
+				}
 			} else {
+				// In multi-upstream mode, the user modes of the different
+				// networks can't be merged
+				var modes modeSet
+				if uc := dc.upstream(); uc != nil {
+					modes = uc.modes
+				}
 				dc.SendMessage(&irc.Message{
 					Prefix:  dc.srv.prefix(),
 					Command: irc.RPL_UMODEIS,
-					Params:  []string{""}, // TODO
+					Params:  []string{dc.nick, "+" + string(modes)},
 				})
 			}
 		}
@@ -890,6 +1823,11 @@ func (dc *downstreamConn) handleMessageRegistered(msg *irc.Message) error {
 		}
 
 		for _, name := range strings.Split(targetsStr, ",") {
+			if name == serviceNick {
+				handleServicePRIVMSG(dc, text)
+				continue
+			}
+
 			uc, upstreamName, err := dc.unmarshalChannel(name)
 			if err != nil {
 				return err
@@ -899,10 +1837,13 @@ func (dc *downstreamConn) handleMessageRegistered(msg *irc.Message) error {
 				dc.handleNickServPRIVMSG(uc, text)
 			}
 
-			uc.SendMessage(&irc.Message{
+			err = uc.SendMessageLimited(&irc.Message{
 				Command: "PRIVMSG",
 				Params:  []string{upstreamName, text},
 			})
+			if err != nil {
+				return err
+			}
 
 			echoMsg := &irc.Message{
 				Prefix: &irc.Prefix{
@@ -912,12 +1853,281 @@ func (dc *downstreamConn) handleMessageRegistered(msg *irc.Message) error {
 				Command: "PRIVMSG",
 				Params:  []string{upstreamName, text},
 			}
+
+			if cmd, ok := parseCTCPMessage(text); ok && cmd != "ACTION" {
+				// CTCP queries are only delivered live, they don't belong in
+				// the conversation history
+				uc.forEachDownstream(func(other *downstreamConn) {
+					if other == dc {
+						return
+					}
+					other.SendMessage(other.marshalMessage(&irc.Message{
+						Prefix:  echoMsg.Prefix,
+						Command: "PRIVMSG",
+						Params:  []string{other.marshalChannel(uc, upstreamName), text},
+					}, uc))
+				})
+				continue
+			}
+
 			dc.lock.Lock()
 			dc.ourMessages[echoMsg] = struct{}{}
 			dc.lock.Unlock()
 
 			uc.ring.Produce(echoMsg)
 		}
+	case "OPER":
+		var name, password string
+		if err := parseMessageParams(msg, &name, &password); err != nil {
+			return err
+		}
+
+		uc := dc.upstream()
+		if uc == nil {
+			return ircError{&irc.Message{
+				Command: irc.ERR_NOOPERHOST,
+				Params:  []string{dc.nick, "OPER requires a connection bound to a single network"},
+			}}
+		}
+
+		err := uc.SendMessageLimited(&irc.Message{
+			Command: "OPER",
+			Params:  []string{name, password},
+		})
+		if err != nil {
+			return err
+		}
+		uc.pendingOPERs = append(uc.pendingOPERs, dc)
+	case "MONITOR":
+		return dc.handleMonitor(msg)
+	case "BOUNCER":
+		return dc.handleBouncer(msg)
+	case "MARKREAD":
+		return dc.handleMarkRead(msg)
+	case "METADATA":
+		return dc.handleMetadata(msg)
+	case "WHO":
+		if len(msg.Params) == 0 {
+			return dc.handleBareWHO()
+		}
+
+		// TODO: support WHO masks
+		mask := msg.Params[0]
+		var options string
+		if len(msg.Params) > 1 {
+			options = msg.Params[1]
+		}
+		fields, whoxToken, whox := parseWHOXOptions(options)
+
+		// The service and, in multi-upstream mode or while the network is
+		// disconnected, the user itself are handled by the bouncer
+		// TODO: use the server casemapping
+		var info *whoxInfo
+		if strings.EqualFold(mask, serviceNick) {
+			info = dc.serviceWHOInfo()
+		} else if dc.upstream() == nil && strings.EqualFold(mask, dc.nick) {
+			info = dc.selfWHOInfo()
+		}
+		if info != nil {
+			info.Token = whoxToken
+			dc.sendWHOReply("*", info, whox, fields)
+			dc.SendMessage(&irc.Message{
+				Prefix:  dc.srv.prefix(),
+				Command: irc.RPL_ENDOFWHO,
+				Params:  []string{dc.nick, mask, "End of /WHO list"},
+			})
+			return nil
+		}
+
+		var uc *upstreamConn
+		var upstreamMask string
+		var err error
+		if mask != "" && strings.IndexByte(dc.channelTypes(), mask[0]) >= 0 {
+			uc, upstreamMask, err = dc.unmarshalChannel(mask)
+		} else {
+			uc, upstreamMask, err = dc.unmarshalNick(mask)
+		}
+		if err != nil {
+			return err
+		}
+
+		params := []string{upstreamMask}
+		if whox && !uc.supportsWHOX {
+			// The upstream server doesn't understand WHOX, only forward the
+			// flags preceding the field spec
+			options = options[:strings.IndexByte(options, '%')]
+			whox = false
+		}
+		if !whox {
+			fields = ""
+		}
+		if options != "" {
+			params = append(params, options)
+		}
+
+		err = uc.SendMessageLimited(&irc.Message{
+			Command: "WHO",
+			Params:  params,
+		})
+		if err != nil {
+			return err
+		}
+		uc.pendingWHOs = append(uc.pendingWHOs, &pendingWHO{dc, fields})
+	case "STATS":
+		var query string
+		if err := parseMessageParams(msg, &query); err != nil {
+			return err
+		}
+
+		switch query {
+		case "u":
+			uptime := time.Since(dc.srv.startTime)
+			days := int(uptime.Hours()) / 24
+			dc.SendMessage(&irc.Message{
+				Prefix:  dc.srv.prefix(),
+				Command: irc.RPL_STATSUPTIME,
+				Params:  []string{dc.nick, fmt.Sprintf("Server Up %d days %d:%02d:%02d", days, int(uptime.Hours())%24, int(uptime.Minutes())%60, int(uptime.Seconds())%60)},
+			})
+		case "l":
+			dc.sendLinkStats()
+		default:
+			// Other queries are about the upstream servers. In
+			// multi-upstream mode, the second parameter is the network.
+			uc := dc.upstream()
+			if dc.network == nil && len(msg.Params) > 1 {
+				dc.forEachUpstream(func(c *upstreamConn) {
+					if c.network.Addr == msg.Params[1] {
+						uc = c
+					}
+				})
+			}
+			if uc == nil {
+				target := "*"
+				if len(msg.Params) > 1 {
+					target = msg.Params[1]
+				}
+				return ircError{&irc.Message{
+					Command: irc.ERR_NOSUCHSERVER,
+					Params:  []string{dc.nick, target, "No such network"},
+				}}
+			}
+
+			err := uc.SendMessageLimited(&irc.Message{
+				Command: "STATS",
+				Params:  []string{query},
+			})
+			if err != nil {
+				return err
+			}
+			uc.pendingSTATS = append(uc.pendingSTATS, dc)
+			return nil
+		}
+
+		dc.SendMessage(&irc.Message{
+			Prefix:  dc.srv.prefix(),
+			Command: irc.RPL_ENDOFSTATS,
+			Params:  []string{dc.nick, query, "End of /STATS report"},
+		})
+	case "WHOIS":
+		if len(msg.Params) == 0 {
+			return ircError{&irc.Message{
+				Command: irc.ERR_NONICKNAMEGIVEN,
+				Params:  []string{dc.nick, "No nickname given"},
+			}}
+		}
+
+		var target, masks string
+		if len(msg.Params) == 1 {
+			target = ""
+			masks = msg.Params[0]
+		} else {
+			target = msg.Params[0]
+			masks = msg.Params[1]
+		}
+
+		// Errors about one of the users don't prevent the others from being
+		// queried
+		for _, mask := range strings.Split(masks, ",") {
+			if mask == "" {
+				continue
+			}
+			err := dc.handleWHOISMask(target, masks, mask)
+			if ircErr, ok := err.(ircError); ok {
+				ircErr.Message.Prefix = dc.srv.prefix()
+				dc.SendMessage(ircErr.Message)
+			} else if err != nil {
+				return err
+			}
+		}
+	case "TAGMSG":
+		var targetsStr string
+		if err := parseMessageParams(msg, &targetsStr); err != nil {
+			return err
+		}
+
+		// Upstream connections don't support message tags, but typing
+		// notifications and reactions are still relayed to the user's other
+		// clients. Reactions are stored in the backlog, typing notifications
+		// are only delivered live.
+		tags := make(irc.Tags)
+		for _, name := range relayedClientTags {
+			if v, ok := msg.Tags[name]; ok {
+				tags[name] = v
+			}
+		}
+		if len(tags) == 0 {
+			break
+		}
+		if v, ok := msg.Tags["+draft/reply"]; ok {
+			tags["+draft/reply"] = v
+		}
+
+		for _, name := range strings.Split(targetsStr, ",") {
+			if name == serviceNick {
+				continue
+			}
+
+			uc, upstreamName, err := dc.unmarshalChannel(name)
+			if err != nil {
+				uc, upstreamName, err = dc.unmarshalNick(name)
+			}
+			if err != nil {
+				return err
+			}
+
+			if _, ok := tags["+draft/react"]; ok {
+				echoMsg := &irc.Message{
+					Tags: tags,
+					Prefix: &irc.Prefix{
+						Name: uc.nick,
+						User: uc.username,
+					},
+					Command: "TAGMSG",
+					Params:  []string{upstreamName},
+				}
+				dc.lock.Lock()
+				dc.ourMessages[echoMsg] = struct{}{}
+				dc.lock.Unlock()
+
+				uc.ring.Produce(echoMsg)
+				continue
+			}
+
+			dc.user.forEachDownstream(func(other *downstreamConn) {
+				if other == dc || !other.caps["message-tags"] {
+					return
+				}
+				if other.network != nil && other.network != uc.network {
+					return
+				}
+				other.SendMessage(other.marshalMessage(&irc.Message{
+					Tags:    tags,
+					Prefix:  other.prefix(),
+					Command: "TAGMSG",
+					Params:  []string{other.marshalTarget(uc, upstreamName)},
+				}, uc))
+			})
+		}
 	default:
 		dc.logger.Printf("unhandled message: %v", msg)
 		return newUnknownCommandError(msg.Command)
@@ -925,6 +2135,222 @@ func (dc *downstreamConn) handleMessageRegistered(msg *irc.Message) error {
 	return nil
 }
 
+// handleWHOISMask handles one of the users queried by a WHOIS command. The
+// service and, in multi-upstream mode or while the network is disconnected,
+// the user itself are handled by the bouncer. Other users are queried with one
+// WHOIS command each, since servers don't necessarily support multiple users.
+// Each query is recorded in the pending WHOIS queries of the upstream
+// connection, so that its replies are only sent to this downstream connection.
+func (dc *downstreamConn) handleWHOISMask(target, masks, mask string) error {
+	if mask == serviceNick {
+		dc.SendMessage(&irc.Message{
+			Prefix:  dc.srv.prefix(),
+			Command: irc.RPL_WHOISUSER,
+			Params:  []string{dc.nick, serviceNick, serviceNick, dc.srv.Hostname, "*", "soju's service"},
+		})
+		dc.SendMessage(&irc.Message{
+			Prefix:  dc.srv.prefix(),
+			Command: irc.RPL_ENDOFWHOIS,
+			Params:  []string{dc.nick, serviceNick, "End of /WHOIS list"},
+		})
+		return nil
+	}
+	if dc.upstream() == nil && mask == dc.nick {
+		dc.SendMessage(&irc.Message{
+			Prefix:  dc.srv.prefix(),
+			Command: irc.RPL_WHOISUSER,
+			Params:  []string{dc.nick, dc.nick, dc.username, dc.srv.Hostname, "*", dc.realname},
+		})
+		dc.SendMessage(&irc.Message{
+			Prefix:  dc.srv.prefix(),
+			Command: irc.RPL_WHOISSERVER,
+			Params:  []string{dc.nick, dc.nick, dc.srv.Hostname, "soju"},
+		})
+		if dc.isOper() {
+			dc.SendMessage(&irc.Message{
+				Prefix:  dc.srv.prefix(),
+				Command: irc.RPL_WHOISOPERATOR,
+				Params:  []string{dc.nick, dc.nick, "is an IRC operator"},
+			})
+		}
+		dc.SendMessage(&irc.Message{
+			Prefix:  dc.srv.prefix(),
+			Command: irc.RPL_ENDOFWHOIS,
+			Params:  []string{dc.nick, dc.nick, "End of /WHOIS list"},
+		})
+		return nil
+	}
+
+	uc, upstreamNick, err := dc.unmarshalNick(mask)
+	if err != nil {
+		return err
+	}
+
+	var params []string
+	if target != "" {
+		if target == masks { // WHOIS nick nick
+			params = []string{upstreamNick, upstreamNick}
+		} else {
+			params = []string{target, upstreamNick}
+		}
+	} else {
+		params = []string{upstreamNick}
+	}
+
+	err = uc.SendMessageLimited(&irc.Message{
+		Command: "WHOIS",
+		Params:  params,
+	})
+	if err != nil {
+		return err
+	}
+	uc.pendingWHOISes = append(uc.pendingWHOISes, dc)
+	return nil
+}
+
+// serviceWHOInfo returns the WHO information of the service.
+func (dc *downstreamConn) serviceWHOInfo() *whoxInfo {
+	return &whoxInfo{
+		Username: serviceNick,
+		Hostname: dc.srv.Hostname,
+		Server:   dc.srv.Hostname,
+		Nickname: serviceNick,
+		Flags:    "H",
+		Realname: "soju's service",
+	}
+}
+
+// selfWHOInfo returns the WHO information of the user, in multi-upstream mode
+// or while the network is disconnected. The user is reported as away if they
+// are away on all connected networks.
+func (dc *downstreamConn) selfWHOInfo() *whoxInfo {
+	connected, away := false, true
+	dc.forEachUpstream(func(uc *upstreamConn) {
+		connected = true
+		if !uc.away {
+			away = false
+		}
+	})
+	flags := "H"
+	if connected && away {
+		flags = "G"
+	}
+	if dc.isOper() {
+		flags += "*"
+	}
+
+	return &whoxInfo{
+		Username: dc.username,
+		Hostname: dc.srv.Hostname,
+		Server:   dc.srv.Hostname,
+		Nickname: dc.nick,
+		Flags:    flags,
+		Realname: dc.realname,
+	}
+}
+
+// isOper returns true if the user is an operator on at least one of the
+// connected networks.
+func (dc *downstreamConn) isOper() bool {
+	oper := false
+	dc.forEachUpstream(func(uc *upstreamConn) {
+		if uc.modes.Has('o') {
+			oper = true
+		}
+	})
+	return oper
+}
+
+// sendWHOReply sends a RPL_WHOREPLY, or a RPL_WHOSPCRPL with the requested
+// fields if the client used WHOX.
+func (dc *downstreamConn) sendWHOReply(channel string, info *whoxInfo, whox bool, fields string) {
+	if whox {
+		dc.SendMessage(generateWHOXReply(dc.srv.prefix(), dc.nick, fields, info))
+		return
+	}
+	dc.SendMessage(&irc.Message{
+		Prefix:  dc.srv.prefix(),
+		Command: irc.RPL_WHOREPLY,
+		Params:  []string{dc.nick, channel, info.Username, info.Hostname, info.Server, info.Nickname, info.Flags, "0 " + info.Realname},
+	})
+}
+
+// handleBareWHO replies to a WHO command without parameters. In
+// single-upstream mode, the command is forwarded to the server. Otherwise,
+// the members of the joined channels are listed from the cached state.
+func (dc *downstreamConn) handleBareWHO() error {
+	dc.sendWHOReply("*", dc.serviceWHOInfo(), false, "")
+
+	if uc := dc.upstream(); uc != nil {
+		err := uc.SendMessageLimited(&irc.Message{
+			Command: "WHO",
+		})
+		if err != nil {
+			return err
+		}
+		uc.pendingWHOs = append(uc.pendingWHOs, &pendingWHO{dc, ""})
+		return nil
+	}
+
+	dc.sendWHOReply("*", dc.selfWHOInfo(), false, "")
+	dc.forEachUpstream(func(uc *upstreamConn) {
+		names := make([]string, 0, len(uc.channels))
+		for name := range uc.channels {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		// Each user is only listed once, with the first channel shared with
+		// them
+		seen := make(map[string]struct{})
+		for _, name := range names {
+			ch := uc.channels[name]
+			nicks := make([]string, 0, len(ch.Members))
+			for nick := range ch.Members {
+				nicks = append(nicks, nick)
+			}
+			sort.Strings(nicks)
+
+			for _, nick := range nicks {
+				if _, ok := seen[nick]; ok || nick == uc.nick {
+					continue
+				}
+				seen[nick] = struct{}{}
+
+				info := &whoxInfo{
+					Username: "*",
+					Hostname: "*",
+					Server:   "*",
+					Nickname: dc.marshalNick(uc, nick),
+					Flags:    "H",
+				}
+				if u, ok := uc.users[nick]; ok {
+					if u.Username != "" {
+						info.Username = u.Username
+					}
+					if u.Hostname != "" {
+						info.Hostname = u.Hostname
+					}
+					if u.Away {
+						info.Flags = "G"
+					}
+				}
+				if m := ch.Members[nick]; m != 0 {
+					info.Flags += string(m)
+				}
+				dc.sendWHOReply(dc.marshalChannel(uc, ch.Name), info, false, "")
+			}
+		}
+	})
+
+	dc.SendMessage(&irc.Message{
+		Prefix:  dc.srv.prefix(),
+		Command: irc.RPL_ENDOFWHO,
+		Params:  []string{dc.nick, "*", "End of /WHO list"},
+	})
+	return nil
+}
+
 func (dc *downstreamConn) handleNickServPRIVMSG(uc *upstreamConn, text string) {
 	username, password, ok := parseNickServCredentials(text, uc.nick)
 	if !ok {
@@ -933,7 +2359,9 @@ func (dc *downstreamConn) handleNickServPRIVMSG(uc *upstreamConn, text string) {
 
 	dc.logger.Printf("auto-saving NickServ credentials with username %q", username)
 	n := uc.network
-	n.SASL.Mechanism = "PLAIN"
+	if n.SASL.Mechanism != "SCRAM-SHA-256" {
+		n.SASL.Mechanism = "PLAIN"
+	}
 	n.SASL.Plain.Username = username
 	n.SASL.Plain.Password = password
 	if err := dc.srv.db.StoreNetwork(dc.user.Username, &n.Network); err != nil {
@@ -1,27 +1,54 @@
 package soju
 
 import (
+	"encoding/base64"
 	"fmt"
+	"strconv"
 	"strings"
 
 	"gopkg.in/irc.v3"
 )
 
 const (
-	rpl_statsping     = "246"
-	rpl_localusers    = "265"
-	rpl_globalusers   = "266"
-	rpl_topicwhotime  = "333"
-	err_invalidcapcmd = "410"
-	rpl_loggedin      = "900"
-	rpl_loggedout     = "901"
-	err_nicklocked    = "902"
-	rpl_saslsuccess   = "903"
-	err_saslfail      = "904"
-	err_sasltoolong   = "905"
-	err_saslaborted   = "906"
-	err_saslalready   = "907"
-	rpl_saslmechs     = "908"
+	rpl_statsping       = "246"
+	rpl_statsdebug      = "249"
+	rpl_localusers      = "265"
+	rpl_globalusers     = "266"
+	rpl_whoiscertfp     = "276"
+	rpl_whoisregnick    = "307"
+	rpl_whoisspecial    = "320"
+	rpl_liststart       = "321"
+	rpl_channelurl      = "328"
+	rpl_creationtime    = "329"
+	rpl_whoisaccount    = "330"
+	rpl_topicwhotime    = "333"
+	rpl_whoisbot        = "335"
+	rpl_whoisactually   = "338"
+	rpl_whospcrpl       = "354"
+	rpl_whoishost       = "378"
+	rpl_whoismodes      = "379"
+	err_invalidcapcmd   = "410"
+	err_needreggednick  = "477"
+	rpl_whoissecure     = "671"
+	rpl_mononline       = "730"
+	rpl_monoffline      = "731"
+	rpl_monlist         = "732"
+	rpl_endofmonlist    = "733"
+	err_monlistfull     = "734"
+	rpl_keyvalue        = "761"
+	rpl_keynotset       = "766"
+	rpl_metadatasubok   = "770"
+	rpl_metadataunsubok = "771"
+	rpl_metadatasubs    = "772"
+	rpl_loggedin        = "900"
+	rpl_loggedout       = "901"
+	err_nicklocked      = "902"
+	rpl_saslsuccess     = "903"
+	err_saslfail        = "904"
+	err_sasltoolong     = "905"
+	err_saslaborted     = "906"
+	err_saslalready     = "907"
+	rpl_saslmechs       = "908"
 )
 
 type modeSet string
@@ -43,6 +70,20 @@ func (ms *modeSet) Del(c byte) {
 	}
 }
 
+// sameModes checks whether two mode sets contain the same modes, regardless
+// of their order.
+func sameModes(a, b modeSet) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := 0; i < len(a); i++ {
+		if !b.Has(a[i]) {
+			return false
+		}
+	}
+	return true
+}
+
 func (ms *modeSet) Apply(s string) error {
 	var plusMinus byte
 	for i := 0; i < len(s); i++ {
@@ -93,17 +134,422 @@ const (
 	membershipVoice     membership = '+'
 )
 
-const stdMembershipPrefixes = "~&@%+"
+// Defaults used when the server doesn't advertise PREFIX in RPL_ISUPPORT.
+const (
+	stdMembershipModes    = "qaohv"
+	stdMembershipPrefixes = "~&@%+"
+)
 
-func parseMembershipPrefix(s string) (prefix membership, nick string) {
-	// TODO: any prefix from PREFIX RPL_ISUPPORT
-	if strings.IndexByte(stdMembershipPrefixes, s[0]) >= 0 {
+// parseMembershipPrefix splits a membership prefix from a nick, given the
+// list of prefixes supported by the server.
+func parseMembershipPrefix(available, s string) (prefix membership, nick string) {
+	if s != "" && strings.IndexByte(available, s[0]) >= 0 {
 		return membership(s[0]), s[1:]
 	} else {
 		return 0, s
 	}
 }
 
+// parseISUPPORTPrefix parses the value of the PREFIX RPL_ISUPPORT token, e.g.
+// "(ov)@+". It returns the mode letters and the matching prefixes.
+func parseISUPPORTPrefix(s string) (modes, prefixes string, err error) {
+	if s == "" {
+		return "", "", nil
+	}
+	if s[0] != '(' {
+		return "", "", fmt.Errorf("malformed PREFIX value %q: missing opening parenthesis", s)
+	}
+	i := strings.IndexByte(s, ')')
+	if i < 0 {
+		return "", "", fmt.Errorf("malformed PREFIX value %q: missing closing parenthesis", s)
+	}
+	modes, prefixes = s[1:i], s[i+1:]
+	if len(modes) != len(prefixes) {
+		return "", "", fmt.Errorf("malformed PREFIX value %q: modes and prefixes mismatch", s)
+	}
+	return modes, prefixes, nil
+}
+
+// Default channel types used when the server doesn't advertise CHANTYPES in
+// RPL_ISUPPORT.
+const stdChannelTypes = "#&+!"
+
+type channelModeType byte
+
+// Channel mode types, as listed in the CHANMODES RPL_ISUPPORT token.
+const (
+	// Modes that add or remove an address to or from a list
+	modeTypeA channelModeType = iota
+	// Modes that change a setting and always have a parameter
+	modeTypeB
+	// Modes that change a setting and have a parameter when being set
+	modeTypeC
+	// Modes that change a setting and never have a parameter
+	modeTypeD
+)
+
+// Defaults used when the server doesn't advertise CHANMODES in RPL_ISUPPORT.
+var stdChannelModes = map[byte]channelModeType{
+	'b': modeTypeA, // ban list
+	'e': modeTypeA, // ban exception list
+	'I': modeTypeA, // invite exception list
+	'k': modeTypeB, // channel key
+	'l': modeTypeC, // channel user limit
+	'i': modeTypeD, // invite-only channel
+	'm': modeTypeD, // moderated channel
+	'n': modeTypeD, // channel does not receive external messages
+	'p': modeTypeD, // private channel
+	's': modeTypeD, // secret channel
+	't': modeTypeD, // protected topic
+}
+
+// parseISUPPORTChanModes parses the value of the CHANMODES RPL_ISUPPORT
+// token, e.g. "b,k,l,imnpst".
+func parseISUPPORTChanModes(s string) (map[byte]channelModeType, error) {
+	parts := strings.SplitN(s, ",", 5)
+	if len(parts) < 4 {
+		return nil, fmt.Errorf("malformed CHANMODES value %q: expected at least 4 comma-separated parts", s)
+	}
+	modes := make(map[byte]channelModeType)
+	for i, mt := range []channelModeType{modeTypeA, modeTypeB, modeTypeC, modeTypeD} {
+		for j := 0; j < len(parts[i]); j++ {
+			modes[parts[i][j]] = mt
+		}
+	}
+	return modes, nil
+}
+
+// parseCTCPMessage returns the CTCP command of a PRIVMSG or NOTICE text, if
+// the text is a CTCP message.
+func parseCTCPMessage(text string) (cmd string, ok bool) {
+	if len(text) < 2 || text[0] != '\x01' {
+		return "", false
+	}
+	text = strings.TrimSuffix(text[1:], "\x01")
+	if i := strings.IndexByte(text, ' '); i >= 0 {
+		text = text[:i]
+	}
+	return strings.ToUpper(text), text != ""
+}
+
+// WHOX fields, in the order they appear in RPL_WHOSPCRPL replies.
+const whoxFields = "tcuihsnfdlaor"
+
+// parseWHOXOptions parses the second parameter of a WHO command, e.g.
+// "o%tcnf,42". It returns the WHOX fields and query token, if any.
+func parseWHOXOptions(options string) (fields, token string, ok bool) {
+	i := strings.IndexByte(options, '%')
+	if i < 0 {
+		return "", "", false
+	}
+	fields = options[i+1:]
+	if i := strings.IndexByte(fields, ','); i >= 0 {
+		fields, token = fields[:i], fields[i+1:]
+	}
+	return fields, token, true
+}
+
+// whoxFieldIndex returns the index of a field in the parameters of a
+// RPL_WHOSPCRPL reply to a query requesting the given fields (the first
+// parameter being the client nick), or -1 if the field wasn't requested.
+func whoxFieldIndex(fields string, field byte) int {
+	if strings.IndexByte(fields, field) < 0 {
+		return -1
+	}
+	i := 1
+	for j := 0; j < len(whoxFields); j++ {
+		if whoxFields[j] == field {
+			return i
+		}
+		if strings.IndexByte(fields, whoxFields[j]) >= 0 {
+			i++
+		}
+	}
+	return -1
+}
+
+type whoxInfo struct {
+	Token    string
+	Username string
+	Hostname string
+	Server   string
+	Nickname string
+	Flags    string
+	Account  string
+	Realname string
+}
+
+// generateWHOXReply builds a RPL_WHOSPCRPL reply containing the requested
+// fields.
+func generateWHOXReply(prefix *irc.Prefix, nick, fields string, info *whoxInfo) *irc.Message {
+	params := []string{nick}
+	for i := 0; i < len(whoxFields); i++ {
+		field := whoxFields[i]
+		if strings.IndexByte(fields, field) < 0 {
+			continue
+		}
+		var v string
+		switch field {
+		case 't':
+			v = info.Token
+		case 'c':
+			v = "*"
+		case 'u':
+			v = info.Username
+		case 'i':
+			v = "255.255.255.255"
+		case 'h':
+			v = info.Hostname
+		case 's':
+			v = info.Server
+		case 'n':
+			v = info.Nickname
+		case 'f':
+			v = info.Flags
+		case 'd':
+			v = "0"
+		case 'l':
+			v = "0"
+		case 'a':
+			v = info.Account
+			if v == "" {
+				v = "0"
+			}
+		case 'o':
+			v = "n/a"
+		case 'r':
+			v = info.Realname
+		}
+		params = append(params, v)
+	}
+	return &irc.Message{
+		Prefix:  prefix,
+		Command: rpl_whospcrpl,
+		Params:  params,
+	}
+}
+
+// isVendorTag checks whether a message tag is vendor-specific, e.g.
+// "example.org/foo". Tags in the draft namespace aren't vendor tags.
+func isVendorTag(name string) bool {
+	name = strings.TrimPrefix(name, "+")
+	return strings.ContainsRune(name, '/') && !strings.HasPrefix(name, "draft/")
+}
+
+// normalizeMask expands a partial ignore mask into a nick!user@host mask, e.g.
+// "nick" into "nick!*@*" and "user@host" into "*!user@host". Masks are
+// lower-cased.
+func normalizeMask(mask string) string {
+	// TODO: use the server casemapping
+	mask = strings.ToLower(mask)
+
+	nick, userhost := mask, "*@*"
+	if i := strings.IndexByte(mask, '!'); i >= 0 {
+		nick, userhost = mask[:i], mask[i+1:]
+		if !strings.ContainsRune(userhost, '@') {
+			userhost += "@*"
+		}
+	} else if strings.ContainsRune(mask, '@') {
+		nick, userhost = "*", mask
+	}
+	if nick == "" {
+		nick = "*"
+	}
+	return nick + "!" + userhost
+}
+
+// matchMask checks whether a message prefix matches a normalized mask. "*"
+// matches any sequence of characters, "?" matches any single character.
+func matchMask(mask string, prefix *irc.Prefix) bool {
+	// TODO: use the server casemapping
+	s := strings.ToLower(prefix.Name + "!" + prefix.User + "@" + prefix.Host)
+
+	// Backtrack to the last "*" on mismatch
+	var mi, si int
+	starMI, starSI := -1, 0
+	for si < len(s) {
+		switch {
+		case mi < len(mask) && (mask[mi] == '?' || mask[mi] == s[si]):
+			mi++
+			si++
+		case mi < len(mask) && mask[mi] == '*':
+			starMI, starSI = mi, si
+			mi++
+		case starMI >= 0:
+			starSI++
+			mi, si = starMI+1, starSI
+		default:
+			return false
+		}
+	}
+	for mi < len(mask) && mask[mi] == '*' {
+		mi++
+	}
+	return mi == len(mask)
+}
+
+// matchTagPatterns checks whether a message tag matches a comma-separated
+// list of patterns. A pattern ending with "*" matches all the tags starting
+// with the pattern prefix.
+func matchTagPatterns(patterns, name string) bool {
+	if patterns == "" {
+		return false
+	}
+	for _, pattern := range strings.Split(patterns, ",") {
+		if strings.HasSuffix(pattern, "*") {
+			if strings.HasPrefix(name, strings.TrimSuffix(pattern, "*")) {
+				return true
+			}
+		} else if pattern == name {
+			return true
+		}
+	}
+	return false
+}
+
+const (
+	// Maximum length of a base64-encoded AUTHENTICATE chunk.
+	maxSASLChunkLen = 400
+	// Maximum length of a base64-encoded SASL payload, after reassembling
+	// the chunks.
+	maxSASLPayloadLen = 16 * maxSASLChunkLen
+)
+
+// encodeSASLPayload encodes a SASL payload into the parameters of one or more
+// AUTHENTICATE messages. An empty payload is sent as "+", and a payload whose
+// length is a multiple of the chunk length is terminated with "+".
+func encodeSASLPayload(payload []byte) []string {
+	s := base64.StdEncoding.EncodeToString(payload)
+	if s == "" {
+		return []string{"+"}
+	}
+
+	var chunks []string
+	for len(s) >= maxSASLChunkLen {
+		chunks = append(chunks, s[:maxSASLChunkLen])
+		s = s[maxSASLChunkLen:]
+	}
+	if s == "" {
+		s = "+"
+	}
+	return append(chunks, s)
+}
+
+var errSASLTooLong = fmt.Errorf("SASL payload too long")
+
+// saslPayloadDecoder reassembles a SASL payload sent in multiple AUTHENTICATE
+// messages.
+type saslPayloadDecoder struct {
+	buf strings.Builder
+}
+
+// decode processes the parameter of an AUTHENTICATE message. It returns
+// more == true if the payload continues in the next message.
+func (d *saslPayloadDecoder) decode(chunk string) (payload []byte, more bool, err error) {
+	if chunk != "+" {
+		d.buf.WriteString(chunk)
+	}
+	if len(chunk) > maxSASLChunkLen || d.buf.Len() > maxSASLPayloadLen {
+		d.reset()
+		return nil, false, errSASLTooLong
+	}
+	if len(chunk) == maxSASLChunkLen {
+		return nil, true, nil
+	}
+
+	s := d.buf.String()
+	d.reset()
+	if s == "" {
+		return nil, false, nil
+	}
+	payload, err = base64.StdEncoding.DecodeString(s)
+	return payload, false, err
+}
+
+func (d *saslPayloadDecoder) reset() {
+	d.buf.Reset()
+}
+
+// listFilter is a set of conditions on the channels returned by LIST, applied
+// by the bouncer to the replies of upstream servers.
+type listFilter struct {
+	minUsers int // -1 if unset
+	maxUsers int // -1 if unset
+	topic    string
+}
+
+// parseListFilter parses the first parameter of a LIST command. Elements of
+// the form ">n" and "<n" (ELIST "U") filter channels by user count, and
+// elements of the form "T:text" filter channels whose topic contains the text.
+// The remaining elements are returned as-is.
+func parseListFilter(param string) (filter *listFilter, rest []string, err error) {
+	for _, elem := range strings.Split(param, ",") {
+		var n *int
+		switch {
+		case strings.HasPrefix(elem, "T:"):
+			if filter == nil {
+				filter = &listFilter{minUsers: -1, maxUsers: -1}
+			}
+			filter.topic = strings.ToLower(strings.TrimPrefix(elem, "T:"))
+			continue
+		case strings.HasPrefix(elem, ">"), strings.HasPrefix(elem, "<"):
+			if filter == nil {
+				filter = &listFilter{minUsers: -1, maxUsers: -1}
+			}
+			if elem[0] == '>' {
+				n = &filter.minUsers
+			} else {
+				n = &filter.maxUsers
+			}
+		default:
+			if elem != "" {
+				rest = append(rest, elem)
+			}
+			continue
+		}
+
+		v, err := strconv.Atoi(elem[1:])
+		if err != nil || v < 0 {
+			return nil, nil, fmt.Errorf("invalid user count condition %q", elem)
+		}
+		*n = v
+	}
+	return filter, rest, nil
+}
+
+// userConditions returns the user count conditions of the filter, in the LIST
+// syntax.
+func (f *listFilter) userConditions() []string {
+	var conds []string
+	if f.minUsers >= 0 {
+		conds = append(conds, ">"+strconv.Itoa(f.minUsers))
+	}
+	if f.maxUsers >= 0 {
+		conds = append(conds, "<"+strconv.Itoa(f.maxUsers))
+	}
+	return conds
+}
+
+// match checks whether a RPL_LIST reply matches the filter.
+func (f *listFilter) match(clients, topic string) bool {
+	if f.minUsers >= 0 || f.maxUsers >= 0 {
+		n, err := strconv.Atoi(clients)
+		if err != nil {
+			return false
+		}
+		if f.minUsers >= 0 && n <= f.minUsers {
+			return false
+		}
+		if f.maxUsers >= 0 && n >= f.maxUsers {
+			return false
+		}
+	}
+	if f.topic != "" && !strings.Contains(strings.ToLower(topic), f.topic) {
+		return false
+	}
+	return true
+}
+
 func parseMessageParams(msg *irc.Message, out ...*string) error {
 	if len(msg.Params) < len(out) {
 		return newNeedMoreParamsError(msg.Command)
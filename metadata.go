@@ -0,0 +1,290 @@
+package soju
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"gopkg.in/irc.v3"
+)
+
+const (
+	// Maximum number of keys a downstream connection can subscribe to.
+	metadataMaxSubs = 50
+	// Maximum number of keys set on a target.
+	metadataMaxKeys = 50
+	// Maximum length of a metadata value, in bytes.
+	metadataMaxValueLen = 300
+	// Reference of the batch sent in reply to METADATA LIST.
+	metadataBatchRef = "metadata"
+)
+
+// isValidMetadataKey checks whether a metadata key only contains the allowed
+// characters: lower-case letters, digits, "_", ".", "/" and "-".
+func isValidMetadataKey(key string) bool {
+	if key == "" {
+		return false
+	}
+	for _, ch := range key {
+		switch {
+		case ch >= 'a' && ch <= 'z', ch >= '0' && ch <= '9':
+		case ch == '_', ch == '.', ch == '/', ch == '-':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// metadataTarget is a nick or channel metadata can be attached to. The
+// user's own nick isn't scoped to a network.
+type metadataTarget struct {
+	name      string // as sent to the client
+	networkID int64  // zero for the user's own nick
+	key       string // empty for the user's own nick
+}
+
+// unmarshalMetadataTarget resolves the target of a METADATA command. Only the
+// user's own nick and the channels joined by the user are supported.
+func (dc *downstreamConn) unmarshalMetadataTarget(name string) (*metadataTarget, error) {
+	if name == "*" || name == dc.nick {
+		return &metadataTarget{name: dc.nick}, nil
+	}
+
+	uc, upstreamName, err := dc.unmarshalChannel(name)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := uc.channels[upstreamName]; !ok {
+		return nil, fmt.Errorf("unknown channel %q", name)
+	}
+	return &metadataTarget{
+		name:      name,
+		networkID: uc.network.ID,
+		// TODO: use the server casemapping
+		key: strings.ToLower(upstreamName),
+	}, nil
+}
+
+func (dc *downstreamConn) sendMetadataFail(code string, context []string, description string) {
+	dc.sendStandardReply("FAIL", "METADATA", code, context, description)
+}
+
+func (dc *downstreamConn) sendKeyValue(target, key, value string, tags irc.Tags) {
+	dc.SendMessage(&irc.Message{
+		Tags:    tags,
+		Prefix:  dc.srv.prefix(),
+		Command: rpl_keyvalue,
+		Params:  []string{dc.nick, target, key, "*", value},
+	})
+}
+
+func (dc *downstreamConn) sendKeyNotSet(target, key string) {
+	dc.SendMessage(&irc.Message{
+		Prefix:  dc.srv.prefix(),
+		Command: rpl_keynotset,
+		Params:  []string{dc.nick, target, key, "Key not set"},
+	})
+}
+
+// notifyMetadata sends a metadata change to the other downstream connections
+// of the user which are subscribed to the key. An empty value indicates that
+// the key has been deleted.
+func (dc *downstreamConn) notifyMetadata(target *metadataTarget, key, value string) {
+	dc.user.forEachDownstream(func(other *downstreamConn) {
+		if other == dc || !other.caps["draft/metadata"] {
+			return
+		}
+		if _, ok := other.metadataSubs[key]; !ok {
+			return
+		}
+		if target.networkID != 0 && other.network != nil && other.network.ID != target.networkID {
+			return
+		}
+
+		name := target.name
+		if target.networkID == 0 {
+			name = other.nick
+		}
+		params := []string{name, key, "*"}
+		if value != "" {
+			params = append(params, value)
+		}
+		other.SendMessage(&irc.Message{
+			Prefix:  other.prefix(),
+			Command: "METADATA",
+			Params:  params,
+		})
+	})
+}
+
+func (dc *downstreamConn) handleMetadata(msg *irc.Message) error {
+	var targetName, subcommand string
+	if err := parseMessageParams(msg, &targetName, &subcommand); err != nil {
+		return err
+	}
+	subcommand = strings.ToUpper(subcommand)
+	args := msg.Params[2:]
+
+	switch subcommand {
+	case "SUB", "UNSUB":
+		if len(args) == 0 {
+			return newNeedMoreParamsError(msg.Command)
+		}
+		var keys []string
+		for _, key := range args {
+			key = strings.ToLower(key)
+			if !isValidMetadataKey(key) {
+				dc.sendMetadataFail("KEY_INVALID", []string{key}, "Invalid key")
+				continue
+			}
+			if subcommand == "SUB" {
+				if _, ok := dc.metadataSubs[key]; !ok && len(dc.metadataSubs) >= metadataMaxSubs {
+					dc.sendMetadataFail("TOO_MANY_SUBS", []string{key}, "Too many subscriptions")
+					break
+				}
+				dc.metadataSubs[key] = struct{}{}
+			} else {
+				delete(dc.metadataSubs, key)
+			}
+			keys = append(keys, key)
+		}
+		if len(keys) > 0 {
+			cmd := rpl_metadatasubok
+			if subcommand == "UNSUB" {
+				cmd = rpl_metadataunsubok
+			}
+			dc.SendMessage(&irc.Message{
+				Prefix:  dc.srv.prefix(),
+				Command: cmd,
+				Params:  append([]string{dc.nick}, keys...),
+			})
+		}
+		return nil
+	case "SUBS":
+		keys := make([]string, 0, len(dc.metadataSubs))
+		for key := range dc.metadataSubs {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		if len(keys) > 0 {
+			dc.SendMessage(&irc.Message{
+				Prefix:  dc.srv.prefix(),
+				Command: rpl_metadatasubs,
+				Params:  append([]string{dc.nick}, keys...),
+			})
+		}
+		return nil
+	case "GET", "LIST", "SET", "CLEAR":
+		// Handled below
+	default:
+		dc.sendMetadataFail("SUBCOMMAND_INVALID", []string{subcommand}, "Unknown subcommand")
+		return nil
+	}
+
+	target, err := dc.unmarshalMetadataTarget(targetName)
+	if err != nil {
+		dc.sendMetadataFail("INVALID_TARGET", []string{targetName}, "Metadata is only supported for yourself and your channels")
+		return nil
+	}
+
+	values, err := dc.srv.db.ListMetadata(dc.user.Username, target.networkID, target.key)
+	if err != nil {
+		return err
+	}
+
+	switch subcommand {
+	case "GET":
+		if len(args) == 0 {
+			return newNeedMoreParamsError(msg.Command)
+		}
+		for _, key := range args {
+			key = strings.ToLower(key)
+			if !isValidMetadataKey(key) {
+				dc.sendMetadataFail("KEY_INVALID", []string{key}, "Invalid key")
+			} else if value, ok := values[key]; ok {
+				dc.sendKeyValue(target.name, key, value, nil)
+			} else {
+				dc.sendKeyNotSet(target.name, key)
+			}
+		}
+	case "LIST":
+		keys := make([]string, 0, len(values))
+		for key := range values {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		var tags irc.Tags
+		if dc.caps["batch"] {
+			tags = irc.Tags{"batch": metadataBatchRef}
+			dc.SendMessage(&irc.Message{
+				Prefix:  dc.srv.prefix(),
+				Command: "BATCH",
+				Params:  []string{"+" + metadataBatchRef, "metadata"},
+			})
+		}
+		for _, key := range keys {
+			dc.sendKeyValue(target.name, key, values[key], tags)
+		}
+		if dc.caps["batch"] {
+			dc.SendMessage(&irc.Message{
+				Prefix:  dc.srv.prefix(),
+				Command: "BATCH",
+				Params:  []string{"-" + metadataBatchRef},
+			})
+		}
+	case "SET":
+		if len(args) == 0 {
+			return newNeedMoreParamsError(msg.Command)
+		}
+		key := strings.ToLower(args[0])
+		if !isValidMetadataKey(key) {
+			dc.sendMetadataFail("KEY_INVALID", []string{key}, "Invalid key")
+			return nil
+		}
+
+		if len(args) < 2 || args[1] == "" {
+			if _, ok := values[key]; !ok {
+				dc.sendMetadataFail("KEY_NOT_SET", []string{target.name, key}, "Key not set")
+				return nil
+			}
+			if err := dc.srv.db.DeleteMetadata(dc.user.Username, target.networkID, target.key, key); err != nil {
+				return err
+			}
+			dc.sendKeyNotSet(target.name, key)
+			dc.notifyMetadata(target, key, "")
+			return nil
+		}
+
+		value := args[1]
+		if len(value) > metadataMaxValueLen {
+			dc.sendMetadataFail("VALUE_INVALID", nil, "Value too long")
+			return nil
+		}
+		if _, ok := values[key]; !ok && len(values) >= metadataMaxKeys {
+			dc.sendMetadataFail("LIMIT_REACHED", []string{target.name}, "Too many keys")
+			return nil
+		}
+		if err := dc.srv.db.StoreMetadata(dc.user.Username, target.networkID, target.key, key, value); err != nil {
+			return err
+		}
+		dc.sendKeyValue(target.name, key, value, nil)
+		dc.notifyMetadata(target, key, value)
+	case "CLEAR":
+		keys := make([]string, 0, len(values))
+		for key := range values {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			if err := dc.srv.db.DeleteMetadata(dc.user.Username, target.networkID, target.key, key); err != nil {
+				return err
+			}
+			dc.sendKeyNotSet(target.name, key)
+			dc.notifyMetadata(target, key, "")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,421 @@
+package soju
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/irc.v3"
+)
+
+const (
+	// Maximum number of nicks a downstream connection can monitor.
+	monitorLimit = 100
+	// Delay between two ISON queries for upstream servers which don't
+	// support MONITOR.
+	monitorPollInterval = time.Minute
+	// Maximum length of the list of nicks in a MONITOR or ISON command.
+	monitorMaxTargetsLen = 400
+)
+
+// upstreamMonitor is the status of a nick monitored on an upstream connection.
+type upstreamMonitor struct {
+	nick   string
+	known  bool // false until the server reports the status
+	online bool
+	prefix *irc.Prefix // only set if online and reported via MONITOR or JOIN
+}
+
+// downstreamMonitor is a nick monitored by a downstream connection.
+type downstreamMonitor struct {
+	nick     string
+	notified bool // whether the status has been sent to the client
+	online   bool // last status sent to the client
+}
+
+// monitorKey returns the key used to store a monitored nick.
+//
+// TODO: use the server casemapping
+func monitorKey(nick string) string {
+	return strings.ToLower(nick)
+}
+
+// joinMonitorTargets splits a list of nicks into comma-separated lists which
+// fit in a single message.
+func joinMonitorTargets(nicks []string, sep string) []string {
+	var lists []string
+	var cur string
+	for _, nick := range nicks {
+		if cur != "" && len(cur)+len(sep)+len(nick) > monitorMaxTargetsLen {
+			lists = append(lists, cur)
+			cur = ""
+		}
+		if cur != "" {
+			cur += sep
+		}
+		cur += nick
+	}
+	if cur != "" {
+		lists = append(lists, cur)
+	}
+	return lists
+}
+
+// updateMonitor synchronizes the nicks monitored on the upstream server with
+// the nicks monitored by downstream connections.
+func (uc *upstreamConn) updateMonitor() {
+	wanted := make(map[string]string)
+	uc.forEachDownstream(func(dc *downstreamConn) {
+		for key, m := range dc.monitored {
+			nick := m.nick
+			if nick == dc.nick {
+				nick = uc.nick
+				key = monitorKey(nick)
+			}
+			wanted[key] = nick
+		}
+	})
+
+	var added, removed []string
+	for key, nick := range wanted {
+		if _, ok := uc.monitored[key]; ok {
+			continue
+		}
+		uc.monitored[key] = &upstreamMonitor{nick: nick}
+		added = append(added, nick)
+	}
+	for key, m := range uc.monitored {
+		if _, ok := wanted[key]; !ok {
+			delete(uc.monitored, key)
+			removed = append(removed, m.nick)
+		}
+	}
+
+	if !uc.supportsMONITOR {
+		if len(added) > 0 && !uc.monitorPolling {
+			uc.pollMonitor()
+		}
+		return
+	}
+
+	for _, targets := range joinMonitorTargets(removed, ",") {
+		uc.SendMessage(&irc.Message{
+			Command: "MONITOR",
+			Params:  []string{"-", targets},
+		})
+	}
+	for _, targets := range joinMonitorTargets(added, ",") {
+		uc.SendMessage(&irc.Message{
+			Command: "MONITOR",
+			Params:  []string{"+", targets},
+		})
+	}
+}
+
+// pollMonitor sends ISON queries for the monitored nicks, and schedules the
+// next poll. Used for servers which don't support MONITOR.
+func (uc *upstreamConn) pollMonitor() {
+	uc.monitorPolling = false
+	if uc.closed || uc.supportsMONITOR || len(uc.monitored) == 0 {
+		return
+	}
+
+	var nicks []string
+	for _, m := range uc.monitored {
+		nicks = append(nicks, m.nick)
+	}
+	for _, targets := range joinMonitorTargets(nicks, " ") {
+		uc.pendingISON = append(uc.pendingISON, strings.Split(targets, " "))
+		uc.SendMessage(&irc.Message{
+			Command: "ISON",
+			Params:  []string{targets},
+		})
+	}
+
+	uc.monitorPolling = true
+	time.AfterFunc(monitorPollInterval, func() {
+		uc.user.monitorPolls <- uc
+	})
+}
+
+// handleISON processes a RPL_ISON reply to a query sent by pollMonitor.
+func (uc *upstreamConn) handleISON(online string) {
+	if len(uc.pendingISON) == 0 {
+		uc.logger.Printf("unexpected RPL_ISON reply")
+		return
+	}
+	nicks := uc.pendingISON[0]
+	uc.pendingISON = uc.pendingISON[1:]
+
+	onlineSet := make(map[string]struct{})
+	for _, nick := range strings.Fields(online) {
+		onlineSet[monitorKey(nick)] = struct{}{}
+	}
+	for _, nick := range nicks {
+		_, ok := onlineSet[monitorKey(nick)]
+		uc.setMonitorStatus(nick, ok, nil)
+	}
+}
+
+// trackMonitorPresence updates the status of a monitored nick from JOIN, QUIT
+// and NICK messages. Only used for servers which don't support MONITOR.
+func (uc *upstreamConn) trackMonitorPresence(prefix *irc.Prefix, online bool) {
+	if uc.supportsMONITOR {
+		return
+	}
+	uc.setMonitorStatus(prefix.Name, online, prefix)
+}
+
+// setMonitorStatus records the status of a monitored nick, and notifies the
+// downstream connections monitoring it if the status has changed.
+func (uc *upstreamConn) setMonitorStatus(nick string, online bool, prefix *irc.Prefix) {
+	key := monitorKey(nick)
+	m, ok := uc.monitored[key]
+	if !ok {
+		return
+	}
+	if !online {
+		prefix = nil
+	} else if prefix == nil && m.online {
+		prefix = m.prefix
+	}
+	if m.known && m.online == online {
+		m.prefix = prefix
+		return
+	}
+	m.known = true
+	m.online = online
+	m.prefix = prefix
+
+	// Collect downstream connections first: notifyMonitor iterates over
+	// upstream connections, which requires the user lock
+	var dcs []*downstreamConn
+	uc.forEachDownstream(func(dc *downstreamConn) {
+		dcs = append(dcs, dc)
+	})
+	for _, dc := range dcs {
+		dc.notifyMonitor(dc.marshalNick(uc, nick))
+	}
+}
+
+// handleMonitorListFull processes ERR_MONLISTFULL. The nicks which couldn't be
+// monitored are forgotten, so that they're added again on the next update, and
+// the error is forwarded to the downstream connections monitoring them.
+func (uc *upstreamConn) handleMonitorListFull(limit, targets string) {
+	nicks := strings.Split(targets, ",")
+	for _, nick := range nicks {
+		delete(uc.monitored, monitorKey(nick))
+	}
+
+	uc.forEachDownstream(func(dc *downstreamConn) {
+		var failed []string
+		for _, nick := range nicks {
+			nick = dc.marshalNick(uc, nick)
+			if _, ok := dc.monitored[monitorKey(nick)]; ok {
+				failed = append(failed, nick)
+			}
+		}
+		if len(failed) == 0 {
+			return
+		}
+		dc.SendMessage(&irc.Message{
+			Prefix:  dc.srv.prefix(),
+			Command: err_monlistfull,
+			Params:  []string{dc.nick, limit, strings.Join(failed, ","), "Monitor list is full"},
+		})
+	})
+}
+
+// resetMonitors sends the status of the nicks monitored by downstream
+// connections again, after an upstream connection has been closed.
+func (uc *upstreamConn) resetMonitors() {
+	var dcs []*downstreamConn
+	uc.forEachDownstream(func(dc *downstreamConn) {
+		dcs = append(dcs, dc)
+	})
+	for _, dc := range dcs {
+		for _, m := range dc.monitored {
+			dc.notifyMonitor(m.nick)
+		}
+	}
+}
+
+// monitorStatus returns the status of a nick monitored by a downstream
+// connection. In multi-upstream mode, the nick is online if it's online on any
+// network.
+func (dc *downstreamConn) monitorStatus(nick string) (known, online bool, prefix *irc.Prefix) {
+	dc.forEachUpstream(func(uc *upstreamConn) {
+		upstreamNick := nick
+		if nick == dc.nick {
+			upstreamNick = uc.nick
+		}
+		m, ok := uc.monitored[monitorKey(upstreamNick)]
+		if !ok || !m.known {
+			return
+		}
+		known = true
+		if m.online && !online {
+			online = true
+			if m.prefix != nil {
+				prefix = dc.marshalUserPrefix(uc, m.prefix)
+			}
+		}
+	})
+	return known, online, prefix
+}
+
+// notifyMonitor sends the status of a monitored nick to the client, if it has
+// changed since the last notification.
+func (dc *downstreamConn) notifyMonitor(nick string) {
+	m, ok := dc.monitored[monitorKey(nick)]
+	if !ok {
+		return
+	}
+	known, online, prefix := dc.monitorStatus(m.nick)
+	if !known {
+		// The status is no longer known, e.g. because the upstream
+		// connection was closed: it'll be sent again once known
+		if m.notified && m.online {
+			dc.sendMonitorStatus(m.nick, false, nil)
+		}
+		m.notified = false
+		return
+	}
+	if m.notified && m.online == online {
+		return
+	}
+	m.notified = true
+	m.online = online
+	dc.sendMonitorStatus(m.nick, online, prefix)
+}
+
+func (dc *downstreamConn) sendMonitorStatus(nick string, online bool, prefix *irc.Prefix) {
+	if online {
+		target := nick
+		if prefix != nil {
+			target = prefix.String()
+		}
+		dc.SendMessage(&irc.Message{
+			Prefix:  dc.srv.prefix(),
+			Command: rpl_mononline,
+			Params:  []string{dc.nick, target},
+		})
+	} else {
+		dc.SendMessage(&irc.Message{
+			Prefix:  dc.srv.prefix(),
+			Command: rpl_monoffline,
+			Params:  []string{dc.nick, nick},
+		})
+	}
+}
+
+// updateUpstreamMonitors synchronizes the nicks monitored on upstream servers
+// after the downstream monitor list has changed.
+func (dc *downstreamConn) updateUpstreamMonitors() {
+	// Collect upstream connections first: updateMonitor iterates over
+	// downstream connections, which requires the user lock
+	var ucs []*upstreamConn
+	dc.forEachUpstream(func(uc *upstreamConn) {
+		ucs = append(ucs, uc)
+	})
+	for _, uc := range ucs {
+		uc.updateMonitor()
+	}
+}
+
+// updateMonitors synchronizes the nicks monitored on all upstream servers,
+// e.g. after a downstream connection has been closed.
+func (u *user) updateMonitors() {
+	var ucs []*upstreamConn
+	u.forEachUpstream(func(uc *upstreamConn) {
+		ucs = append(ucs, uc)
+	})
+	for _, uc := range ucs {
+		uc.updateMonitor()
+	}
+}
+
+func (dc *downstreamConn) handleMonitor(msg *irc.Message) error {
+	var subcommand string
+	if err := parseMessageParams(msg, &subcommand); err != nil {
+		return err
+	}
+
+	switch strings.ToUpper(subcommand) {
+	case "+", "-":
+		var targets string
+		if err := parseMessageParams(msg, nil, &targets); err != nil {
+			return err
+		}
+		nicks := strings.Split(targets, ",")
+
+		if subcommand == "-" {
+			for _, nick := range nicks {
+				delete(dc.monitored, monitorKey(nick))
+			}
+			dc.updateUpstreamMonitors()
+			break
+		}
+
+		var added []string
+		for i, nick := range nicks {
+			if nick == "" {
+				continue
+			}
+			key := monitorKey(nick)
+			if _, ok := dc.monitored[key]; ok {
+				continue
+			}
+			if len(dc.monitored) >= monitorLimit {
+				dc.SendMessage(&irc.Message{
+					Prefix:  dc.srv.prefix(),
+					Command: err_monlistfull,
+					Params:  []string{dc.nick, strconv.Itoa(monitorLimit), strings.Join(nicks[i:], ","), "Monitor list is full"},
+				})
+				break
+			}
+			dc.monitored[key] = &downstreamMonitor{nick: nick}
+			added = append(added, nick)
+		}
+		dc.updateUpstreamMonitors()
+
+		// Statuses not known yet are sent when reported by the upstream
+		// servers
+		for _, nick := range added {
+			dc.notifyMonitor(nick)
+		}
+	case "C":
+		dc.monitored = make(map[string]*downstreamMonitor)
+		dc.updateUpstreamMonitors()
+	case "L":
+		var nicks []string
+		for _, m := range dc.monitored {
+			nicks = append(nicks, m.nick)
+		}
+		for _, targets := range joinMonitorTargets(nicks, ",") {
+			dc.SendMessage(&irc.Message{
+				Prefix:  dc.srv.prefix(),
+				Command: rpl_monlist,
+				Params:  []string{dc.nick, targets},
+			})
+		}
+		dc.SendMessage(&irc.Message{
+			Prefix:  dc.srv.prefix(),
+			Command: rpl_endofmonlist,
+			Params:  []string{dc.nick, "End of MONITOR list"},
+		})
+	case "S":
+		for _, m := range dc.monitored {
+			known, online, prefix := dc.monitorStatus(m.nick)
+			if !known {
+				continue
+			}
+			m.notified = true
+			m.online = online
+			dc.sendMonitorStatus(m.nick, online, prefix)
+		}
+	default:
+		dc.sendStandardReply("FAIL", "MONITOR", "INVALID_PARAMS", []string{subcommand}, "Unknown MONITOR subcommand")
+	}
+	return nil
+}
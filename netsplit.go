@@ -0,0 +1,220 @@
+package soju
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"gopkg.in/irc.v3"
+)
+
+const (
+	// Time to wait for more netsplit QUIT or netjoin JOIN messages before
+	// sending a summary to downstream connections.
+	netsplitCollapseDelay = 2 * time.Second
+	// Time after which a user who quit in a netsplit rejoining isn't
+	// considered part of a netjoin anymore.
+	netjoinTimeout = 30 * time.Minute
+	// Maximum number of nicks listed in a netsplit summary.
+	netsplitMaxNicks = 16
+)
+
+// Batch references used for netsplit and netjoin batches.
+const (
+	netsplitBatchRef = "netsplit"
+	netjoinBatchRef  = "netjoin"
+)
+
+// netsplit holds pending QUIT or JOIN messages caused by a netsplit or a
+// netjoin, not yet forwarded to downstream connections which don't have the
+// soju.im/raw-netsplits capability enabled.
+type netsplit struct {
+	servers string
+	quits   []*irc.Message
+	joins   []*irc.Message
+}
+
+// isNetsplitQuit checks whether a QUIT reason has the form used by servers
+// when a user quits because of a netsplit, e.g. "irc.a.net irc.b.net" or
+// "*.net *.split".
+func isNetsplitQuit(reason string) bool {
+	servers := strings.Split(reason, " ")
+	if len(servers) != 2 {
+		return false
+	}
+	for _, s := range servers {
+		if !strings.ContainsRune(s, '.') || strings.ContainsAny(s, "/:") {
+			return false
+		}
+		if s[0] == '.' || s[len(s)-1] == '.' {
+			return false
+		}
+	}
+	return true
+}
+
+func (uc *upstreamConn) pendingNetsplit() *netsplit {
+	if uc.netsplit == nil {
+		uc.netsplit = &netsplit{}
+		time.AfterFunc(netsplitCollapseDelay, func() {
+			uc.user.netsplitFlushes <- uc
+		})
+	}
+	return uc.netsplit
+}
+
+// handleNetsplitQuit records a QUIT caused by a netsplit.
+func (uc *upstreamConn) handleNetsplitQuit(msg *irc.Message, reason string) {
+	now := time.Now()
+	for n, t := range uc.splitNicks {
+		if now.Sub(t) > netjoinTimeout {
+			delete(uc.splitNicks, n)
+		}
+	}
+	uc.splitNicks[msg.Prefix.Name] = now
+	uc.splitServers = reason
+
+	ns := uc.pendingNetsplit()
+	ns.servers = reason
+	ns.quits = append(ns.quits, msg)
+}
+
+// handleNetjoin checks whether a JOIN is caused by a netjoin, and if so
+// records it. It returns false if the JOIN should be forwarded as usual.
+func (uc *upstreamConn) handleNetjoin(prefix *irc.Prefix, channel string) bool {
+	t, ok := uc.splitNicks[prefix.Name]
+	if !ok || time.Now().Sub(t) > netjoinTimeout {
+		return false
+	}
+
+	ns := uc.pendingNetsplit()
+	ns.joins = append(ns.joins, &irc.Message{
+		Prefix:  prefix,
+		Command: "JOIN",
+		Params:  []string{channel},
+	})
+	return true
+}
+
+// netsplitNicks returns the nicks of the users of QUIT or JOIN messages,
+// without duplicates.
+func netsplitNicks(msgs []*irc.Message) []string {
+	var nicks []string
+	seen := make(map[string]struct{})
+	for _, msg := range msgs {
+		if _, ok := seen[msg.Prefix.Name]; ok {
+			continue
+		}
+		seen[msg.Prefix.Name] = struct{}{}
+		nicks = append(nicks, msg.Prefix.Name)
+	}
+	return nicks
+}
+
+// flushNetsplit sends a summary of the pending netsplit to downstream
+// connections, followed by the QUIT and JOIN messages to keep their member
+// lists up-to-date. These are sent in netsplit and netjoin batches to
+// downstream connections which support it, so that clients can hide them.
+func (uc *upstreamConn) flushNetsplit() {
+	ns := uc.netsplit
+	uc.netsplit = nil
+	if ns == nil || uc.closed {
+		return
+	}
+
+	quits := netsplitNicks(ns.quits)
+	joins := netsplitNicks(ns.joins)
+	for _, nick := range joins {
+		delete(uc.splitNicks, nick)
+	}
+
+	if len(quits) > 0 {
+		uc.logger.Printf("netsplit %q: %v users quit", ns.servers, len(quits))
+	}
+	if len(joins) > 0 {
+		uc.logger.Printf("netjoin: %v users rejoined", len(joins))
+	}
+
+	// Netjoin batches are tagged with the servers of the last netsplit
+	servers := strings.Split(uc.splitServers, " ")
+
+	uc.forEachDownstream(func(dc *downstreamConn) {
+		if dc.caps["soju.im/raw-netsplits"] {
+			return
+		}
+
+		if len(quits) > 0 {
+			text := fmt.Sprintf("Netsplit %v, quits: %v", ns.servers, formatNetsplitNicks(dc, uc, quits))
+			sendNetsplitNOTICE(dc, uc, text)
+			sendNetsplitBatch(dc, uc, netsplitBatchRef, servers, ns.quits)
+		}
+		if len(joins) > 0 {
+			text := fmt.Sprintf("Netsplit over, joins: %v", formatNetsplitNicks(dc, uc, joins))
+			sendNetsplitNOTICE(dc, uc, text)
+			sendNetsplitBatch(dc, uc, netjoinBatchRef, servers, ns.joins)
+		}
+	})
+}
+
+// sendNetsplitBatch sends QUIT or JOIN messages caused by a netsplit or a
+// netjoin, in a batch if the downstream connection supports it.
+func sendNetsplitBatch(dc *downstreamConn, uc *upstreamConn, batchType string, servers []string, msgs []*irc.Message) {
+	if dc.caps["batch"] {
+		dc.SendMessage(&irc.Message{
+			Prefix:  dc.srv.prefix(),
+			Command: "BATCH",
+			Params:  append([]string{"+" + batchType, batchType}, servers...),
+		})
+	}
+	for _, msg := range msgs {
+		params := msg.Params
+		if msg.Command == "JOIN" {
+			params = []string{dc.marshalChannel(uc, msg.Params[0])}
+		}
+		m := dc.marshalMessage(&irc.Message{
+			Prefix:  dc.marshalUserPrefix(uc, msg.Prefix),
+			Command: msg.Command,
+			Params:  params,
+		}, uc)
+		if dc.caps["batch"] {
+			m = m.Copy()
+			if m.Tags == nil {
+				m.Tags = make(irc.Tags)
+			}
+			m.Tags["batch"] = irc.TagValue(batchType)
+		}
+		dc.SendMessage(m)
+	}
+	if dc.caps["batch"] {
+		dc.SendMessage(&irc.Message{
+			Prefix:  dc.srv.prefix(),
+			Command: "BATCH",
+			Params:  []string{"-" + batchType},
+		})
+	}
+}
+
+func formatNetsplitNicks(dc *downstreamConn, uc *upstreamConn, nicks []string) string {
+	n := len(nicks)
+	if n > netsplitMaxNicks {
+		nicks = nicks[:netsplitMaxNicks]
+	}
+
+	l := make([]string, len(nicks))
+	for i, nick := range nicks {
+		l[i] = dc.marshalNick(uc, nick)
+	}
+	s := strings.Join(l, ", ")
+	if n > len(nicks) {
+		s += fmt.Sprintf(" (%v more)", n-len(nicks))
+	}
+	return s
+}
+
+func sendNetsplitNOTICE(dc *downstreamConn, uc *upstreamConn, text string) {
+	dc.SendMessage(dc.marshalMessage(&irc.Message{
+		Prefix:  dc.srv.prefix(),
+		Command: "NOTICE",
+		Params:  []string{dc.nick, text},
+	}, uc))
+}
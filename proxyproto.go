@@ -0,0 +1,192 @@
+package soju
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Maximum time a client has to send the PROXY protocol header.
+var proxyProtocolTimeout = 10 * time.Second
+
+const (
+	// Maximum length of a PROXY protocol v1 header, including the CRLF
+	proxyProtocolV1MaxLen = 107
+)
+
+var proxyProtocolV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+type proxyProtocolListener struct {
+	net.Listener
+}
+
+// NewProxyProtocolListener wraps a listener to accept connections prefixed
+// with a HAProxy PROXY protocol v1 or v2 header. The remote address of the
+// returned connections is the one of the original client. Connections with a
+// missing or malformed header fail on the first read.
+//
+// This must only be used when all clients are trusted proxies, since the
+// header can be used to spoof any address.
+func NewProxyProtocolListener(ln net.Listener) net.Listener {
+	return proxyProtocolListener{ln}
+}
+
+func (ln proxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := ln.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyProtocolConn{Conn: conn}, nil
+}
+
+// proxyProtocolConn reads the PROXY protocol header lazily, to avoid blocking
+// the accept loop.
+type proxyProtocolConn struct {
+	net.Conn
+
+	once       sync.Once
+	br         *bufio.Reader
+	remoteAddr net.Addr
+	err        error
+}
+
+func (c *proxyProtocolConn) readHeader() {
+	c.once.Do(func() {
+		c.br = bufio.NewReader(c.Conn)
+		c.Conn.SetReadDeadline(time.Now().Add(proxyProtocolTimeout))
+		c.remoteAddr, c.err = readProxyProtocolHeader(c.br)
+		c.Conn.SetReadDeadline(time.Time{})
+		if c.err != nil {
+			c.err = fmt.Errorf("failed to read PROXY protocol header: %v", c.err)
+		}
+	})
+}
+
+func (c *proxyProtocolConn) Read(b []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.br.Read(b)
+}
+
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	c.readHeader()
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// readProxyProtocolHeader reads a PROXY protocol header. A nil address is
+// returned if the header doesn't carry the client address, e.g. for health
+// checks sent by the proxy itself.
+func readProxyProtocolHeader(br *bufio.Reader) (net.Addr, error) {
+	b, err := br.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	switch b[0] {
+	case 'P':
+		return readProxyProtocolV1Header(br)
+	case proxyProtocolV2Sig[0]:
+		return readProxyProtocolV2Header(br)
+	default:
+		return nil, fmt.Errorf("missing header")
+	}
+}
+
+func readProxyProtocolV1Header(br *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= proxyProtocolV1MaxLen {
+			return nil, fmt.Errorf("v1 header too long")
+		}
+		ch, err := br.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, ch)
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if fields[0] != "PROXY" || len(fields) < 2 {
+		return nil, fmt.Errorf("malformed v1 header")
+	}
+	switch fields[1] {
+	case "UNKNOWN":
+		return nil, nil
+	case "TCP4", "TCP6":
+		// Handled below
+	default:
+		return nil, fmt.Errorf("unsupported v1 protocol %q", fields[1])
+	}
+	if len(fields) != 6 {
+		return nil, fmt.Errorf("malformed v1 header")
+	}
+
+	ip := net.ParseIP(fields[2])
+	if ip == nil {
+		return nil, fmt.Errorf("invalid v1 source address %q", fields[2])
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid v1 source port %q", fields[4])
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func readProxyProtocolV2Header(br *bufio.Reader) (net.Addr, error) {
+	var hdr [16]byte
+	if _, err := io.ReadFull(br, hdr[:]); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(hdr[:12], proxyProtocolV2Sig) {
+		return nil, fmt.Errorf("invalid v2 signature")
+	}
+	if hdr[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported v2 version %v", hdr[12]>>4)
+	}
+	cmd := hdr[12] & 0xF
+	family := hdr[13] >> 4
+
+	payload := make([]byte, binary.BigEndian.Uint16(hdr[14:]))
+	if _, err := io.ReadFull(br, payload); err != nil {
+		return nil, err
+	}
+
+	switch cmd {
+	case 0: // LOCAL
+		return nil, nil
+	case 1: // PROXY
+		// Handled below
+	default:
+		return nil, fmt.Errorf("unsupported v2 command %v", cmd)
+	}
+
+	var ipLen int
+	switch family {
+	case 1: // AF_INET
+		ipLen = net.IPv4len
+	case 2: // AF_INET6
+		ipLen = net.IPv6len
+	default:
+		// Unix sockets and unspecified families don't carry an IP address
+		return nil, nil
+	}
+
+	// Source address, destination address, source port, destination port
+	if len(payload) < 2*ipLen+4 {
+		return nil, fmt.Errorf("truncated v2 address block")
+	}
+	ip := net.IP(payload[:ipLen])
+	port := binary.BigEndian.Uint16(payload[2*ipLen:])
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
@@ -0,0 +1,121 @@
+package soju
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestReadProxyProtocolV1Header(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		addr   string // empty if no address is expected
+		err    bool
+	}{
+		{"tcp4", "PROXY TCP4 192.0.2.1 192.0.2.2 56324 6697\r\n", "192.0.2.1:56324", false},
+		{"tcp6", "PROXY TCP6 2001:db8::1 2001:db8::2 56324 6697\r\n", "[2001:db8::1]:56324", false},
+		{"unknown", "PROXY UNKNOWN\r\n", "", false},
+		{"unknown with addresses", "PROXY UNKNOWN 192.0.2.1 192.0.2.2 56324 6697\r\n", "", false},
+		{"bad signature", "PROXI TCP4 192.0.2.1 192.0.2.2 56324 6697\r\n", "", true},
+		{"unsupported protocol", "PROXY UDP4 192.0.2.1 192.0.2.2 56324 6697\r\n", "", true},
+		{"missing fields", "PROXY TCP4 192.0.2.1 192.0.2.2 56324\r\n", "", true},
+		{"invalid address", "PROXY TCP4 192.0.2.x 192.0.2.2 56324 6697\r\n", "", true},
+		{"invalid port", "PROXY TCP4 192.0.2.1 192.0.2.2 65536 6697\r\n", "", true},
+		{"too long", "PROXY UNKNOWN " + strings.Repeat("x", proxyProtocolV1MaxLen) + "\r\n", "", true},
+		{"truncated", "PROXY TCP4 192.0.2.1", "", true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			data := tc.header
+			if !tc.err {
+				data += "NICK alice\r\n"
+			}
+			br := bufio.NewReader(strings.NewReader(data))
+			addr, err := readProxyProtocolV1Header(br)
+			checkProxyProtocolResult(t, br, addr, err, tc.addr, tc.err)
+		})
+	}
+}
+
+func TestReadProxyProtocolV2Header(t *testing.T) {
+	sig := string(proxyProtocolV2Sig)
+	tests := []struct {
+		name   string
+		header string
+		addr   string // empty if no address is expected
+		err    bool
+	}{
+		{
+			"tcp4",
+			sig + "\x21\x11\x00\x0C" + "\xC0\x00\x02\x01" + "\xC0\x00\x02\x02" + "\xDC\x04" + "\x1A\x29",
+			"192.0.2.1:56324",
+			false,
+		},
+		{
+			"tcp6",
+			sig + "\x21\x21\x00\x24" +
+				"\x20\x01\x0D\xB8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01" +
+				"\x20\x01\x0D\xB8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02" +
+				"\xDC\x04" + "\x1A\x29",
+			"[2001:db8::1]:56324",
+			false,
+		},
+		{
+			"tcp4 with TLVs",
+			sig + "\x21\x11\x00\x10" + "\xC0\x00\x02\x01" + "\xC0\x00\x02\x02" + "\xDC\x04" + "\x1A\x29" + "\x04\x00\x01\x00",
+			"192.0.2.1:56324",
+			false,
+		},
+		{"local", sig + "\x20\x00\x00\x00", "", false},
+		{"unix", sig + "\x21\x31\x00\x00", "", false},
+		{"bad signature", "\r\n\r\n\x00\r\nQUIX\n" + "\x21\x11\x00\x00", "", true},
+		{"unsupported version", sig + "\x11\x11\x00\x00", "", true},
+		{"unsupported command", sig + "\x22\x11\x00\x00", "", true},
+		{"truncated address block", sig + "\x21\x11\x00\x04" + "\xC0\x00\x02\x01", "", true},
+		{"truncated payload", sig + "\x21\x11\x00\x0C" + "\xC0\x00\x02\x01", "", true},
+		{"truncated header", sig[:8], "", true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			data := tc.header
+			if !tc.err {
+				data += "NICK alice\r\n"
+			}
+			br := bufio.NewReader(strings.NewReader(data))
+			addr, err := readProxyProtocolV2Header(br)
+			checkProxyProtocolResult(t, br, addr, err, tc.addr, tc.err)
+		})
+	}
+}
+
+func checkProxyProtocolResult(t *testing.T, br *bufio.Reader, addr net.Addr, err error, wantAddr string, wantErr bool) {
+	t.Helper()
+
+	if wantErr {
+		if err == nil {
+			t.Fatalf("expected an error, got address %v", addr)
+		}
+		return
+	}
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if wantAddr == "" {
+		if addr != nil {
+			t.Errorf("expected no address, got %v", addr)
+		}
+	} else if addr == nil || addr.String() != wantAddr {
+		t.Errorf("expected address %v, got %v", wantAddr, addr)
+	}
+
+	// The header must be consumed entirely, and nothing more
+	rest, _ := br.ReadString('\n')
+	if rest != "NICK alice\r\n" {
+		t.Errorf("expected the IRC data to follow the header, got %q", rest)
+	}
+}
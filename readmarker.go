@@ -0,0 +1,131 @@
+package soju
+
+import (
+	"strings"
+	"time"
+
+	"gopkg.in/irc.v3"
+)
+
+// Layout of the timestamps sent in MARKREAD messages, as used by the
+// server-time extension.
+const readMarkerTimeLayout = "2006-01-02T15:04:05.000Z"
+
+// readMarkerKey returns the key used to store the read marker of a target.
+//
+// TODO: use the server casemapping
+func readMarkerKey(target string) string {
+	return strings.ToLower(target)
+}
+
+// formatReadMarker formats the timestamp parameter of a MARKREAD message. A
+// zero time indicates that no read marker is stored.
+func formatReadMarker(t time.Time) string {
+	if t.IsZero() {
+		return "timestamp=*"
+	}
+	return "timestamp=" + t.UTC().Format(readMarkerTimeLayout)
+}
+
+// readMarkerNetwork returns the network and the upstream name of a MARKREAD
+// target.
+func (dc *downstreamConn) readMarkerNetwork(target string) (*network, string, error) {
+	if dc.network != nil {
+		return dc.network, target, nil
+	}
+
+	uc, name, err := dc.unmarshalChannel(target)
+	if err != nil {
+		uc, name, err = dc.unmarshalNick(target)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return uc.network, name, nil
+}
+
+// sendReadMarker sends the read marker of a target to a downstream connection
+// with the draft/read-marker capability.
+func (dc *downstreamConn) sendReadMarker(target string, t time.Time) {
+	if !dc.caps["draft/read-marker"] {
+		return
+	}
+	dc.SendMessage(&irc.Message{
+		Prefix:  dc.srv.prefix(),
+		Command: "MARKREAD",
+		Params:  []string{target, formatReadMarker(t)},
+	})
+}
+
+// sendStoredReadMarker sends the read marker stored for a target, e.g. when
+// the client joins a channel.
+func (dc *downstreamConn) sendStoredReadMarker(net *network, target string) {
+	if !dc.caps["draft/read-marker"] {
+		return
+	}
+	t, err := dc.srv.db.GetReadMarker(net.ID, readMarkerKey(target), dc.clientName)
+	if err != nil {
+		dc.logger.Printf("failed to get read marker for %q: %v", target, err)
+		return
+	}
+	dc.sendReadMarker(target, t)
+}
+
+func (dc *downstreamConn) handleMarkRead(msg *irc.Message) error {
+	if len(msg.Params) == 0 {
+		dc.sendStandardReply("FAIL", "MARKREAD", "NEED_MORE_PARAMS", nil, "Missing target")
+		return nil
+	}
+	target := msg.Params[0]
+
+	net, name, err := dc.readMarkerNetwork(target)
+	if err != nil {
+		dc.sendStandardReply("FAIL", "MARKREAD", "INVALID_PARAMS", []string{target}, "Unknown target")
+		return nil
+	}
+	key := readMarkerKey(name)
+
+	stored, err := dc.srv.db.GetReadMarker(net.ID, key, dc.clientName)
+	if err != nil {
+		return err
+	}
+
+	if len(msg.Params) < 2 {
+		dc.sendReadMarker(target, stored)
+		return nil
+	}
+
+	s := msg.Params[1]
+	if !strings.HasPrefix(s, "timestamp=") {
+		dc.sendStandardReply("FAIL", "MARKREAD", "INVALID_PARAMS", []string{target, s}, "Invalid timestamp")
+		return nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, strings.TrimPrefix(s, "timestamp="))
+	if err != nil {
+		dc.sendStandardReply("FAIL", "MARKREAD", "INVALID_PARAMS", []string{target, s}, "Invalid timestamp")
+		return nil
+	}
+	t = t.UTC().Truncate(time.Millisecond)
+
+	// Read markers only move forward
+	if !t.After(stored) {
+		dc.sendReadMarker(target, stored)
+		return nil
+	}
+
+	if err := dc.srv.db.StoreReadMarker(net.ID, key, dc.clientName, t); err != nil {
+		return err
+	}
+
+	// Read markers are shared by the connections with the same client name
+	dc.user.forEachDownstream(func(other *downstreamConn) {
+		if other.network != nil && other.network != net {
+			return
+		}
+		if other.clientName != dc.clientName {
+			return
+		}
+		other.sendReadMarker(name, t)
+	})
+	return nil
+}
@@ -2,6 +2,7 @@ package soju
 
 import (
 	"sync"
+	"time"
 
 	"gopkg.in/irc.v3"
 )
@@ -10,6 +11,7 @@ import (
 // buffer size is fixed. The ring buffer is stored in memory.
 type Ring struct {
 	buffer []*irc.Message
+	times  []time.Time // time at which each message was produced
 	cap    uint64
 
 	lock      sync.Mutex
@@ -21,6 +23,7 @@ type Ring struct {
 func NewRing(capacity int) *Ring {
 	return &Ring{
 		buffer: make([]*irc.Message, capacity),
+		times:  make([]time.Time, capacity),
 		cap:    uint64(capacity),
 	}
 }
@@ -32,6 +35,7 @@ func (r *Ring) Produce(msg *irc.Message) {
 
 	i := int(r.cur % r.cap)
 	r.buffer[i] = msg
+	r.times[i] = time.Now()
 	r.cur++
 
 	for _, consumer := range r.consumers {
@@ -44,6 +48,31 @@ func (r *Ring) Produce(msg *irc.Message) {
 	}
 }
 
+// LimitSeq advances a history sequence number (see RingConsumer.Close) so that
+// at most maxCount messages, and no message older than maxAge, are left after
+// it. A zero maxCount or maxAge disables the corresponding limit.
+func (r *Ring) LimitSeq(seq uint64, maxCount int, maxAge time.Duration) uint64 {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if seq > r.cur {
+		panic("soju: history sequence number greater than producer cursor")
+	}
+	if r.cur-seq > r.cap {
+		seq = r.cur - r.cap
+	}
+	if maxCount > 0 && r.cur-seq > uint64(maxCount) {
+		seq = r.cur - uint64(maxCount)
+	}
+	if maxAge > 0 {
+		cutoff := time.Now().Add(-maxAge)
+		for seq < r.cur && r.times[seq%r.cap].Before(cutoff) {
+			seq++
+		}
+	}
+	return seq
+}
+
 // NewConsumer creates a new ring buffer consumer.
 //
 // If seq is nil, the consumer will get messages starting from the last
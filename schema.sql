@@ -1,6 +1,18 @@
 CREATE TABLE User (
 	username VARCHAR(255) PRIMARY KEY,
-	password VARCHAR(255) NOT NULL
+	password VARCHAR(255) NOT NULL,
+	admin INTEGER NOT NULL DEFAULT 0,
+	backlog_max_count INTEGER,
+	backlog_max_age INTEGER,
+	auto_reply VARCHAR(255)
+);
+
+CREATE TABLE CertFingerprint (
+	id INTEGER PRIMARY KEY,
+	user VARCHAR(255) NOT NULL,
+	sha256 VARCHAR(64) NOT NULL,
+	FOREIGN KEY(user) REFERENCES User(username),
+	UNIQUE(sha256)
 );
 
 CREATE TABLE Network (
@@ -14,10 +26,26 @@ CREATE TABLE Network (
 	sasl_mechanism VARCHAR(255),
 	sasl_plain_username VARCHAR(255),
 	sasl_plain_password VARCHAR(255),
+	on_demand INTEGER NOT NULL DEFAULT 0,
+	cap_negotiation VARCHAR(255),
+	suppress_server_notices INTEGER NOT NULL DEFAULT 0,
+	forward_tags VARCHAR(255),
+	drop_tags VARCHAR(255),
 	FOREIGN KEY(user) REFERENCES User(username),
 	UNIQUE(user, addr, nick)
 );
 
+CREATE TABLE Setting (
+	id INTEGER PRIMARY KEY,
+	user VARCHAR(255) NOT NULL,
+	network INTEGER,
+	channel VARCHAR(255),
+	key VARCHAR(255) NOT NULL,
+	value VARCHAR(255) NOT NULL,
+	FOREIGN KEY(user) REFERENCES User(username),
+	FOREIGN KEY(network) REFERENCES Network(id)
+);
+
 CREATE TABLE Channel (
 	id INTEGER PRIMARY KEY,
 	network INTEGER NOT NULL,
@@ -26,3 +54,33 @@ CREATE TABLE Channel (
 	FOREIGN KEY(network) REFERENCES Network(id),
 	UNIQUE(network, name)
 );
+
+CREATE TABLE IgnoreMask (
+	id INTEGER PRIMARY KEY,
+	network INTEGER NOT NULL,
+	mask VARCHAR(255) NOT NULL,
+	FOREIGN KEY(network) REFERENCES Network(id),
+	UNIQUE(network, mask)
+);
+
+CREATE TABLE ReadMarker (
+	id INTEGER PRIMARY KEY,
+	network INTEGER NOT NULL,
+	target VARCHAR(255) NOT NULL,
+	client VARCHAR(255) NOT NULL,
+	timestamp VARCHAR(255) NOT NULL,
+	FOREIGN KEY(network) REFERENCES Network(id),
+	UNIQUE(network, target, client)
+);
+
+CREATE TABLE Metadata (
+	id INTEGER PRIMARY KEY,
+	user VARCHAR(255) NOT NULL,
+	network INTEGER,
+	target VARCHAR(255),
+	key VARCHAR(255) NOT NULL,
+	value TEXT NOT NULL,
+	FOREIGN KEY(user) REFERENCES User(username),
+	FOREIGN KEY(network) REFERENCES Network(id),
+	UNIQUE(user, network, target, key)
+);
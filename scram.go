@@ -0,0 +1,136 @@
+package soju
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-sasl"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// scramClient implements the client side of the SASL SCRAM mechanisms, as
+// defined in RFC 5802. Channel binding isn't supported.
+type scramClient struct {
+	mech               string
+	hash               func() hash.Hash
+	username, password string
+
+	step            int
+	clientNonce     string
+	clientFirstBare string
+	serverSignature []byte
+}
+
+func newSCRAMSHA256Client(username, password string) sasl.Client {
+	return &scramClient{
+		mech:     "SCRAM-SHA-256",
+		hash:     sha256.New,
+		username: username,
+		password: password,
+	}
+}
+
+func (c *scramClient) Start() (mech string, ir []byte, err error) {
+	var nonce [18]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return "", nil, fmt.Errorf("failed to generate SCRAM nonce: %v", err)
+	}
+	c.clientNonce = base64.StdEncoding.EncodeToString(nonce[:])
+
+	username := strings.NewReplacer("=", "=3D", ",", "=2C").Replace(c.username)
+	c.clientFirstBare = "n=" + username + ",r=" + c.clientNonce
+	// The "n,," GS2 header indicates that channel binding isn't supported
+	return c.mech, []byte("n,," + c.clientFirstBare), nil
+}
+
+func (c *scramClient) Next(challenge []byte) ([]byte, error) {
+	c.step++
+	switch c.step {
+	case 1:
+		return c.handleServerFirst(string(challenge))
+	case 2:
+		return nil, c.handleServerFinal(string(challenge))
+	default:
+		return nil, fmt.Errorf("unexpected SCRAM challenge")
+	}
+}
+
+func (c *scramClient) handleServerFirst(serverFirst string) ([]byte, error) {
+	attrs := parseSCRAMAttrs(serverFirst)
+	if _, ok := attrs["m"]; ok {
+		return nil, fmt.Errorf("unsupported SCRAM extension")
+	}
+
+	nonce := attrs["r"]
+	if !strings.HasPrefix(nonce, c.clientNonce) || len(nonce) == len(c.clientNonce) {
+		return nil, fmt.Errorf("invalid SCRAM server nonce")
+	}
+	salt, err := base64.StdEncoding.DecodeString(attrs["s"])
+	if err != nil || len(salt) == 0 {
+		return nil, fmt.Errorf("invalid SCRAM salt")
+	}
+	iter, err := strconv.Atoi(attrs["i"])
+	if err != nil || iter <= 0 {
+		return nil, fmt.Errorf("invalid SCRAM iteration count")
+	}
+
+	saltedPassword := pbkdf2.Key([]byte(c.password), salt, iter, c.hash().Size(), c.hash)
+	clientKey := c.hmac(saltedPassword, "Client Key")
+	h := c.hash()
+	h.Write(clientKey)
+	storedKey := h.Sum(nil)
+
+	// "biws" is the base64 encoding of the "n,," GS2 header
+	clientFinalWithoutProof := "c=biws,r=" + nonce
+	authMessage := c.clientFirstBare + "," + serverFirst + "," + clientFinalWithoutProof
+
+	proof := c.hmac(storedKey, authMessage)
+	for i := range proof {
+		proof[i] ^= clientKey[i]
+	}
+
+	serverKey := c.hmac(saltedPassword, "Server Key")
+	c.serverSignature = c.hmac(serverKey, authMessage)
+
+	clientFinal := clientFinalWithoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof)
+	return []byte(clientFinal), nil
+}
+
+func (c *scramClient) handleServerFinal(serverFinal string) error {
+	attrs := parseSCRAMAttrs(serverFinal)
+	if e, ok := attrs["e"]; ok {
+		return fmt.Errorf("SCRAM authentication failed: %v", e)
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(attrs["v"])
+	if err != nil || !bytes.Equal(sig, c.serverSignature) {
+		return fmt.Errorf("invalid SCRAM server signature")
+	}
+	return nil
+}
+
+func (c *scramClient) hmac(key []byte, s string) []byte {
+	mac := hmac.New(c.hash, key)
+	mac.Write([]byte(s))
+	return mac.Sum(nil)
+}
+
+// parseSCRAMAttrs parses a comma-separated list of SCRAM attributes.
+func parseSCRAMAttrs(s string) map[string]string {
+	attrs := make(map[string]string)
+	for _, attr := range strings.Split(s, ",") {
+		kv := strings.SplitN(attr, "=", 2)
+		if len(kv) != 2 || len(kv[0]) != 1 {
+			continue
+		}
+		attrs[kv[0]] = kv[1]
+	}
+	return attrs
+}
@@ -4,10 +4,13 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"net/http"
+	"net/url"
 	"sync"
 	"time"
 
 	"gopkg.in/irc.v3"
+	"nhooyr.io/websocket"
 )
 
 // TODO: make configurable
@@ -53,7 +56,74 @@ type Server struct {
 	RingCap  int
 	Debug    bool
 
-	db *DB
+	// If non-empty, all downstream connections must provide this password
+	// in addition to their user credentials.
+	ServerPassword string
+
+	// Host patterns of the web pages allowed to connect over WebSocket, in
+	// addition to the WebSocket server itself. See
+	// websocket.AcceptOptions.OriginPatterns.
+	HTTPOrigins []string
+
+	// Maximum number of commands per second accepted from a downstream
+	// connection, and maximum burst size. Zero disables the limit.
+	DownstreamFloodRate  float64
+	DownstreamFloodBurst int
+
+	// Maximum number of messages per second relayed from downstream
+	// connections to an upstream server, and maximum burst size. Excess
+	// messages are queued. Zero disables the limit.
+	UpstreamFloodRate  float64
+	UpstreamFloodBurst int
+
+	// If true, QUIT and JOIN messages caused by netsplits are collapsed into
+	// a summary for downstream connections without the
+	// soju.im/raw-netsplits capability.
+	CollapseNetsplits bool
+
+	// If true, a WHOX query is sent when joining a channel to fetch
+	// information about its members, if the upstream server supports it.
+	WHOXOnJoin bool
+
+	// Limits the messages sent to clients when they connect, unless the user
+	// overrides it.
+	BacklogLimit BacklogLimit
+
+	// Interval between two PINGs sent to upstream servers, and delay after
+	// which an upstream connection is considered dead if nothing has been
+	// received. A zero interval disables PINGs.
+	UpstreamPingInterval time.Duration
+	UpstreamPingTimeout  time.Duration
+
+	// Delay after which an idle downstream connection is sent a PING, and
+	// delay after which it's considered dead if nothing has been received
+	// since the PING. A zero interval disables PINGs.
+	DownstreamPingInterval time.Duration
+	DownstreamPingTimeout  time.Duration
+
+	// If true, nick changes forced by upstream servers (e.g. by services)
+	// are saved as the network nick, instead of trying to use the previous
+	// nick again on reconnection.
+	PersistForcedNicks bool
+
+	// If true, a connection is refused if another connection with the same
+	// client name is already attached to the same network, since they would
+	// share read markers. Otherwise, the connections share the client state.
+	UniqueClientNames bool
+
+	// If true, the user is marked as away on upstream servers when the last
+	// downstream connection is detached, after AutoAwayDelay. The delay
+	// avoids flapping when clients reconnect quickly. Users can override it
+	// with the "auto-away" setting.
+	AutoAway      bool
+	AutoAwayDelay time.Duration
+
+	// If non-nil, connections to upstream servers are made through this
+	// SOCKS5 proxy.
+	UpstreamProxy *url.URL
+
+	db        *DB
+	startTime time.Time
 
 	lock            sync.Mutex
 	users           map[string]*user
@@ -62,10 +132,20 @@ type Server struct {
 
 func NewServer(db *DB) *Server {
 	return &Server{
-		Logger:  log.New(log.Writer(), "", log.LstdFlags),
-		RingCap: 4096,
-		users:   make(map[string]*user),
-		db:      db,
+		Logger:               log.New(log.Writer(), "", log.LstdFlags),
+		RingCap:              4096,
+		DownstreamFloodRate:  2,
+		DownstreamFloodBurst: 30,
+		UpstreamFloodRate:    0.5,
+		UpstreamFloodBurst:   10,
+		UpstreamPingInterval: time.Minute,
+		UpstreamPingTimeout:  time.Minute,
+		users:                make(map[string]*user),
+		db:                   db,
+		startTime:            time.Now(),
+
+		DownstreamPingInterval: time.Minute,
+		DownstreamPingTimeout:  time.Minute,
 	}
 }
 
@@ -99,6 +179,14 @@ func (s *Server) getUser(name string) *user {
 	return u
 }
 
+func (s *Server) forEachUser(f func(*user)) {
+	s.lock.Lock()
+	for _, u := range s.users {
+		f(u)
+	}
+	s.lock.Unlock()
+}
+
 func (s *Server) Serve(ln net.Listener) error {
 	for {
 		netConn, err := ln.Accept()
@@ -108,29 +196,56 @@ func (s *Server) Serve(ln net.Listener) error {
 
 		setKeepAlive(netConn)
 
-		dc := newDownstreamConn(s, netConn)
-		go func() {
-			s.lock.Lock()
-			s.downstreamConns = append(s.downstreamConns, dc)
-			s.lock.Unlock()
-
-			if err := dc.runUntilRegistered(); err != nil {
-				dc.logger.Print(err)
-			} else {
-				if err := dc.readMessages(dc.user.downstreamIncoming); err != nil {
-					dc.logger.Print(err)
-				}
-			}
-			dc.Close()
-
-			s.lock.Lock()
-			for i := range s.downstreamConns {
-				if s.downstreamConns[i] == dc {
-					s.downstreamConns = append(s.downstreamConns[:i], s.downstreamConns[i+1:]...)
-					break
-				}
-			}
-			s.lock.Unlock()
-		}()
+		// The PROXY protocol header, if any, is read by the new goroutine
+		go s.handle(newNetIRCConn(netConn))
+	}
+}
+
+// ServeHTTP accepts IRC connections over WebSocket.
+func (s *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	conn, err := websocket.Accept(w, req, &websocket.AcceptOptions{
+		Subprotocols:   []string{"text.ircv3.net"},
+		OriginPatterns: s.HTTPOrigins,
+	})
+	if err != nil {
+		s.Logger.Printf("failed to accept WebSocket connection: %v", err)
+		return
+	}
+	// Messages can't exceed 8191 bytes with message tags
+	conn.SetReadLimit(8192)
+
+	s.handle(websocketIRCConn{
+		conn:       conn,
+		remoteAddr: websocketAddr(req.RemoteAddr),
+		tlsState:   req.TLS,
+	})
+}
+
+func (s *Server) handle(ic ircConn) {
+	dc := newDownstreamConn(s, ic)
+	if s.DownstreamPingInterval > 0 {
+		go dc.sendPings()
 	}
+
+	s.lock.Lock()
+	s.downstreamConns = append(s.downstreamConns, dc)
+	s.lock.Unlock()
+
+	if err := dc.runUntilRegistered(); err != nil {
+		dc.logger.Print(err)
+	} else {
+		if err := dc.readMessages(dc.user.downstreamIncoming); err != nil {
+			dc.logger.Print(err)
+		}
+	}
+	dc.Close()
+
+	s.lock.Lock()
+	for i := range s.downstreamConns {
+		if s.downstreamConns[i] == dc {
+			s.downstreamConns = append(s.downstreamConns[:i], s.downstreamConns[i+1:]...)
+			break
+		}
+	}
+	s.lock.Unlock()
 }
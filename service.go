@@ -0,0 +1,1001 @@
+package soju
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/irc.v3"
+)
+
+const serviceNick = "BouncerServ"
+
+type serviceCommandSet map[string]*serviceCommand
+
+type serviceCommand struct {
+	usage    string
+	desc     string
+	handle   func(dc *downstreamConn, params []string) error
+	children serviceCommandSet
+	admin    bool
+}
+
+func sendServiceNOTICE(dc *downstreamConn, text string) {
+	dc.SendMessage(&irc.Message{
+		Prefix:  &irc.Prefix{Name: serviceNick, User: serviceNick, Host: dc.srv.Hostname},
+		Command: "NOTICE",
+		Params:  []string{dc.nick, text},
+	})
+}
+
+func handleServicePRIVMSG(dc *downstreamConn, text string) {
+	if cmd, ok := parseCTCPMessage(text); ok {
+		handleServiceCTCP(dc, cmd, text)
+		return
+	}
+
+	words := strings.Fields(text)
+	cmd, params, err := serviceCommands.Get(words)
+	if err != nil {
+		sendServiceNOTICE(dc, fmt.Sprintf(`error: %v (type "help" for a list of commands)`, err))
+		return
+	}
+	if cmd.admin && !dc.user.Admin {
+		sendServiceNOTICE(dc, "error: you must be an admin to use this command")
+		return
+	}
+
+	if err := cmd.handle(dc, params); err != nil {
+		sendServiceNOTICE(dc, fmt.Sprintf("error: %v", err))
+	}
+}
+
+// Commands supported by handleServiceCTCP, advertised in CLIENTINFO replies.
+const serviceCTCPCommands = "CLIENTINFO PING TIME VERSION"
+
+func handleServiceCTCP(dc *downstreamConn, cmd, text string) {
+	var arg string
+	text = strings.TrimSuffix(text[1:], "\x01")
+	if i := strings.IndexByte(text, ' '); i >= 0 {
+		arg = text[i+1:]
+	}
+
+	var reply string
+	switch cmd {
+	case "CLIENTINFO":
+		reply = serviceCTCPCommands
+	case "PING":
+		reply = arg
+	case "TIME":
+		reply = time.Now().Format(time.RFC1123Z)
+	case "VERSION":
+		reply = "soju " + sojuVersion()
+	default:
+		// Ignore unknown CTCP queries and ACTIONs
+		return
+	}
+
+	text = "\x01" + cmd
+	if reply != "" {
+		text += " " + reply
+	}
+	sendServiceNOTICE(dc, text+"\x01")
+}
+
+// sojuVersion returns the version of the soju module, if known.
+func sojuVersion() string {
+	if info, ok := debug.ReadBuildInfo(); ok {
+		return info.Main.Version
+	}
+	return "unknown"
+}
+
+func (cmds serviceCommandSet) Get(params []string) (*serviceCommand, []string, error) {
+	if len(params) == 0 {
+		return nil, nil, fmt.Errorf("no command specified")
+	}
+
+	name := params[0]
+	params = params[1:]
+
+	cmd, ok := cmds[name]
+	if !ok {
+		for k := range cmds {
+			if !strings.HasPrefix(k, name) {
+				continue
+			}
+			if cmd != nil {
+				return nil, params, fmt.Errorf("command %q is ambiguous", name)
+			}
+			cmd = cmds[k]
+		}
+	}
+	if cmd == nil {
+		return nil, params, fmt.Errorf("command %q not found", name)
+	}
+
+	if len(params) == 0 || len(cmd.children) == 0 {
+		return cmd, params, nil
+	}
+	return cmd.children.Get(params)
+}
+
+var serviceCommands serviceCommandSet
+
+func init() {
+	serviceCommands = serviceCommandSet{
+		"help": {
+			usage:  "[command]",
+			desc:   "print help message",
+			handle: handleServiceHelp,
+		},
+		"network": {
+			children: serviceCommandSet{
+				"on-demand": {
+					usage:  "<name> <on|off>",
+					desc:   "only connect to a network while a client is attached",
+					handle: handleServiceNetworkOnDemand,
+				},
+				"suppress-server-notices": {
+					usage:  "<name> <on|off>",
+					desc:   "don't forward notices sent by the server to clients",
+					handle: handleServiceNetworkSuppressServerNotices,
+				},
+				"cap-negotiation": {
+					usage:  "<name> <default|late|none>",
+					desc:   "change when capabilities are negotiated, for legacy servers",
+					handle: handleServiceNetworkCapNegotiation,
+				},
+				"tags": {
+					usage:  "<name> <forward|drop> <tag,...>|none",
+					desc:   "forward or drop message tags sent by the server, vendor tags are dropped by default",
+					handle: handleServiceNetworkTags,
+				},
+				"sasl": {
+					usage:  "<name> <plain|scram-sha-256> <username> <password>|none",
+					desc:   "change the SASL credentials used to authenticate with the server",
+					handle: handleServiceNetworkSASL,
+				},
+				"set": {
+					usage:  "<name> <key> <value>|default",
+					desc:   "change a setting for a network",
+					handle: handleServiceNetworkSet,
+				},
+				"get": {
+					usage:  "<name> [key]",
+					desc:   "show the settings of a network",
+					handle: handleServiceNetworkGet,
+				},
+				"ignore": {
+					children: serviceCommandSet{
+						"list": {
+							usage:  "<name>",
+							desc:   "list the masks ignored on a network",
+							handle: handleServiceNetworkIgnoreList,
+						},
+						"add": {
+							usage:  "<name> <nick!user@host>",
+							desc:   "stop forwarding messages sent by users matching a mask",
+							handle: handleServiceNetworkIgnoreAdd,
+						},
+						"delete": {
+							usage:  "<name> <nick!user@host>",
+							desc:   "remove an ignore mask",
+							handle: handleServiceNetworkIgnoreDelete,
+						},
+					},
+				},
+			},
+		},
+		"channel": {
+			children: serviceCommandSet{
+				"errors": {
+					usage:  "[network]",
+					desc:   "show the channels which failed to be joined",
+					handle: handleServiceChannelErrors,
+				},
+				"retry": {
+					usage:  "<name> [network]",
+					desc:   "try to join a channel again",
+					handle: handleServiceChannelRetry,
+				},
+			},
+		},
+		"self": {
+			children: serviceCommandSet{
+				"backlog-limit": {
+					usage:  "<count> <age>|default",
+					desc:   "limit the messages sent on connection, 0 for unlimited",
+					handle: handleServiceSelfBacklogLimit,
+				},
+				"auto-reply": {
+					usage:  "<text>|off",
+					desc:   "reply to direct messages while no client is connected",
+					handle: handleServiceSelfAutoReply,
+				},
+				"certfp": {
+					desc:   "show the fingerprint of the TLS client certificate of this connection",
+					handle: handleServiceSelfCertFP,
+				},
+				"set": {
+					usage:  "<key> <value>|default",
+					desc:   "change a setting",
+					handle: handleServiceSelfSet,
+				},
+				"get": {
+					usage:  "[key]",
+					desc:   "show settings",
+					handle: handleServiceSelfGet,
+				},
+			},
+		},
+		"server": {
+			children: serviceCommandSet{
+				"features": {
+					desc:   "show the soju version and the features supported by this server",
+					handle: handleServiceServerFeatures,
+				},
+			},
+		},
+		"admin": {
+			children: serviceCommandSet{
+				"broadcast": {
+					usage:  "<text>",
+					desc:   "send a notice to all connected clients of all users",
+					handle: handleServiceAdminBroadcast,
+					admin:  true,
+				},
+				"user": {
+					children: serviceCommandSet{
+						"reload": {
+							usage:  "<username>",
+							desc:   "reload a user and its networks and channels from the database",
+							handle: handleServiceAdminUserReload,
+							admin:  true,
+						},
+					},
+					admin: true,
+				},
+				"certfp": {
+					children: serviceCommandSet{
+						"list": {
+							usage:  "<username>",
+							desc:   "list the TLS client certificates a user can authenticate with",
+							handle: handleServiceAdminCertFPList,
+							admin:  true,
+						},
+						"add": {
+							usage:  "<username> <sha256>",
+							desc:   "allow a user to authenticate with a TLS client certificate",
+							handle: handleServiceAdminCertFPAdd,
+							admin:  true,
+						},
+						"delete": {
+							usage:  "<username> <sha256>",
+							desc:   "remove a TLS client certificate of a user",
+							handle: handleServiceAdminCertFPDelete,
+							admin:  true,
+						},
+					},
+					admin: true,
+				},
+			},
+			admin: true,
+		},
+	}
+}
+
+func appendServiceCommandSetHelp(cmds serviceCommandSet, prefix []string, admin bool, l *[]string) {
+	for name, cmd := range cmds {
+		if cmd.admin && !admin {
+			continue
+		}
+		words := append(append([]string(nil), prefix...), name)
+		if len(cmd.children) == 0 {
+			s := strings.Join(words, " ")
+			*l = append(*l, s)
+		} else {
+			appendServiceCommandSetHelp(cmd.children, words, admin, l)
+		}
+	}
+}
+
+func handleServiceHelp(dc *downstreamConn, params []string) error {
+	if len(params) > 0 {
+		cmd, rest, err := serviceCommands.Get(params)
+		if err != nil {
+			return err
+		}
+		words := params[:len(params)-len(rest)]
+
+		if len(cmd.children) > 0 {
+			var l []string
+			appendServiceCommandSetHelp(cmd.children, words, dc.user.Admin, &l)
+			sort.Strings(l)
+			sendServiceNOTICE(dc, "available commands: "+strings.Join(l, ", "))
+		} else {
+			text := strings.Join(words, " ")
+			if cmd.usage != "" {
+				text += " " + cmd.usage
+			}
+			text += ": " + cmd.desc
+
+			sendServiceNOTICE(dc, text)
+		}
+	} else {
+		var l []string
+		appendServiceCommandSetHelp(serviceCommands, nil, dc.user.Admin, &l)
+		sort.Strings(l)
+		sendServiceNOTICE(dc, "available commands: "+strings.Join(l, ", "))
+	}
+	return nil
+}
+
+func parseBool(s string) (bool, error) {
+	switch strings.ToLower(s) {
+	case "on", "true", "yes", "1":
+		return true, nil
+	case "off", "false", "no", "0":
+		return false, nil
+	default:
+		return false, fmt.Errorf("invalid boolean value %q", s)
+	}
+}
+
+// updateNetworkRecord changes the record of one of the user's networks, and
+// stores it in the database.
+func updateNetworkRecord(dc *downstreamConn, name string, f func(record *Network)) (*network, error) {
+	net := dc.user.getNetwork(name)
+	if net == nil {
+		return nil, fmt.Errorf("unknown network %q", name)
+	}
+	if err := net.updateRecord(f); err != nil {
+		return nil, err
+	}
+	return net, nil
+}
+
+func handleServiceNetworkOnDemand(dc *downstreamConn, params []string) error {
+	if len(params) != 2 {
+		return fmt.Errorf("expected exactly two arguments")
+	}
+
+	onDemand, err := parseBool(params[1])
+	if err != nil {
+		return err
+	}
+
+	net, err := updateNetworkRecord(dc, params[0], func(record *Network) {
+		record.OnDemand = onDemand
+	})
+	if err != nil {
+		return err
+	}
+	net.notifyDownstreamsChanged()
+
+	if onDemand {
+		sendServiceNOTICE(dc, fmt.Sprintf("network %q will only be connected while a client is attached", net.Addr))
+	} else {
+		sendServiceNOTICE(dc, fmt.Sprintf("network %q will always be connected", net.Addr))
+	}
+	return nil
+}
+
+func handleServiceNetworkSuppressServerNotices(dc *downstreamConn, params []string) error {
+	if len(params) != 2 {
+		return fmt.Errorf("expected exactly two arguments")
+	}
+
+	suppress, err := parseBool(params[1])
+	if err != nil {
+		return err
+	}
+
+	net, err := updateNetworkRecord(dc, params[0], func(record *Network) {
+		record.SuppressServerNotices = suppress
+	})
+	if err != nil {
+		return err
+	}
+
+	if suppress {
+		sendServiceNOTICE(dc, fmt.Sprintf("server notices from network %q will no longer be forwarded", net.Addr))
+	} else {
+		sendServiceNOTICE(dc, fmt.Sprintf("server notices from network %q will be forwarded", net.Addr))
+	}
+	return nil
+}
+
+func handleServiceNetworkTags(dc *downstreamConn, params []string) error {
+	if len(params) != 3 {
+		return fmt.Errorf("expected exactly three arguments")
+	}
+
+	if params[1] != "forward" && params[1] != "drop" {
+		return fmt.Errorf("invalid policy %q, expected forward or drop", params[1])
+	}
+
+	patterns := params[2]
+	if patterns == "none" {
+		patterns = ""
+	}
+
+	net, err := updateNetworkRecord(dc, params[0], func(record *Network) {
+		if params[1] == "forward" {
+			record.ForwardTags = patterns
+		} else {
+			record.DropTags = patterns
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	if patterns == "" {
+		sendServiceNOTICE(dc, fmt.Sprintf("%v list cleared for network %q", params[1], net.Addr))
+	} else {
+		action := "forwarded"
+		if params[1] == "drop" {
+			action = "dropped"
+		}
+		sendServiceNOTICE(dc, fmt.Sprintf("tags matching %v will be %v for network %q", patterns, action, net.Addr))
+	}
+	return nil
+}
+
+func handleServiceNetworkCapNegotiation(dc *downstreamConn, params []string) error {
+	if len(params) != 2 {
+		return fmt.Errorf("expected exactly two arguments")
+	}
+
+	var mode string
+	switch strings.ToLower(params[1]) {
+	case "default":
+		mode = ""
+	case "late", "none":
+		mode = strings.ToLower(params[1])
+	default:
+		return fmt.Errorf("invalid capability negotiation mode %q", params[1])
+	}
+
+	net, err := updateNetworkRecord(dc, params[0], func(record *Network) {
+		record.CapNegotiation = mode
+	})
+	if err != nil {
+		return err
+	}
+
+	sendServiceNOTICE(dc, fmt.Sprintf("capability negotiation mode for network %q updated, will apply on next connection", net.Addr))
+	return nil
+}
+
+func handleServiceNetworkSASL(dc *downstreamConn, params []string) error {
+	if len(params) < 2 {
+		return fmt.Errorf("expected a network name and a mechanism")
+	}
+
+	var auth SASL
+	switch mech := strings.ToUpper(params[1]); mech {
+	case "NONE":
+		if len(params) != 2 {
+			return fmt.Errorf("expected exactly two arguments")
+		}
+	case "PLAIN", "SCRAM-SHA-256":
+		if len(params) != 4 {
+			return fmt.Errorf("expected a username and a password")
+		}
+		auth.Mechanism = mech
+		auth.Plain.Username = params[2]
+		auth.Plain.Password = params[3]
+	default:
+		return fmt.Errorf("unsupported SASL mechanism %q", params[1])
+	}
+
+	net, err := updateNetworkRecord(dc, params[0], func(record *Network) {
+		record.SASL = auth
+	})
+	if err != nil {
+		return err
+	}
+
+	if auth.Mechanism == "" {
+		sendServiceNOTICE(dc, fmt.Sprintf("SASL authentication disabled for network %q, will apply on next connection", net.Addr))
+	} else {
+		sendServiceNOTICE(dc, fmt.Sprintf("SASL %v authentication enabled for network %q, will apply on next connection", auth.Mechanism, net.Addr))
+	}
+	return nil
+}
+
+func handleServiceChannelErrors(dc *downstreamConn, params []string) error {
+	if len(params) > 1 {
+		return fmt.Errorf("expected at most one argument")
+	}
+
+	var networks []*network
+	if len(params) == 1 {
+		net := dc.user.getNetwork(params[0])
+		if net == nil {
+			return fmt.Errorf("unknown network %q", params[0])
+		}
+		networks = append(networks, net)
+	} else {
+		dc.forEachNetwork(func(net *network) {
+			networks = append(networks, net)
+		})
+	}
+
+	n := 0
+	for _, net := range networks {
+		var channels []string
+		for name := range net.joinErrors {
+			channels = append(channels, name)
+		}
+		sort.Strings(channels)
+
+		for _, name := range channels {
+			sendServiceNOTICE(dc, fmt.Sprintf("network %q: %v: %v", net.Addr, name, net.joinErrors[name]))
+			n++
+		}
+	}
+	if n == 0 {
+		sendServiceNOTICE(dc, "no channel join error")
+	}
+	return nil
+}
+
+func handleServiceChannelRetry(dc *downstreamConn, params []string) error {
+	if len(params) < 1 || len(params) > 2 {
+		return fmt.Errorf("expected a channel name and an optional network")
+	}
+	name := params[0]
+
+	var uc *upstreamConn
+	if len(params) == 2 {
+		dc.forEachUpstream(func(conn *upstreamConn) {
+			if conn.network.Addr == params[1] {
+				uc = conn
+			}
+		})
+		if uc == nil {
+			return fmt.Errorf("network %q is unknown or disconnected", params[1])
+		}
+	} else {
+		dc.forEachUpstream(func(conn *upstreamConn) {
+			if _, ok := conn.network.joinErrors[name]; ok {
+				uc = conn
+			}
+		})
+		if uc == nil {
+			uc = dc.upstream()
+		}
+		if uc == nil {
+			return fmt.Errorf("please specify a network")
+		}
+	}
+
+	err := uc.SendMessageLimited(&irc.Message{
+		Command: "JOIN",
+		Params:  []string{name},
+	})
+	if err != nil {
+		return err
+	}
+	uc.addPendingJoins(name)
+	sendServiceNOTICE(dc, fmt.Sprintf("trying to join %v on network %q", name, uc.network.Addr))
+	return nil
+}
+
+func handleServiceSelfBacklogLimit(dc *downstreamConn, params []string) error {
+	var limit *BacklogLimit
+	if len(params) == 1 && params[0] == "default" {
+		// Use the server default
+	} else if len(params) == 2 {
+		maxCount, err := strconv.Atoi(params[0])
+		if err != nil || maxCount < 0 {
+			return fmt.Errorf("invalid count %q", params[0])
+		}
+		maxAge, err := time.ParseDuration(params[1])
+		if err != nil || maxAge < 0 {
+			return fmt.Errorf("invalid age %q", params[1])
+		}
+		limit = &BacklogLimit{MaxCount: maxCount, MaxAge: maxAge}
+	} else {
+		return fmt.Errorf("expected a count and an age, or \"default\"")
+	}
+
+	dc.user.lock.Lock()
+	dc.user.BacklogLimit = limit
+	record := dc.user.User
+	dc.user.lock.Unlock()
+
+	if err := dc.srv.db.UpdateUser(&record); err != nil {
+		return err
+	}
+
+	if limit == nil {
+		limit = &dc.srv.BacklogLimit
+	}
+	sendServiceNOTICE(dc, "backlog limit set to "+formatBacklogLimit(limit))
+	return nil
+}
+
+func handleServiceSelfAutoReply(dc *downstreamConn, params []string) error {
+	if len(params) == 0 {
+		return fmt.Errorf("expected a text or \"off\"")
+	}
+	text := strings.Join(params, " ")
+	if len(params) == 1 && params[0] == "off" {
+		text = ""
+	}
+
+	dc.user.lock.Lock()
+	dc.user.AutoReply = text
+	record := dc.user.User
+	dc.user.lock.Unlock()
+
+	if err := dc.srv.db.UpdateUser(&record); err != nil {
+		return err
+	}
+
+	if text == "" {
+		sendServiceNOTICE(dc, "auto-reply disabled")
+	} else {
+		sendServiceNOTICE(dc, fmt.Sprintf("auto-reply set to %q", text))
+	}
+	return nil
+}
+
+func handleServiceSelfSet(dc *downstreamConn, params []string) error {
+	if len(params) < 2 {
+		return fmt.Errorf("expected a key and a value, or \"default\"")
+	}
+	if err := setServiceSetting(dc, 0, params[0], params[1:]); err != nil {
+		return err
+	}
+	dc.user.forEachNetwork(func(net *network) {
+		net.notifyDownstreamsChanged()
+	})
+	return nil
+}
+
+func handleServiceSelfGet(dc *downstreamConn, params []string) error {
+	if len(params) > 1 {
+		return fmt.Errorf("expected at most one argument")
+	}
+	return sendServiceSettings(dc, 0, params, func(def *settingDef) bool {
+		return def.userScope
+	})
+}
+
+func handleServiceNetworkSet(dc *downstreamConn, params []string) error {
+	if len(params) < 3 {
+		return fmt.Errorf("expected a network name, a key and a value, or \"default\"")
+	}
+
+	net := dc.user.getNetwork(params[0])
+	if net == nil {
+		return fmt.Errorf("unknown network %q", params[0])
+	}
+
+	if err := setServiceSetting(dc, net.ID, params[1], params[2:]); err != nil {
+		return err
+	}
+	net.notifyDownstreamsChanged()
+	return nil
+}
+
+func handleServiceNetworkGet(dc *downstreamConn, params []string) error {
+	if len(params) < 1 || len(params) > 2 {
+		return fmt.Errorf("expected a network name and an optional key")
+	}
+
+	net := dc.user.getNetwork(params[0])
+	if net == nil {
+		return fmt.Errorf("unknown network %q", params[0])
+	}
+
+	return sendServiceSettings(dc, net.ID, params[1:], func(def *settingDef) bool {
+		return def.networkScope
+	})
+}
+
+func handleServiceNetworkIgnoreList(dc *downstreamConn, params []string) error {
+	if len(params) != 1 {
+		return fmt.Errorf("expected exactly one argument")
+	}
+
+	net := dc.user.getNetwork(params[0])
+	if net == nil {
+		return fmt.Errorf("unknown network %q", params[0])
+	}
+
+	if len(net.ignoreMasks) == 0 {
+		sendServiceNOTICE(dc, fmt.Sprintf("no ignore mask for network %q", net.Addr))
+		return nil
+	}
+	for _, mask := range net.ignoreMasks {
+		sendServiceNOTICE(dc, mask)
+	}
+	return nil
+}
+
+func handleServiceNetworkIgnoreAdd(dc *downstreamConn, params []string) error {
+	if len(params) != 2 {
+		return fmt.Errorf("expected exactly two arguments")
+	}
+
+	net := dc.user.getNetwork(params[0])
+	if net == nil {
+		return fmt.Errorf("unknown network %q", params[0])
+	}
+
+	mask := normalizeMask(params[1])
+	for _, other := range net.ignoreMasks {
+		if other == mask {
+			return fmt.Errorf("mask %q is already ignored", mask)
+		}
+	}
+
+	if err := dc.srv.db.StoreIgnoreMask(net.ID, mask); err != nil {
+		return err
+	}
+	net.ignoreMasks = append(net.ignoreMasks, mask)
+
+	sendServiceNOTICE(dc, fmt.Sprintf("ignoring %q on network %q", mask, net.Addr))
+	return nil
+}
+
+func handleServiceNetworkIgnoreDelete(dc *downstreamConn, params []string) error {
+	if len(params) != 2 {
+		return fmt.Errorf("expected exactly two arguments")
+	}
+
+	net := dc.user.getNetwork(params[0])
+	if net == nil {
+		return fmt.Errorf("unknown network %q", params[0])
+	}
+
+	mask := normalizeMask(params[1])
+	i := -1
+	for j, other := range net.ignoreMasks {
+		if other == mask {
+			i = j
+			break
+		}
+	}
+	if i < 0 {
+		return fmt.Errorf("mask %q isn't ignored", mask)
+	}
+
+	if err := dc.srv.db.DeleteIgnoreMask(net.ID, mask); err != nil {
+		return err
+	}
+	net.ignoreMasks = append(net.ignoreMasks[:i], net.ignoreMasks[i+1:]...)
+
+	sendServiceNOTICE(dc, fmt.Sprintf("deleted ignore mask %q on network %q", mask, net.Addr))
+	return nil
+}
+
+func setServiceSetting(dc *downstreamConn, networkID int64, key string, params []string) error {
+	value := strings.Join(params, " ")
+	if len(params) == 1 && params[0] == "default" {
+		value = ""
+	}
+
+	value, err := dc.user.setSetting(networkID, "", key, value)
+	if err != nil {
+		return err
+	}
+
+	if value == "" {
+		sendServiceNOTICE(dc, fmt.Sprintf("%v reset to default", key))
+	} else {
+		sendServiceNOTICE(dc, fmt.Sprintf("%v set to %q", key, value))
+	}
+	return nil
+}
+
+func sendServiceSettings(dc *downstreamConn, networkID int64, params []string, inScope func(def *settingDef) bool) error {
+	keys := params
+	if len(keys) == 0 {
+		for _, key := range sortedSettingKeys() {
+			if inScope(settingDefs[key]) {
+				keys = append(keys, key)
+			}
+		}
+	}
+
+	for _, key := range keys {
+		def, ok := settingDefs[key]
+		if !ok {
+			return fmt.Errorf("unknown setting %q", key)
+		}
+		value, ok := dc.user.getSetting(networkID, "", key)
+		if !ok {
+			value = "(default)"
+		}
+		sendServiceNOTICE(dc, fmt.Sprintf("%v: %v (%v)", key, value, def.desc))
+	}
+	return nil
+}
+
+func formatBacklogLimit(limit *BacklogLimit) string {
+	count := "unlimited messages"
+	if limit.MaxCount > 0 {
+		count = fmt.Sprintf("%v messages", limit.MaxCount)
+	}
+	age := "unlimited age"
+	if limit.MaxAge > 0 {
+		age = fmt.Sprintf("%v old", limit.MaxAge)
+	}
+	return count + ", " + age
+}
+
+func handleServiceServerFeatures(dc *downstreamConn, params []string) error {
+	sendServiceNOTICE(dc, "soju version: "+sojuVersion())
+
+	var caps []string
+	for name, value := range dc.supportedCaps() {
+		if value != "" {
+			name += "=" + value
+		}
+		caps = append(caps, name)
+	}
+	sort.Strings(caps)
+	sendServiceNOTICE(dc, "client capabilities: "+strings.Join(caps, " "))
+
+	sendServiceNOTICE(dc, "SASL mechanisms: "+strings.Join(dc.saslMechanisms(), ", "))
+	sendServiceNOTICE(dc, fmt.Sprintf("message history: in-memory, %v messages per network", dc.srv.RingCap))
+	sendServiceNOTICE(dc, "default backlog limit: "+formatBacklogLimit(&dc.srv.BacklogLimit))
+
+	flood := "unlimited"
+	if dc.srv.DownstreamFloodRate > 0 {
+		flood = fmt.Sprintf("%v commands per second, burst of %v", dc.srv.DownstreamFloodRate, dc.srv.DownstreamFloodBurst)
+	}
+	sendServiceNOTICE(dc, "client flood limit: "+flood)
+
+	flood = "unlimited"
+	if dc.srv.UpstreamFloodRate > 0 {
+		flood = fmt.Sprintf("%v messages per second, burst of %v, at most %v queued", dc.srv.UpstreamFloodRate, dc.srv.UpstreamFloodBurst, upstreamFloodQueueLen)
+	}
+	sendServiceNOTICE(dc, "server flood limit: "+flood)
+
+	var options []string
+	if dc.srv.ServerPassword != "" {
+		options = append(options, "server password required")
+	}
+	if dc.srv.CollapseNetsplits {
+		options = append(options, "netsplits collapsed")
+	}
+	if len(options) > 0 {
+		sendServiceNOTICE(dc, "options: "+strings.Join(options, ", "))
+	}
+	return nil
+}
+
+func handleServiceAdminBroadcast(dc *downstreamConn, params []string) error {
+	if len(params) == 0 {
+		return fmt.Errorf("expected a message to broadcast")
+	}
+	text := strings.Join(params, " ")
+
+	dc.srv.forEachUser(func(u *user) {
+		// Other users may be busy: don't block the current user's goroutine
+		go func() {
+			u.broadcasts <- text
+		}()
+	})
+
+	sendServiceNOTICE(dc, "broadcast message sent")
+	return nil
+}
+
+func handleServiceAdminUserReload(dc *downstreamConn, params []string) error {
+	if len(params) != 1 {
+		return fmt.Errorf("expected exactly one argument")
+	}
+
+	u := dc.srv.getUser(params[0])
+	if u == nil {
+		return fmt.Errorf("unknown user %q", params[0])
+	}
+
+	select {
+	case u.reloads <- struct{}{}:
+		// This space is intentionally left blank
+	default:
+		// A reload is already pending
+	}
+
+	sendServiceNOTICE(dc, fmt.Sprintf("reloading user %q", u.Username))
+	return nil
+}
+
+func handleServiceSelfCertFP(dc *downstreamConn, params []string) error {
+	fingerprint, err := dc.certFingerprint()
+	if err != nil {
+		return err
+	}
+	sendServiceNOTICE(dc, "SHA-256 fingerprint: "+fingerprint)
+	return nil
+}
+
+// parseCertFingerprint normalizes a hex-encoded SHA-256 fingerprint, which
+// may contain colons.
+func parseCertFingerprint(s string) (string, error) {
+	s = strings.ToLower(strings.Replace(s, ":", "", -1))
+	if b, err := hex.DecodeString(s); err != nil || len(b) != sha256.Size {
+		return "", fmt.Errorf("invalid SHA-256 fingerprint %q", s)
+	}
+	return s, nil
+}
+
+func handleServiceAdminCertFPList(dc *downstreamConn, params []string) error {
+	if len(params) != 1 {
+		return fmt.Errorf("expected exactly one argument")
+	}
+	username := params[0]
+
+	fingerprints, err := dc.srv.db.ListCertFingerprints(username)
+	if err != nil {
+		return err
+	}
+	if len(fingerprints) == 0 {
+		sendServiceNOTICE(dc, fmt.Sprintf("no certificate for user %q", username))
+		return nil
+	}
+	for _, fp := range fingerprints {
+		sendServiceNOTICE(dc, fp)
+	}
+	return nil
+}
+
+func handleServiceAdminCertFPAdd(dc *downstreamConn, params []string) error {
+	if len(params) != 2 {
+		return fmt.Errorf("expected exactly two arguments")
+	}
+	username := params[0]
+	fingerprint, err := parseCertFingerprint(params[1])
+	if err != nil {
+		return err
+	}
+
+	if dc.srv.getUser(username) == nil {
+		return fmt.Errorf("unknown user %q", username)
+	}
+	if owner, err := dc.srv.db.GetCertFingerprintUser(fingerprint); err != nil {
+		return err
+	} else if owner != "" {
+		return fmt.Errorf("certificate already belongs to user %q", owner)
+	}
+
+	if err := dc.srv.db.StoreCertFingerprint(username, fingerprint); err != nil {
+		return err
+	}
+
+	sendServiceNOTICE(dc, fmt.Sprintf("added certificate for user %q", username))
+	return nil
+}
+
+func handleServiceAdminCertFPDelete(dc *downstreamConn, params []string) error {
+	if len(params) != 2 {
+		return fmt.Errorf("expected exactly two arguments")
+	}
+	username := params[0]
+	fingerprint, err := parseCertFingerprint(params[1])
+	if err != nil {
+		return err
+	}
+
+	if err := dc.srv.db.DeleteCertFingerprint(username, fingerprint); err != nil {
+		return err
+	}
+
+	sendServiceNOTICE(dc, fmt.Sprintf("deleted certificate for user %q", username))
+	return nil
+}
@@ -0,0 +1,150 @@
+package soju
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// settingDef describes a setting users can change with the "set" service
+// commands.
+type settingDef struct {
+	desc string
+	// Whether the setting can be set for the whole user, for a network or
+	// for a channel
+	userScope, networkScope, channelScope bool
+	// parse validates a value and returns its canonical form
+	parse func(value string) (string, error)
+}
+
+var settingDefs = map[string]*settingDef{
+	"auto-away": {
+		desc:         "mark yourself as away while no client is attached, defaults to the server configuration",
+		userScope:    true,
+		networkScope: true,
+		parse:        parseBoolSetting,
+	},
+}
+
+func parseBoolSetting(value string) (string, error) {
+	b, err := parseBool(value)
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatBool(b), nil
+}
+
+// sortedSettingKeys returns the keys of settingDefs, sorted.
+func sortedSettingKeys() []string {
+	keys := make([]string, 0, len(settingDefs))
+	for key := range settingDefs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+type settingKey struct {
+	networkID int64
+	channel   string
+	key       string
+}
+
+// loadSettings populates the settings cache from the database.
+func (u *user) loadSettings() error {
+	records, err := u.srv.db.ListSettings(u.Username)
+	if err != nil {
+		return err
+	}
+
+	settings := make(map[settingKey]string, len(records))
+	for _, s := range records {
+		settings[settingKey{s.NetworkID, s.Channel, s.Key}] = s.Value
+	}
+
+	u.lock.Lock()
+	u.settings = settings
+	u.lock.Unlock()
+	return nil
+}
+
+// getSetting returns the value of a setting. Values set for a channel take
+// precedence over values set for its network, which take precedence over
+// values set for the user.
+func (u *user) getSetting(networkID int64, channel, key string) (value string, ok bool) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	if channel != "" {
+		if value, ok := u.settings[settingKey{networkID, channel, key}]; ok {
+			return value, true
+		}
+	}
+	if networkID != 0 {
+		if value, ok := u.settings[settingKey{networkID, "", key}]; ok {
+			return value, true
+		}
+	}
+	value, ok = u.settings[settingKey{0, "", key}]
+	return value, ok
+}
+
+// boolSetting returns the value of a boolean setting, or def if unset.
+func (u *user) boolSetting(networkID int64, channel, key string, def bool) bool {
+	value, ok := u.getSetting(networkID, channel, key)
+	if !ok {
+		return def
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return def
+	}
+	return b
+}
+
+// setSetting validates and stores a setting. An empty value resets the
+// setting to its default. The canonical form of the value is returned.
+func (u *user) setSetting(networkID int64, channel, key, value string) (string, error) {
+	def, ok := settingDefs[key]
+	if !ok {
+		return "", fmt.Errorf("unknown setting %q", key)
+	}
+	switch {
+	case channel != "" && !def.channelScope:
+		return "", fmt.Errorf("setting %q can't be set for a channel", key)
+	case channel == "" && networkID != 0 && !def.networkScope:
+		return "", fmt.Errorf("setting %q can't be set for a network", key)
+	case networkID == 0 && !def.userScope:
+		return "", fmt.Errorf("setting %q can only be set for a network or channel", key)
+	}
+
+	k := settingKey{networkID, channel, key}
+	if value == "" {
+		if err := u.srv.db.DeleteSetting(u.Username, networkID, channel, key); err != nil {
+			return "", err
+		}
+		u.lock.Lock()
+		delete(u.settings, k)
+		u.lock.Unlock()
+		return "", nil
+	}
+
+	value, err := def.parse(value)
+	if err != nil {
+		return "", err
+	}
+	err = u.srv.db.StoreSetting(u.Username, &Setting{
+		NetworkID: networkID,
+		Channel:   channel,
+		Key:       key,
+		Value:     value,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	u.lock.Lock()
+	u.settings[k] = value
+	u.lock.Unlock()
+	return value, nil
+}
@@ -1,17 +1,20 @@
 package soju
 
 import (
+	"context"
 	"crypto/tls"
-	"encoding/base64"
 	"fmt"
 	"io"
 	"net"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/emersion/go-sasl"
+	"golang.org/x/net/proxy"
+	"golang.org/x/time/rate"
 	"gopkg.in/irc.v3"
 )
 
@@ -25,8 +28,42 @@ type upstreamChannel struct {
 	modes     modeSet
 	Members   map[string]membership
 	complete  bool
+
+	// Downstream connections waiting for the channel to be complete to
+	// receive a NAMES reply
+	pendingNAMES map[*downstreamConn]struct{}
+}
+
+// upstreamUser holds information about a user sharing a channel with us.
+type upstreamUser struct {
+	Nick     string
+	Username string
+	Hostname string
+	Account  string // empty if not logged in
+	Away     bool
 }
 
+// Capabilities requested from upstream servers, if available.
+var permanentUpstreamCaps = map[string]bool{
+	"account-notify": true,
+	"account-tag":    true,
+	"away-notify":    true,
+	"chghost":        true,
+	"setname":        true,
+	// Used to track the username and hostname of channel members
+	"userhost-in-names": true,
+}
+
+// Token used to recognize replies to the WHOX queries sent when joining a
+// channel.
+const whoxJoinToken = "521"
+
+// Maximum number of messages from downstream connections which can be queued
+// for an upstream connection because of the flood limit.
+const upstreamFloodQueueLen = 64
+
+var errUpstreamFlooded = fmt.Errorf("too many messages queued for the upstream server")
+
 type upstreamConn struct {
 	network  *network
 	logger   Logger
@@ -37,22 +74,81 @@ type upstreamConn struct {
 	outgoing chan<- *irc.Message
 	ring     *Ring
 
+	// Messages relayed from downstream connections, subject to the flood
+	// limit
+	floodQueue   chan *irc.Message
+	floodLimiter *rate.Limiter
+
 	serverName            string
 	availableUserModes    string
 	availableChannelModes string
 	channelModesWithParam string
-
-	registered bool
-	nick       string
-	username   string
-	realname   string
-	closed     bool
-	modes      modeSet
-	channels   map[string]*upstreamChannel
-	caps       map[string]string
-
-	saslClient  sasl.Client
-	saslStarted bool
+	gotMOTD               bool // the MOTD sent on registration has ended
+
+	// Populated from RPL_ISUPPORT, with defaults for servers which don't
+	// advertise the corresponding tokens
+	gotISUPPORT              bool
+	availableChannelTypes    string
+	availableMembershipModes string // matches availableMemberships
+	availableMemberships     string
+	channelModeTypes         map[byte]channelModeType
+	supportsWHOX             bool
+	supportsMONITOR          bool
+	elist                    string // LIST extensions, see ELIST
+
+	registered  bool
+	nick        string
+	username    string
+	realname    string
+	closed      bool
+	modes       modeSet
+	away        bool // as reported by RPL_NOWAWAY and RPL_UNAWAY
+	channels    map[string]*upstreamChannel
+	users       map[string]*upstreamUser // populated by WHOX on join
+	caps        map[string]string        // advertised by the server
+	enabledCaps map[string]bool
+
+	saslClient    sasl.Client
+	saslMechanism string // mechanism of saslClient
+	saslRetry     string // mechanism to fall back to, see RPL_SASLMECHS
+	saslStarted   bool
+	saslChallenge saslPayloadDecoder
+
+	netsplit   *netsplit            // pending netsplit summary
+	splitNicks map[string]time.Time // users who quit in a netsplit
+	// Servers of the last netsplit, as in the QUIT reason
+	splitServers string
+
+	// Channels for which the WHOX query sent on join hasn't completed yet
+	pendingJoinWHOX map[string]struct{}
+	// Channels for which a JOIN has been sent, but not replied to yet, see
+	// addPendingJoins
+	pendingJoins map[string]struct{}
+	// WHO queries sent on behalf of downstream connections, in order
+	pendingWHOs []*pendingWHO
+
+	// Channel mode queries sent on behalf of downstream connections, in
+	// order, and the last one answered with RPL_CHANNELMODEIS
+	pendingModeQueries []*pendingModeQuery
+	lastModeQuery      *pendingModeQuery
+
+	// Downstream connections which sent the STATS queries which haven't
+	// completed yet, in order
+	pendingSTATS []*downstreamConn
+	// Downstream connections which sent the WHOIS queries which haven't
+	// completed yet, in order
+	pendingWHOISes []*downstreamConn
+	// Downstream connections which sent the OPER commands which haven't
+	// been replied to yet, in order
+	pendingOPERs []*downstreamConn
+
+	monitored      map[string]*upstreamMonitor // see updateMonitor
+	monitorPolling bool                        // an ISON poll is scheduled
+	pendingISON    [][]string                  // nicks of ISON queries sent
+
+	// Protects closed and outgoing, which can be used by the pinger and
+	// downstream watcher while the connection is being closed
+	closeLock sync.Mutex
 
 	lock    sync.Mutex
 	history map[string]uint64 // TODO: move to network
@@ -66,13 +162,36 @@ func connectToUpstream(network *network) (*upstreamConn, error) {
 		addr = addr + ":6697"
 	}
 
-	logger.Printf("connecting to TLS server at address %q", addr)
-	netConn, err := tls.Dial("tcp", addr, nil)
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid address %q: %v", addr, err)
+	}
+
+	var dialer proxy.Dialer = proxy.Direct
+	if u := network.user.srv.UpstreamProxy; u != nil {
+		logger.Printf("connecting to TLS server at address %q via proxy %q", addr, u.Host)
+		dialer, err = proxy.FromURL(u, proxy.Direct)
+		if err != nil {
+			return nil, fmt.Errorf("failed to set up proxy: %v", err)
+		}
+	} else {
+		logger.Printf("connecting to TLS server at address %q", addr)
+	}
+
+	rawConn, err := dialer.Dial("tcp", addr)
 	if err != nil {
 		return nil, fmt.Errorf("failed to dial %q: %v", addr, err)
 	}
 
-	setKeepAlive(netConn)
+	setKeepAlive(rawConn)
+
+	// The TLS handshake is performed on the first read or write
+	netConn := tls.Client(rawConn, &tls.Config{ServerName: host})
+
+	floodLimit := rate.Inf
+	if network.user.srv.UpstreamFloodRate > 0 {
+		floodLimit = rate.Limit(network.user.srv.UpstreamFloodRate)
+	}
 
 	outgoing := make(chan *irc.Message, 64)
 	uc := &upstreamConn{
@@ -83,14 +202,44 @@ func connectToUpstream(network *network) (*upstreamConn, error) {
 		srv:      network.user.srv,
 		user:     network.user,
 		outgoing: outgoing,
+
+		floodQueue:   make(chan *irc.Message, upstreamFloodQueueLen),
+		floodLimiter: rate.NewLimiter(floodLimit, network.user.srv.UpstreamFloodBurst),
+
 		ring:     NewRing(network.user.srv.RingCap),
 		channels: make(map[string]*upstreamChannel),
 		history:  make(map[string]uint64),
 		caps:     make(map[string]string),
+
+		enabledCaps: make(map[string]bool),
+
+		splitNicks: make(map[string]time.Time),
+		users:      make(map[string]*upstreamUser),
+
+		pendingJoinWHOX: make(map[string]struct{}),
+		pendingJoins:    make(map[string]struct{}),
+		monitored:       make(map[string]*upstreamMonitor),
+
+		availableChannelTypes:    stdChannelTypes,
+		availableMembershipModes: stdMembershipModes,
+		availableMemberships:     stdMembershipPrefixes,
+		channelModeTypes:         stdChannelModes,
 	}
 
 	go func() {
-		for msg := range outgoing {
+		for {
+			var msg *irc.Message
+			select {
+			case msg = <-outgoing:
+			case msg = <-uc.floodQueue:
+				if err := uc.floodLimiter.Wait(context.Background()); err != nil {
+					uc.logger.Printf("flood limiter failed: %v", err)
+				}
+			}
+			if msg == nil {
+				break
+			}
+
 			if uc.srv.Debug {
 				uc.logger.Printf("sent: %v", msg)
 			}
@@ -98,6 +247,16 @@ func connectToUpstream(network *network) (*upstreamConn, error) {
 				uc.logger.Printf("failed to write message: %v", err)
 			}
 		}
+		// No message can be queued anymore once the connection is closed
+	drain:
+		for {
+			select {
+			case msg := <-uc.floodQueue:
+				uc.logger.Printf("dropping queued message on close: %v", msg.Command)
+			default:
+				break drain
+			}
+		}
 		if err := uc.net.Close(); err != nil {
 			uc.logger.Printf("failed to close connection: %v", err)
 		} else {
@@ -109,6 +268,9 @@ func connectToUpstream(network *network) (*upstreamConn, error) {
 }
 
 func (uc *upstreamConn) Close() error {
+	uc.closeLock.Lock()
+	defer uc.closeLock.Unlock()
+
 	if uc.closed {
 		return fmt.Errorf("upstream connection already closed")
 	}
@@ -126,6 +288,445 @@ func (uc *upstreamConn) forEachDownstream(f func(*downstreamConn)) {
 	})
 }
 
+// isServerPrefix returns true if the prefix refers to a server rather than a
+// user.
+func (uc *upstreamConn) isServerPrefix(prefix *irc.Prefix) bool {
+	if prefix == nil || prefix.Name == "" || prefix.Name == uc.serverName {
+		return true
+	}
+	return prefix.User == "" && prefix.Host == "" && strings.ContainsRune(prefix.Name, '.')
+}
+
+// Minimum delay between two auto-replies sent to the same nick.
+const autoReplyInterval = 30 * time.Minute
+
+// isServiceNick checks whether a nick is likely to belong to a network
+// service such as NickServ or ChanServ.
+func isServiceNick(nick string) bool {
+	nick = strings.ToLower(nick)
+	switch nick {
+	case "global", "services":
+		return true
+	}
+	return strings.HasSuffix(nick, "serv")
+}
+
+// autoReply sends the user's auto-reply to the sender of a direct message if
+// no downstream connection is attached to the network.
+func (uc *upstreamConn) autoReply(prefix *irc.Prefix) {
+	uc.user.lock.Lock()
+	text := uc.user.AutoReply
+	uc.user.lock.Unlock()
+
+	if text == "" || uc.isServerPrefix(prefix) || isServiceNick(prefix.Name) || prefix.Name == uc.nick {
+		return
+	}
+	if uc.network.hasDownstreams() {
+		return
+	}
+
+	now := time.Now()
+	for nick, t := range uc.network.autoReplies {
+		if now.Sub(t) > autoReplyInterval {
+			delete(uc.network.autoReplies, nick)
+		}
+	}
+	if _, ok := uc.network.autoReplies[prefix.Name]; ok {
+		return
+	}
+	uc.network.autoReplies[prefix.Name] = now
+
+	uc.SendMessage(&irc.Message{
+		Command: "NOTICE",
+		Params:  []string{prefix.Name, text},
+	})
+}
+
+// getPendingLIST returns the pending LIST the next LIST replies belong to. The
+// caller must hold pendingLISTsLock.
+func (uc *upstreamConn) getPendingLIST() *pendingLIST {
+	for _, pl := range uc.user.pendingLISTs {
+		if _, ok := pl.pendingCommands[uc]; ok {
+			return pl
+		}
+	}
+	return nil
+}
+
+// sendLIST sends the LIST command of the first pending LIST. If it can't be
+// queued because of the flood limit, the LIST is completed right away. The
+// caller must not hold pendingLISTsLock.
+func (uc *upstreamConn) sendLIST(cmd *irc.Message) {
+	if err := uc.SendMessageLimited(cmd); err != nil {
+		uc.logger.Printf("dropping LIST: %v", err)
+		uc.endPendingLIST()
+	}
+}
+
+// endPendingLIST completes the first pending LIST, and sends the next queued
+// LIST command, if any. It returns false if there is no pending LIST.
+func (uc *upstreamConn) endPendingLIST() bool {
+	uc.user.pendingLISTsLock.Lock()
+	pl := uc.getPendingLIST()
+	var completed []*downstreamConn
+	var next *irc.Message
+	if pl != nil {
+		delete(pl.pendingCommands, uc)
+		completed = uc.user.removeCompletedLISTs()
+		if pl := uc.getPendingLIST(); pl != nil {
+			next = pl.pendingCommands[uc]
+		}
+	}
+	uc.user.pendingLISTsLock.Unlock()
+
+	sendListEnd(completed)
+	if next != nil {
+		uc.sendLIST(next)
+	}
+	return pl != nil
+}
+
+// abortPendingLISTs completes the pending LISTs of a closed upstream
+// connection, so that downstream connections aren't left waiting for
+// RPL_LISTEND.
+func (uc *upstreamConn) abortPendingLISTs() {
+	uc.user.pendingLISTsLock.Lock()
+	for _, pl := range uc.user.pendingLISTs {
+		delete(pl.pendingCommands, uc)
+	}
+	completed := uc.user.removeCompletedLISTs()
+	uc.user.pendingLISTsLock.Unlock()
+
+	sendListEnd(completed)
+}
+
+// handleForcedNick handles a nick change which wasn't requested by a
+// downstream connection, e.g. forced by services. Unless forced nicks are
+// persisted, the previous nick is used again on reconnection, which may cause
+// the nick to be changed again: downstream connections are warned about it.
+func (uc *upstreamConn) handleForcedNick(nick string) {
+	var text string
+	if uc.srv.PersistForcedNicks {
+		uc.logger.Printf("nick changed by the server, saving %q as the network nick", nick)
+		err := uc.network.updateRecord(func(record *Network) {
+			record.Nick = nick
+		})
+		if err != nil {
+			uc.logger.Printf("failed to store network nick: %v", err)
+		}
+		text = fmt.Sprintf("network %q changed your nick to %q, it will be used on reconnection", uc.network.Addr, nick)
+	} else {
+		uc.logger.Printf("nick changed by the server to %q", nick)
+		text = fmt.Sprintf("network %q changed your nick to %q, %q will be used again on reconnection: use NICK to keep the new nick", uc.network.Addr, nick, uc.network.Nick)
+	}
+
+	uc.forEachDownstream(func(dc *downstreamConn) {
+		sendServiceNOTICE(dc, text)
+	})
+}
+
+// trackUser records the username and hostname of a user, if known.
+func (uc *upstreamConn) trackUser(prefix *irc.Prefix) {
+	if prefix.Name == uc.nick || prefix.User == "" || prefix.Host == "" {
+		return
+	}
+	if u, ok := uc.users[prefix.Name]; ok {
+		u.Username = prefix.User
+		u.Hostname = prefix.Host
+		return
+	}
+	uc.users[prefix.Name] = &upstreamUser{
+		Nick:     prefix.Name,
+		Username: prefix.User,
+		Hostname: prefix.Host,
+	}
+}
+
+// pruneUsers forgets about users who don't share any channel with us anymore.
+func (uc *upstreamConn) pruneUsers() {
+	for nick := range uc.users {
+		found := false
+		for _, ch := range uc.channels {
+			if _, ok := ch.Members[nick]; ok {
+				found = true
+				break
+			}
+		}
+		if !found {
+			delete(uc.users, nick)
+		}
+	}
+}
+
+func (uc *upstreamConn) isChannel(name string) bool {
+	return name != "" && strings.IndexByte(uc.availableChannelTypes, name[0]) >= 0
+}
+
+func (uc *upstreamConn) parseMembershipPrefix(s string) (prefix membership, nick string) {
+	return parseMembershipPrefix(uc.availableMemberships, s)
+}
+
+// channelKeyChange returns the channel key set by a mode change, if the change
+// sets or unsets the key. An empty key means the key is unset.
+func (uc *upstreamConn) channelKeyChange(modeStr string, args []string) (key string, changed bool) {
+	var plusMinus byte
+	for i := 0; i < len(modeStr); i++ {
+		mode := modeStr[i]
+		if mode == '+' || mode == '-' {
+			plusMinus = mode
+			continue
+		}
+
+		var arg string
+		takesArg := strings.IndexByte(uc.availableMembershipModes, mode) >= 0
+		if mt, ok := uc.channelModeTypes[mode]; ok {
+			takesArg = takesArg || mt == modeTypeA || mt == modeTypeB || (mt == modeTypeC && plusMinus == '+')
+		}
+		if takesArg && len(args) > 0 {
+			arg = args[0]
+			args = args[1:]
+		}
+
+		if mode != 'k' {
+			continue
+		}
+		if plusMinus == '+' {
+			key, changed = arg, arg != ""
+		} else if plusMinus == '-' {
+			key, changed = "", true
+		}
+	}
+	return key, changed
+}
+
+// applyChannelModes applies a channel mode change. Membership mode changes
+// update the channel members, list modes are ignored.
+func (uc *upstreamConn) applyChannelModes(ch *upstreamChannel, modeStr string, args []string) error {
+	var plusMinus byte
+	for i := 0; i < len(modeStr); i++ {
+		mode := modeStr[i]
+		if mode == '+' || mode == '-' {
+			plusMinus = mode
+			continue
+		}
+		if plusMinus == 0 {
+			return fmt.Errorf("malformed modestring %q: missing plus/minus", modeStr)
+		}
+
+		if j := strings.IndexByte(uc.availableMembershipModes, mode); j >= 0 {
+			if len(args) == 0 {
+				return fmt.Errorf("malformed modestring %q: missing mode argument for %c%c", modeStr, plusMinus, mode)
+			}
+			nick := args[0]
+			args = args[1:]
+
+			prefix := membership(uc.availableMemberships[j])
+			current, ok := ch.Members[nick]
+			if !ok {
+				continue
+			}
+			if plusMinus == '+' {
+				ch.Members[nick] = prefix
+			} else if current == prefix {
+				// TODO: keep track of all member modes, not just the highest
+				ch.Members[nick] = 0
+			}
+			continue
+		}
+
+		mt, ok := uc.channelModeTypes[mode]
+		if !ok {
+			// Unknown mode: assume it doesn't take any argument
+			mt = modeTypeD
+		}
+
+		if mt == modeTypeA || mt == modeTypeB || (mt == modeTypeC && plusMinus == '+') {
+			if len(args) > 0 {
+				args = args[1:]
+			}
+		}
+		if mt == modeTypeA {
+			continue
+		}
+
+		if plusMinus == '+' {
+			ch.modes.Add(mode)
+		} else {
+			ch.modes.Del(mode)
+		}
+	}
+	return nil
+}
+
+// membershipMode returns the channel mode letter of a membership prefix, or
+// zero if there is none.
+func (uc *upstreamConn) membershipMode(m membership) byte {
+	if m == 0 {
+		return 0
+	}
+	i := strings.IndexByte(uc.availableMemberships, byte(m))
+	if i < 0 {
+		return 0
+	}
+	return uc.availableMembershipModes[i]
+}
+
+// addPendingJoins records the channels of a JOIN sent to the server, so that
+// join errors can be told apart from errors replied to other commands.
+func (uc *upstreamConn) addPendingJoins(channels string) {
+	for _, name := range strings.Split(channels, ",") {
+		// TODO: use the server casemapping
+		uc.pendingJoins[strings.ToLower(name)] = struct{}{}
+	}
+}
+
+// popPendingJoin returns whether a JOIN has been sent for a channel, and
+// removes it from the pending JOINs.
+func (uc *upstreamConn) popPendingJoin(name string) bool {
+	// TODO: use the server casemapping
+	name = strings.ToLower(name)
+	_, ok := uc.pendingJoins[name]
+	delete(uc.pendingJoins, name)
+	return ok
+}
+
+// forEachWHOISDownstream calls f with the downstream connection a WHOIS reply
+// belongs to. RPL_ENDOFWHOIS completes the WHOIS query. RPL_AWAY and
+// ERR_NOSUCHNICK are also sent in reply to PRIVMSG: if there is no pending
+// WHOIS query, they are sent to all downstream connections.
+func (uc *upstreamConn) forEachWHOISDownstream(cmd string, f func(dc *downstreamConn)) {
+	if len(uc.pendingWHOISes) == 0 {
+		if cmd == irc.RPL_AWAY || cmd == irc.ERR_NOSUCHNICK {
+			uc.forEachDownstream(f)
+		} else {
+			uc.logger.Printf("ignoring unsolicited WHOIS reply %v", cmd)
+		}
+		return
+	}
+
+	dc := uc.pendingWHOISes[0]
+	if cmd == irc.RPL_ENDOFWHOIS {
+		uc.pendingWHOISes = uc.pendingWHOISes[1:]
+	}
+	if !dc.isClosed() {
+		f(dc)
+	}
+}
+
+// pendingWHO is a WHO query sent on behalf of a downstream connection.
+type pendingWHO struct {
+	downstream *downstreamConn
+	fields     string // WHOX fields, empty if WHOX isn't used
+}
+
+// getPendingWHO returns the WHO query the next replies belong to, if any.
+func (uc *upstreamConn) getPendingWHO() *pendingWHO {
+	if len(uc.pendingWHOs) == 0 {
+		return nil
+	}
+	return uc.pendingWHOs[0]
+}
+
+// popPendingWHO removes the WHO query the next replies belong to, once it has
+// completed.
+func (uc *upstreamConn) popPendingWHO() *pendingWHO {
+	pw := uc.getPendingWHO()
+	if pw != nil {
+		uc.pendingWHOs = uc.pendingWHOs[1:]
+	}
+	return pw
+}
+
+// pendingModeQuery is a channel mode query sent on behalf of a downstream
+// connection.
+//
+// When a channel is rejoined after a reconnection, its modes are queried by
+// the bouncer itself, with a nil downstream connection: the reply is only
+// forwarded to the downstream connections which received the previous state
+// of the channel, if the modes have changed.
+type pendingModeQuery struct {
+	channel string
+	list    byte // queried list mode, zero for RPL_CHANNELMODEIS
+	dc      *downstreamConn
+
+	prevModes   modeSet
+	downstreams []*downstreamConn
+}
+
+// Replies to list mode queries, with the list mode they belong to.
+var modeListReplies = map[string]byte{
+	irc.RPL_BANLIST:         'b',
+	irc.RPL_ENDOFBANLIST:    'b',
+	irc.RPL_EXCEPTLIST:      'e',
+	irc.RPL_ENDOFEXCEPTLIST: 'e',
+	irc.RPL_INVITELIST:      'I',
+	irc.RPL_ENDOFINVITELIST: 'I',
+}
+
+// isModeListQuery checks whether a modestring only queries list modes whose
+// replies can be matched to the query.
+func isModeListQuery(modeStr string) bool {
+	modeStr = strings.TrimPrefix(modeStr, "+")
+	if modeStr == "" {
+		return false
+	}
+	for i := 0; i < len(modeStr); i++ {
+		switch modeStr[i] {
+		case 'b', 'e', 'I':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// addModeQuery records a channel mode query sent on behalf of a downstream
+// connection, so that the replies are only forwarded to it.
+func (uc *upstreamConn) addModeQuery(dc *downstreamConn, channel, modeStr string) {
+	if modeStr == "" {
+		uc.pendingModeQueries = append(uc.pendingModeQueries, &pendingModeQuery{channel: channel, dc: dc})
+		return
+	}
+	modeStr = strings.TrimPrefix(modeStr, "+")
+	for i := 0; i < len(modeStr); i++ {
+		uc.pendingModeQueries = append(uc.pendingModeQueries, &pendingModeQuery{channel: channel, list: modeStr[i], dc: dc})
+	}
+}
+
+// popModeQuery returns the pending channel mode query a reply belongs to, if
+// any. The query is removed once the last reply has been received.
+func (uc *upstreamConn) popModeQuery(cmd, channel string) *pendingModeQuery {
+	switch cmd {
+	case rpl_channelurl, rpl_creationtime:
+		// Sent after RPL_CHANNELMODEIS, but also on their own by some
+		// servers
+		q := uc.lastModeQuery
+		if q == nil || !strings.EqualFold(q.channel, channel) {
+			return nil
+		}
+		if cmd == rpl_creationtime {
+			uc.lastModeQuery = nil
+		}
+		return q
+	}
+
+	list := modeListReplies[cmd]
+	for i, q := range uc.pendingModeQueries {
+		if q.list != list || !strings.EqualFold(q.channel, channel) {
+			continue
+		}
+		switch cmd {
+		case irc.RPL_CHANNELMODEIS:
+			uc.lastModeQuery = q
+		case irc.RPL_BANLIST, irc.RPL_EXCEPTLIST, irc.RPL_INVITELIST:
+			return q
+		}
+		uc.pendingModeQueries = append(uc.pendingModeQueries[:i], uc.pendingModeQueries[i+1:]...)
+		return q
+	}
+	return nil
+}
+
 func (uc *upstreamConn) getChannel(name string) (*upstreamChannel, error) {
 	ch, ok := uc.channels[name]
 	if !ok {
@@ -135,7 +736,155 @@ func (uc *upstreamConn) getChannel(name string) (*upstreamChannel, error) {
 }
 
 func (uc *upstreamConn) handleMessage(msg *irc.Message) error {
+	// Keep track of accounts with the account tag, and fill it in from the
+	// data tracked via WHOX and ACCOUNT if the server didn't send it
+	var sender *upstreamUser
+	if msg.Prefix != nil {
+		sender = uc.users[msg.Prefix.Name]
+	}
+	if sender != nil {
+		if account, ok := msg.Tags["account"]; ok {
+			sender.Account = string(account)
+		} else if sender.Account != "" {
+			if msg.Tags == nil {
+				msg.Tags = make(irc.Tags)
+			}
+			msg.Tags["account"] = irc.TagValue(sender.Account)
+		}
+	}
+
 	switch msg.Command {
+	case "ACCOUNT":
+		if msg.Prefix == nil {
+			return fmt.Errorf("expected a prefix")
+		}
+
+		var account string
+		if err := parseMessageParams(msg, &account); err != nil {
+			return err
+		}
+		if account == "*" {
+			account = ""
+		}
+
+		if msg.Prefix.Name != uc.nick {
+			if u, ok := uc.users[msg.Prefix.Name]; ok {
+				u.Account = account
+			} else {
+				uc.users[msg.Prefix.Name] = &upstreamUser{
+					Nick:     msg.Prefix.Name,
+					Username: msg.Prefix.User,
+					Hostname: msg.Prefix.Host,
+					Account:  account,
+				}
+			}
+		}
+
+		uc.forEachDownstream(func(dc *downstreamConn) {
+			if !dc.caps["account-notify"] {
+				return
+			}
+			dc.SendMessage(dc.marshalMessage(&irc.Message{
+				Prefix:  dc.marshalUserPrefix(uc, msg.Prefix),
+				Command: "ACCOUNT",
+				Params:  msg.Params,
+			}, uc))
+		})
+	case "AWAY":
+		if msg.Prefix == nil {
+			return fmt.Errorf("expected a prefix")
+		}
+
+		away := len(msg.Params) > 0
+		if msg.Prefix.Name != uc.nick {
+			if u, ok := uc.users[msg.Prefix.Name]; ok {
+				u.Away = away
+			} else {
+				uc.users[msg.Prefix.Name] = &upstreamUser{
+					Nick:     msg.Prefix.Name,
+					Username: msg.Prefix.User,
+					Hostname: msg.Prefix.Host,
+					Away:     away,
+				}
+			}
+		}
+
+		uc.forEachDownstream(func(dc *downstreamConn) {
+			if !dc.caps["away-notify"] {
+				return
+			}
+			dc.SendMessage(dc.marshalMessage(&irc.Message{
+				Prefix:  dc.marshalUserPrefix(uc, msg.Prefix),
+				Command: "AWAY",
+				Params:  msg.Params,
+			}, uc))
+		})
+	case "CHGHOST":
+		if msg.Prefix == nil {
+			return fmt.Errorf("expected a prefix")
+		}
+
+		var username, host string
+		if err := parseMessageParams(msg, &username, &host); err != nil {
+			return err
+		}
+
+		if u, ok := uc.users[msg.Prefix.Name]; ok {
+			u.Username = username
+			u.Hostname = host
+		}
+
+		uc.forEachDownstream(func(dc *downstreamConn) {
+			if !dc.caps["chghost"] {
+				return
+			}
+			dc.SendMessage(dc.marshalMessage(&irc.Message{
+				Prefix:  dc.marshalUserPrefix(uc, msg.Prefix),
+				Command: "CHGHOST",
+				Params:  []string{username, host},
+			}, uc))
+		})
+	case "SETNAME":
+		if msg.Prefix == nil {
+			return fmt.Errorf("expected a prefix")
+		}
+
+		var realname string
+		if err := parseMessageParams(msg, &realname); err != nil {
+			return err
+		}
+
+		me := msg.Prefix.Name == uc.nick
+		if me {
+			uc.realname = realname
+			err := uc.network.updateRecord(func(record *Network) {
+				record.Realname = realname
+			})
+			if err != nil {
+				uc.logger.Printf("failed to store realname: %v", err)
+			}
+		}
+
+		uc.forEachDownstream(func(dc *downstreamConn) {
+			if me && dc.network == nil {
+				// In multi-upstream mode, the change has already been
+				// echoed to the client
+				return
+			}
+			if me {
+				dc.realname = realname
+			}
+			if !dc.caps["setname"] {
+				return
+			}
+			dc.SendMessage(dc.marshalMessage(&irc.Message{
+				Prefix:  dc.marshalUserPrefix(uc, msg.Prefix),
+				Command: "SETNAME",
+				Params:  []string{realname},
+			}, uc))
+		})
+	case "PONG":
+		// Ignore: replies to the PINGs sent by sendPings
 	case "PING":
 		uc.SendMessage(&irc.Message{
 			Command: "PONG",
@@ -152,33 +901,69 @@ func (uc *upstreamConn) handleMessage(msg *irc.Message) error {
 			return err
 		}
 
-		if name == msg.Prefix.Name { // user mode change
+		if !uc.isChannel(name) { // user mode change
 			if name != uc.nick {
 				return fmt.Errorf("received MODE message for unknow nick %q", name)
 			}
-			return uc.modes.Apply(modeStr)
+			// The IRC operator status is the 'o' user mode
+			wasOper := uc.modes.Has('o')
+			if err := uc.modes.Apply(modeStr); err != nil {
+				return err
+			}
+			if isOper := uc.modes.Has('o'); isOper != wasOper {
+				if isOper {
+					uc.logger.Printf("became IRC operator")
+				} else {
+					uc.logger.Printf("no longer IRC operator")
+				}
+			}
+
+			uc.forEachDownstream(func(dc *downstreamConn) {
+				// In multi-upstream mode, the user modes of the different
+				// networks can't be merged
+				if dc.network == nil {
+					return
+				}
+				params := []string{dc.nick, modeStr}
+				params = append(params, msg.Params[2:]...)
+				dc.SendMessage(dc.marshalMessage(&irc.Message{
+					Prefix:  dc.prefix(),
+					Command: "MODE",
+					Params:  params,
+				}, uc))
+			})
 		} else { // channel mode change
 			ch, err := uc.getChannel(name)
 			if err != nil {
 				return err
 			}
-			if err := ch.modes.Apply(modeStr); err != nil {
+			if err := uc.applyChannelModes(ch, modeStr, msg.Params[2:]); err != nil {
 				return err
 			}
 
 			uc.forEachDownstream(func(dc *downstreamConn) {
-				dc.SendMessage(&irc.Message{
+				params := []string{dc.marshalChannel(uc, name), modeStr}
+				params = append(params, msg.Params[2:]...)
+
+				dc.SendMessage(dc.marshalMessage(&irc.Message{
 					Prefix:  dc.marshalUserPrefix(uc, msg.Prefix),
 					Command: "MODE",
-					Params:  []string{dc.marshalChannel(uc, name), modeStr},
-				})
+					Params:  params,
+				}, uc))
 			})
 		}
 	case "NOTICE":
 		uc.logger.Print(msg)
 
+		if uc.network.SuppressServerNotices && uc.isServerPrefix(msg.Prefix) {
+			break
+		}
+		if uc.network.isIgnored(msg.Prefix) {
+			break
+		}
+
 		uc.forEachDownstream(func(dc *downstreamConn) {
-			dc.SendMessage(msg)
+			dc.SendMessage(dc.marshalMessage(msg, uc))
 		})
 	case "CAP":
 		var subCmd string
@@ -209,12 +994,23 @@ func (uc *upstreamConn) handleMessage(msg *irc.Message) error {
 				break // wait to receive all capabilities
 			}
 
+			var requestCaps []string
+			for name := range permanentUpstreamCaps {
+				if _, ok := uc.caps[name]; ok {
+					requestCaps = append(requestCaps, name)
+				}
+			}
 			if uc.requestSASL() {
+				requestCaps = append(requestCaps, "sasl")
+			}
+
+			if len(requestCaps) > 0 {
+				sort.Strings(requestCaps)
 				uc.SendMessage(&irc.Message{
 					Command: "CAP",
-					Params:  []string{"REQ", "sasl"},
+					Params:  []string{"REQ", strings.Join(requestCaps, " ")},
 				})
-				break // we'll send CAP END after authentication is completed
+				break // we'll send CAP END after the server replies
 			}
 
 			uc.SendMessage(&irc.Message{
@@ -247,7 +1043,6 @@ func (uc *upstreamConn) handleMessage(msg *irc.Message) error {
 			return fmt.Errorf("received unexpected AUTHENTICATE message")
 		}
 
-		// TODO: if a challenge is 400 bytes long, buffer it
 		var challengeStr string
 		if err := parseMessageParams(msg, &challengeStr); err != nil {
 			uc.SendMessage(&irc.Message{
@@ -257,21 +1052,19 @@ func (uc *upstreamConn) handleMessage(msg *irc.Message) error {
 			return err
 		}
 
-		var challenge []byte
-		if challengeStr != "+" {
-			var err error
-			challenge, err = base64.StdEncoding.DecodeString(challengeStr)
-			if err != nil {
-				uc.SendMessage(&irc.Message{
-					Command: "AUTHENTICATE",
-					Params:  []string{"*"},
-				})
-				return err
-			}
+		challenge, more, err := uc.saslChallenge.decode(challengeStr)
+		if err != nil {
+			uc.SendMessage(&irc.Message{
+				Command: "AUTHENTICATE",
+				Params:  []string{"*"},
+			})
+			return err
+		} else if more {
+			// Wait for the rest of the challenge
+			break
 		}
 
 		var resp []byte
-		var err error
 		if !uc.saslStarted {
 			_, resp, err = uc.saslClient.Start()
 			uc.saslStarted = true
@@ -286,16 +1079,12 @@ func (uc *upstreamConn) handleMessage(msg *irc.Message) error {
 			return err
 		}
 
-		// TODO: send response in multiple chunks if >= 400 bytes
-		var respStr = "+"
-		if resp != nil {
-			respStr = base64.StdEncoding.EncodeToString(resp)
+		for _, chunk := range encodeSASLPayload(resp) {
+			uc.SendMessage(&irc.Message{
+				Command: "AUTHENTICATE",
+				Params:  []string{chunk},
+			})
 		}
-
-		uc.SendMessage(&irc.Message{
-			Command: "AUTHENTICATE",
-			Params:  []string{respStr},
-		})
 	case rpl_loggedin:
 		var account string
 		if err := parseMessageParams(msg, nil, nil, &account); err != nil {
@@ -304,6 +1093,34 @@ func (uc *upstreamConn) handleMessage(msg *irc.Message) error {
 		uc.logger.Printf("logged in with account %q", account)
 	case rpl_loggedout:
 		uc.logger.Printf("logged out")
+	case rpl_saslmechs:
+		var mechs string
+		if err := parseMessageParams(msg, nil, &mechs); err != nil {
+			return err
+		}
+		uc.logger.Printf("server supports SASL mechanisms: %v", mechs)
+
+		// Servers which don't support CAP 302 only advertise their SASL
+		// mechanisms with this numeric
+		uc.caps["sasl"] = mechs
+		if uc.saslClient == nil || uc.supportsSASLMechanism(uc.saslMechanism) {
+			break
+		}
+
+		// The authentication is aborted with ERR_SASLFAIL, retry then with
+		// another mechanism using the same credentials
+		uc.saslRetry = ""
+		for _, mech := range []string{"SCRAM-SHA-256", "PLAIN"} {
+			if mech != uc.saslMechanism && uc.supportsSASLMechanism(mech) {
+				uc.saslRetry = mech
+				break
+			}
+		}
+		if uc.saslRetry != "" {
+			uc.logger.Printf("SASL mechanism %q not supported by server, falling back to %q", uc.saslMechanism, uc.saslRetry)
+		} else {
+			uc.logger.Printf("SASL mechanism %q not supported by server", uc.saslMechanism)
+		}
 	case err_nicklocked, rpl_saslsuccess, err_saslfail, err_sasltoolong, err_saslaborted:
 		var info string
 		if err := parseMessageParams(msg, nil, &info); err != nil {
@@ -320,14 +1137,40 @@ func (uc *upstreamConn) handleMessage(msg *irc.Message) error {
 
 		uc.saslClient = nil
 		uc.saslStarted = false
+		uc.saslChallenge.reset()
+
+		if mech := uc.saslRetry; msg.Command == err_saslfail && mech != "" {
+			uc.saslRetry = ""
+			if err := uc.startSASL(mech); err != nil {
+				return err
+			}
+			break
+		}
 
 		uc.SendMessage(&irc.Message{
 			Command: "CAP",
 			Params:  []string{"END"},
 		})
 	case irc.RPL_WELCOME:
+		// The server may have truncated or otherwise changed our nick
+		if err := parseMessageParams(msg, &uc.nick); err != nil {
+			return err
+		}
+
 		uc.registered = true
 		uc.logger.Printf("connection registered")
+		uc.network.setState(bouncerNetworkConnected)
+
+		uc.forEachDownstream(func(dc *downstreamConn) {
+			dc.updateNick(uc)
+		})
+
+		if uc.network.autoAway() && !uc.network.hasDownstreams() {
+			uc.SendMessage(&irc.Message{
+				Command: "AWAY",
+				Params:  []string{autoAwayMessage},
+			})
+		}
 
 		channels, err := uc.srv.db.ListChannels(uc.network.ID)
 		if err != nil {
@@ -335,11 +1178,105 @@ func (uc *upstreamConn) handleMessage(msg *irc.Message) error {
 			break
 		}
 
+		rejoined := make(map[string]struct{})
 		for _, ch := range channels {
+			params := []string{ch.Name}
+			if ch.Key != "" {
+				params = append(params, ch.Key)
+			}
 			uc.SendMessage(&irc.Message{
 				Command: "JOIN",
-				Params:  []string{ch.Name},
+				Params:  params,
 			})
+			uc.addPendingJoins(ch.Name)
+			// TODO: use the server casemapping
+			rejoined[strings.ToLower(ch.Name)] = struct{}{}
+		}
+
+		for name := range uc.network.prevChannels {
+			if _, ok := rejoined[strings.ToLower(name)]; !ok {
+				uc.partPrevChannel(name)
+			}
+		}
+	case irc.RPL_ISUPPORT:
+		if err := parseMessageParams(msg, nil, nil); err != nil {
+			return err
+		}
+		uc.gotISUPPORT = true
+
+		for _, token := range msg.Params[1 : len(msg.Params)-1] {
+			negate := strings.HasPrefix(token, "-")
+			token = strings.TrimPrefix(token, "-")
+
+			key, value := token, ""
+			if i := strings.IndexByte(token, '='); i >= 0 {
+				key, value = token[:i], token[i+1:]
+			}
+
+			var err error
+			switch key {
+			case "CHANTYPES":
+				if negate {
+					uc.availableChannelTypes = stdChannelTypes
+				} else {
+					uc.availableChannelTypes = value
+				}
+			case "PREFIX":
+				if negate {
+					uc.availableMembershipModes = stdMembershipModes
+					uc.availableMemberships = stdMembershipPrefixes
+				} else {
+					var modes, prefixes string
+					if modes, prefixes, err = parseISUPPORTPrefix(value); err == nil {
+						uc.availableMembershipModes = modes
+						uc.availableMemberships = prefixes
+					}
+				}
+			case "WHOX":
+				uc.supportsWHOX = !negate
+			case "MONITOR":
+				uc.supportsMONITOR = !negate
+			case "ELIST":
+				if negate {
+					uc.elist = ""
+				} else {
+					uc.elist = strings.ToUpper(value)
+				}
+			case "CHANMODES":
+				if negate {
+					uc.channelModeTypes = stdChannelModes
+				} else {
+					var modes map[byte]channelModeType
+					if modes, err = parseISUPPORTChanModes(value); err == nil {
+						uc.channelModeTypes = modes
+					}
+				}
+			}
+			if err != nil {
+				// Keep the previous value rather than mis-parsing messages
+				uc.logger.Printf("failed to parse RPL_ISUPPORT token %q: %v", token, err)
+			}
+		}
+	case irc.RPL_ENDOFMOTD, irc.ERR_NOMOTD:
+		// The MOTD is sent right after registration, and then in reply to
+		// MOTD commands
+		if uc.gotMOTD {
+			break
+		}
+		uc.gotMOTD = true
+
+		if !uc.gotISUPPORT {
+			uc.logger.Printf("warning: server didn't send RPL_ISUPPORT, using default channel types, modes and prefixes")
+		}
+		uc.updateMonitor()
+	case irc.RPL_UMODEIS:
+		var modeStr string
+		if err := parseMessageParams(msg, nil, &modeStr); err != nil {
+			return err
+		}
+		uc.modes = ""
+		if err := uc.modes.Apply(modeStr); err != nil {
+			return err
 		}
 	case irc.RPL_MYINFO:
 		if err := parseMessageParams(msg, nil, &uc.serverName, nil, &uc.availableUserModes, &uc.availableChannelModes); err != nil {
@@ -358,8 +1295,10 @@ func (uc *upstreamConn) handleMessage(msg *irc.Message) error {
 			return err
 		}
 
+		me := false
 		if msg.Prefix.Name == uc.nick {
 			uc.logger.Printf("changed nick from %q to %q", uc.nick, newNick)
+			me = true
 			uc.nick = newNick
 		}
 
@@ -369,14 +1308,30 @@ func (uc *upstreamConn) handleMessage(msg *irc.Message) error {
 				ch.Members[newNick] = membership
 			}
 		}
+		if u, ok := uc.users[msg.Prefix.Name]; ok {
+			delete(uc.users, msg.Prefix.Name)
+			u.Nick = newNick
+			uc.users[newNick] = u
+		}
+
+		if me {
+			uc.forEachDownstream(func(dc *downstreamConn) {
+				dc.updateNick(uc)
+			})
+
+			if uc.registered && !strings.EqualFold(newNick, uc.network.Nick) {
+				uc.handleForcedNick(newNick)
+			}
+		} else {
+			uc.trackMonitorPresence(msg.Prefix, false)
+			uc.trackMonitorPresence(&irc.Prefix{Name: newNick, User: msg.Prefix.User, Host: msg.Prefix.Host}, true)
 
-		if msg.Prefix.Name != uc.nick {
 			uc.forEachDownstream(func(dc *downstreamConn) {
-				dc.SendMessage(&irc.Message{
+				dc.SendMessage(dc.marshalMessage(&irc.Message{
 					Prefix:  dc.marshalUserPrefix(uc, msg.Prefix),
 					Command: "NICK",
 					Params:  []string{newNick},
-				})
+				}, uc))
 			})
 		}
 	case "JOIN":
@@ -392,25 +1347,37 @@ func (uc *upstreamConn) handleMessage(msg *irc.Message) error {
 		for _, ch := range strings.Split(channels, ",") {
 			if msg.Prefix.Name == uc.nick {
 				uc.logger.Printf("joined channel %q", ch)
+				uc.popPendingJoin(ch)
+				delete(uc.network.joinErrors, ch)
 				uc.channels[ch] = &upstreamChannel{
 					Name:    ch,
 					conn:    uc,
 					Members: make(map[string]membership),
 				}
-			} else {
-				ch, err := uc.getChannel(ch)
-				if err != nil {
-					return err
-				}
-				ch.Members[msg.Prefix.Name] = 0
+				// Downstream connections will receive the JOIN when the
+				// channel is complete, see RPL_ENDOFNAMES
+				continue
 			}
 
+			ch, err := uc.getChannel(ch)
+			if err != nil {
+				return err
+			}
+			ch.Members[msg.Prefix.Name] = 0
+			uc.trackUser(msg.Prefix)
+			uc.trackMonitorPresence(msg.Prefix, true)
+
+			netjoin := uc.srv.CollapseNetsplits && uc.handleNetjoin(msg.Prefix, ch.Name)
+
 			uc.forEachDownstream(func(dc *downstreamConn) {
-				dc.SendMessage(&irc.Message{
+				if netjoin && !dc.caps["soju.im/raw-netsplits"] {
+					return
+				}
+				dc.SendMessage(dc.marshalMessage(&irc.Message{
 					Prefix:  dc.marshalUserPrefix(uc, msg.Prefix),
 					Command: "JOIN",
-					Params:  []string{dc.marshalChannel(uc, ch)},
-				})
+					Params:  []string{dc.marshalChannel(uc, ch.Name)},
+				}, uc))
 			})
 		}
 	case "PART":
@@ -434,13 +1401,14 @@ func (uc *upstreamConn) handleMessage(msg *irc.Message) error {
 				}
 				delete(ch.Members, msg.Prefix.Name)
 			}
+			uc.pruneUsers()
 
 			uc.forEachDownstream(func(dc *downstreamConn) {
-				dc.SendMessage(&irc.Message{
+				dc.SendMessage(dc.marshalMessage(&irc.Message{
 					Prefix:  dc.marshalUserPrefix(uc, msg.Prefix),
 					Command: "PART",
 					Params:  []string{dc.marshalChannel(uc, ch)},
-				})
+				}, uc))
 			})
 		}
 	case "QUIT":
@@ -455,14 +1423,26 @@ func (uc *upstreamConn) handleMessage(msg *irc.Message) error {
 		for _, ch := range uc.channels {
 			delete(ch.Members, msg.Prefix.Name)
 		}
+		delete(uc.users, msg.Prefix.Name)
 
 		if msg.Prefix.Name != uc.nick {
+			uc.trackMonitorPresence(msg.Prefix, false)
+
+			netsplit := false
+			if uc.srv.CollapseNetsplits && len(msg.Params) > 0 && isNetsplitQuit(msg.Params[0]) {
+				netsplit = true
+				uc.handleNetsplitQuit(msg, msg.Params[0])
+			}
+
 			uc.forEachDownstream(func(dc *downstreamConn) {
-				dc.SendMessage(&irc.Message{
+				if netsplit && !dc.caps["soju.im/raw-netsplits"] {
+					return
+				}
+				dc.SendMessage(dc.marshalMessage(&irc.Message{
 					Prefix:  dc.marshalUserPrefix(uc, msg.Prefix),
 					Command: "QUIT",
 					Params:  msg.Params,
-				})
+				}, uc))
 			})
 		}
 	case irc.RPL_TOPIC, irc.RPL_NOTOPIC:
@@ -493,16 +1473,20 @@ func (uc *upstreamConn) handleMessage(msg *irc.Message) error {
 		} else {
 			ch.Topic = ""
 		}
+		if msg.Prefix != nil {
+			ch.TopicWho = msg.Prefix.String()
+			ch.TopicTime = time.Now()
+		}
 		uc.forEachDownstream(func(dc *downstreamConn) {
 			params := []string{dc.marshalChannel(uc, name)}
 			if ch.Topic != "" {
 				params = append(params, ch.Topic)
 			}
-			dc.SendMessage(&irc.Message{
+			dc.SendMessage(dc.marshalMessage(&irc.Message{
 				Prefix:  dc.marshalUserPrefix(uc, msg.Prefix),
 				Command: "TOPIC",
 				Params:  params,
-			})
+			}, uc))
 		})
 	case rpl_topicwhotime:
 		var name, who, timeStr string
@@ -535,9 +1519,11 @@ func (uc *upstreamConn) handleMessage(msg *irc.Message) error {
 		}
 		ch.Status = status
 
-		for _, s := range strings.Split(members, " ") {
-			membership, nick := parseMembershipPrefix(s)
-			ch.Members[nick] = membership
+		for _, s := range strings.Fields(members) {
+			membership, mask := uc.parseMembershipPrefix(s)
+			prefix := irc.ParsePrefix(mask)
+			ch.Members[prefix.Name] = membership
+			uc.trackUser(prefix)
 		}
 	case irc.RPL_ENDOFNAMES:
 		var name string
@@ -554,30 +1540,505 @@ func (uc *upstreamConn) handleMessage(msg *irc.Message) error {
 		}
 		ch.complete = true
 
+		if uc.srv.WHOXOnJoin && uc.supportsWHOX {
+			// Fetch the hostname, account and away status of all members
+			uc.pendingJoinWHOX[ch.Name] = struct{}{}
+			uc.SendMessage(&irc.Message{
+				Command: "WHO",
+				Params:  []string{ch.Name, "%tcuhnfa," + whoxJoinToken},
+			})
+		}
+
+		net := uc.network
+		prev := net.prevChannels[ch.Name]
+		delete(net.prevChannels, ch.Name)
+
+		var updated []*downstreamConn
+		uc.forEachDownstream(func(dc *downstreamConn) {
+			if _, ok := net.prevDownstreams[dc]; ok && prev != nil && prev.complete {
+				forwardChannelUpdate(dc, prev, ch)
+				updated = append(updated, dc)
+			} else {
+				forwardChannel(dc, ch)
+			}
+
+			if _, ok := ch.pendingNAMES[dc]; ok {
+				sendNames(dc, ch)
+			}
+		})
+		ch.pendingNAMES = nil
+
+		if len(updated) > 0 {
+			// Fetch the channel modes to compare them with the previous ones
+			uc.SendMessage(&irc.Message{
+				Command: "MODE",
+				Params:  []string{ch.Name},
+			})
+			uc.pendingModeQueries = append(uc.pendingModeQueries, &pendingModeQuery{
+				channel:     ch.Name,
+				prevModes:   prev.modes,
+				downstreams: updated,
+			})
+		}
+
+		if len(net.prevChannels) == 0 {
+			net.prevDownstreams = nil
+		}
+	case rpl_whospcrpl:
+		var token string
+		if err := parseMessageParams(msg, nil, &token); err != nil {
+			return err
+		}
+		if token != whoxJoinToken {
+			pw := uc.getPendingWHO()
+			if pw == nil {
+				uc.logger.Printf("ignoring unsolicited RPL_WHOSPCRPL")
+				break
+			}
+			dc := pw.downstream
+			if dc.isClosed() {
+				break
+			}
+			channelIndex := whoxFieldIndex(pw.fields, 'c')
+			nickIndex := whoxFieldIndex(pw.fields, 'n')
+
+			params := make([]string, len(msg.Params))
+			copy(params, msg.Params)
+			params[0] = dc.nick
+			if channelIndex > 0 && channelIndex < len(params) && params[channelIndex] != "*" {
+				params[channelIndex] = dc.marshalChannel(uc, params[channelIndex])
+			}
+			if nickIndex > 0 && nickIndex < len(params) {
+				params[nickIndex] = dc.marshalNick(uc, params[nickIndex])
+			}
+			dc.SendMessage(dc.marshalMessage(&irc.Message{
+				Prefix:  dc.srv.prefix(),
+				Command: rpl_whospcrpl,
+				Params:  params,
+			}, uc))
+			break
+		}
+
+		var channel, username, host, nick, flags, account string
+		if err := parseMessageParams(msg, nil, nil, &channel, &username, &host, &nick, &flags, &account); err != nil {
+			return err
+		}
+		if account == "0" {
+			account = ""
+		}
+		uc.users[nick] = &upstreamUser{
+			Nick:     nick,
+			Username: username,
+			Hostname: host,
+			Account:  account,
+			Away:     strings.HasPrefix(flags, "G"),
+		}
+	case irc.RPL_ENDOFWHO:
+		var mask string
+		if err := parseMessageParams(msg, nil, &mask); err != nil {
+			return err
+		}
+		if _, ok := uc.pendingJoinWHOX[mask]; ok {
+			delete(uc.pendingJoinWHOX, mask)
+			break
+		}
+		pw := uc.popPendingWHO()
+		if pw == nil {
+			uc.logger.Printf("ignoring unsolicited RPL_ENDOFWHO for %q", mask)
+			break
+		}
+		if dc := pw.downstream; !dc.isClosed() {
+			dc.SendMessage(dc.marshalMessage(&irc.Message{
+				Prefix:  dc.srv.prefix(),
+				Command: irc.RPL_ENDOFWHO,
+				Params:  []string{dc.nick, dc.marshalTarget(uc, mask), "End of /WHO list"},
+			}, uc))
+		}
+	case irc.RPL_WHOREPLY:
+		var channel, username, host, server, nick, flags, trailing string
+		if err := parseMessageParams(msg, nil, &channel, &username, &host, &server, &nick, &flags, &trailing); err != nil {
+			return err
+		}
+
+		pw := uc.getPendingWHO()
+		if pw == nil {
+			uc.logger.Printf("ignoring unsolicited RPL_WHOREPLY")
+			break
+		}
+		dc := pw.downstream
+		if dc.isClosed() {
+			break
+		}
+		if channel != "*" {
+			channel = dc.marshalChannel(uc, channel)
+		}
+		dc.SendMessage(dc.marshalMessage(&irc.Message{
+			Prefix:  dc.srv.prefix(),
+			Command: irc.RPL_WHOREPLY,
+			Params:  []string{dc.nick, channel, username, host, server, dc.marshalNick(uc, nick), flags, trailing},
+		}, uc))
+	case irc.ERR_UNKNOWNCOMMAND, irc.ERR_NEEDMOREPARAMS, irc.RPL_TRYAGAIN:
+		var cmd, text string
+		if err := parseMessageParams(msg, nil, &cmd, &text); err != nil {
+			return err
+		}
+		if cmd != "WHO" || uc.getPendingWHO() == nil {
+			uc.logger.Printf("unhandled message: %v", msg)
+			break
+		}
+
+		// The WHO query failed, no RPL_ENDOFWHO follows
+		pw := uc.popPendingWHO()
+		if dc := pw.downstream; !dc.isClosed() {
+			dc.SendMessage(&irc.Message{
+				Prefix:  dc.srv.prefix(),
+				Command: msg.Command,
+				Params:  []string{dc.nick, cmd, text},
+			})
+		}
+	case irc.RPL_WHOISUSER, irc.RPL_WHOISSERVER, irc.RPL_WHOISOPERATOR, irc.RPL_WHOISIDLE, irc.RPL_ENDOFWHOIS, irc.RPL_AWAY, rpl_whoiscertfp, rpl_whoisregnick, rpl_whoisspecial, rpl_whoisaccount, rpl_whoisbot, rpl_whoishost, rpl_whoismodes, rpl_whoissecure, irc.ERR_NOSUCHNICK, rpl_whoisactually:
+		// Depending on the server, the parameters of RPL_WHOISACTUALLY after
+		// the nick are either "<ip> :<text>", "<user@host> <ip> :<text>" or
+		// ":<text>". Only the nick is marshaled, the other parameters are
+		// left untouched.
+		var nick string
+		if err := parseMessageParams(msg, nil, &nick); err != nil {
+			return err
+		}
+
+		uc.forEachWHOISDownstream(msg.Command, func(dc *downstreamConn) {
+			params := append([]string{dc.nick, dc.marshalNick(uc, nick)}, msg.Params[2:]...)
+			dc.SendMessage(dc.marshalMessage(&irc.Message{
+				Prefix:  dc.srv.prefix(),
+				Command: msg.Command,
+				Params:  params,
+			}, uc))
+		})
+	case irc.ERR_NOSUCHSERVER:
+		// Replied to WHOIS queries with a remote server target, instead of
+		// RPL_ENDOFWHOIS
+		var server, text string
+		if err := parseMessageParams(msg, nil, &server, &text); err != nil {
+			return err
+		}
+		if len(uc.pendingWHOISes) == 0 {
+			uc.logger.Printf("unhandled message: %v", msg)
+			break
+		}
+		dc := uc.pendingWHOISes[0]
+		uc.pendingWHOISes = uc.pendingWHOISes[1:]
+		if dc.isClosed() {
+			break
+		}
+
+		dc.SendMessage(&irc.Message{
+			Prefix:  dc.srv.prefix(),
+			Command: msg.Command,
+			Params:  []string{dc.nick, server, text},
+		})
+	case irc.RPL_WHOISCHANNELS:
+		var nick, channelList string
+		if err := parseMessageParams(msg, nil, &nick, &channelList); err != nil {
+			return err
+		}
+		channels := strings.Fields(channelList)
+
+		uc.forEachWHOISDownstream(msg.Command, func(dc *downstreamConn) {
+			l := make([]string, len(channels))
+			for i, channel := range channels {
+				prefix, channel := uc.parseMembershipPrefix(channel)
+				channel = dc.marshalChannel(uc, channel)
+				if prefix != 0 {
+					channel = string(prefix) + channel
+				}
+				l[i] = channel
+			}
+			channelList := strings.Join(l, " ")
+
+			dc.SendMessage(dc.marshalMessage(&irc.Message{
+				Prefix:  dc.srv.prefix(),
+				Command: irc.RPL_WHOISCHANNELS,
+				Params:  []string{dc.nick, dc.marshalNick(uc, nick), channelList},
+			}, uc))
+		})
+	case irc.RPL_LIST:
+		var channel, clients, topic string
+		if err := parseMessageParams(msg, nil, &channel, &clients, &topic); err != nil {
+			return err
+		}
+
+		uc.user.pendingLISTsLock.Lock()
+		pl := uc.getPendingLIST()
+		var dc *downstreamConn
+		var filter *listFilter
+		if pl != nil {
+			dc, filter = pl.downstream, pl.filter
+		}
+		uc.user.pendingLISTsLock.Unlock()
+
+		if pl == nil {
+			// Quirky servers may send RPL_LIST replies we didn't ask for
+			uc.logger.Printf("ignoring unsolicited RPL_LIST for %q", channel)
+			break
+		}
+		if filter != nil && !filter.match(clients, topic) {
+			break
+		}
+		if dc != nil {
+			dc.SendMessage(dc.marshalMessage(&irc.Message{
+				Prefix:  dc.srv.prefix(),
+				Command: irc.RPL_LIST,
+				Params:  []string{dc.nick, dc.marshalChannel(uc, channel), clients, topic},
+			}, uc))
+		}
+	case irc.RPL_LISTEND:
+		if !uc.endPendingLIST() {
+			uc.logger.Printf("ignoring unsolicited RPL_LISTEND")
+		}
+	case irc.ERR_NOSUCHCHANNEL, irc.ERR_TOOMANYCHANNELS, irc.ERR_CHANNELISFULL, irc.ERR_INVITEONLYCHAN, irc.ERR_BANNEDFROMCHAN, irc.ERR_BADCHANNELKEY, irc.ERR_BADCHANMASK, err_needreggednick:
+		var channel, text string
+		if err := parseMessageParams(msg, nil, &channel, &text); err != nil {
+			return err
+		}
+
+		// These errors aren't necessarily replies to JOIN: only record them
+		// for the channels being joined
+		if uc.popPendingJoin(channel) {
+			uc.logger.Printf("failed to join channel %q: %v", channel, text)
+			uc.network.joinErrors[channel] = text
+			uc.partPrevChannel(channel)
+		}
+
 		uc.forEachDownstream(func(dc *downstreamConn) {
-			forwardChannel(dc, ch)
+			dc.SendMessage(dc.marshalMessage(&irc.Message{
+				Prefix:  dc.srv.prefix(),
+				Command: msg.Command,
+				Params:  []string{dc.nick, dc.marshalChannel(uc, channel), text},
+			}, uc))
+		})
+	case irc.RPL_YOUREOPER, irc.ERR_NOOPERHOST, irc.ERR_PASSWDMISMATCH:
+		if msg.Command == irc.ERR_PASSWDMISMATCH && !uc.registered {
+			// This is a reply to our PASS command, not to OPER
+			uc.logger.Printf("server password rejected: %v", msg)
+			break
+		}
+		if msg.Command == irc.RPL_YOUREOPER {
+			uc.logger.Printf("OPER command succeeded")
+		}
+
+		var text string
+		if err := parseMessageParams(msg, nil, &text); err != nil {
+			return err
+		}
+
+		if len(uc.pendingOPERs) == 0 {
+			break
+		}
+		dc := uc.pendingOPERs[0]
+		uc.pendingOPERs = uc.pendingOPERs[1:]
+		if dc.isClosed() {
+			break
+		}
+
+		dc.SendMessage(&irc.Message{
+			Prefix:  dc.srv.prefix(),
+			Command: msg.Command,
+			Params:  []string{dc.nick, text},
 		})
 	case "PRIVMSG":
-		if err := parseMessageParams(msg, nil, nil); err != nil {
+		var target, text string
+		if err := parseMessageParams(msg, &target, &text); err != nil {
 			return err
 		}
+
+		if uc.network.isIgnored(msg.Prefix) {
+			break
+		}
+
+		if cmd, ok := parseCTCPMessage(text); ok && cmd != "ACTION" {
+			// CTCP queries are only delivered live, they don't belong in the
+			// conversation history
+			uc.forEachDownstream(func(dc *downstreamConn) {
+				dc.SendMessage(dc.marshalMessage(&irc.Message{
+					Prefix:  dc.marshalUserPrefix(uc, msg.Prefix),
+					Command: "PRIVMSG",
+					Params:  []string{dc.marshalTarget(uc, target), text},
+				}, uc))
+			})
+			break
+		}
+
 		uc.ring.Produce(msg)
-	case irc.RPL_YOURHOST, irc.RPL_CREATED:
+
+		if target == uc.nick {
+			uc.autoReply(msg.Prefix)
+		}
+	case irc.RPL_CHANNELMODEIS, rpl_channelurl, rpl_creationtime, irc.RPL_BANLIST, irc.RPL_ENDOFBANLIST, irc.RPL_INVITELIST, irc.RPL_ENDOFINVITELIST, irc.RPL_EXCEPTLIST, irc.RPL_ENDOFEXCEPTLIST:
+		var name string
+		if err := parseMessageParams(msg, nil, &name); err != nil {
+			return err
+		}
+
+		if msg.Command == irc.RPL_CHANNELMODEIS {
+			var modeStr string
+			if err := parseMessageParams(msg, nil, nil, &modeStr); err != nil {
+				return err
+			}
+			if ch, ok := uc.channels[name]; ok {
+				// RPL_CHANNELMODEIS lists all the channel modes
+				ch.modes = ""
+				if err := uc.applyChannelModes(ch, modeStr, msg.Params[3:]); err != nil {
+					return err
+				}
+			}
+		}
+
+		forward := func(dc *downstreamConn) {
+			params := []string{dc.nick, dc.marshalChannel(uc, name)}
+			params = append(params, msg.Params[2:]...)
+			dc.SendMessage(dc.marshalMessage(&irc.Message{
+				Prefix:  dc.srv.prefix(),
+				Command: msg.Command,
+				Params:  params,
+			}, uc))
+		}
+
+		// Replies to queries sent by a downstream connection are only
+		// forwarded to it, others are broadcast
+		if q := uc.popModeQuery(msg.Command, name); q != nil && q.dc == nil {
+			ch, ok := uc.channels[name]
+			if msg.Command != irc.RPL_CHANNELMODEIS || !ok || sameModes(ch.modes, q.prevModes) {
+				break
+			}
+			for _, dc := range q.downstreams {
+				if !dc.isClosed() {
+					forward(dc)
+				}
+			}
+		} else if q != nil {
+			if !q.dc.isClosed() {
+				forward(q.dc)
+			}
+		} else {
+			uc.forEachDownstream(forward)
+		}
+	case rpl_mononline, rpl_monoffline:
+		var targets string
+		if err := parseMessageParams(msg, nil, &targets); err != nil {
+			return err
+		}
+
+		for _, target := range strings.Split(targets, ",") {
+			if msg.Command == rpl_mononline {
+				prefix := irc.ParsePrefix(target)
+				uc.setMonitorStatus(prefix.Name, true, prefix)
+			} else {
+				uc.setMonitorStatus(target, false, nil)
+			}
+		}
+	case err_monlistfull:
+		var limit, targets string
+		if err := parseMessageParams(msg, nil, &limit, &targets); err != nil {
+			return err
+		}
+		uc.logger.Printf("upstream monitor list is full, failed to monitor %q", targets)
+		uc.handleMonitorListFull(limit, targets)
+	case irc.RPL_ISON:
+		var online string
+		if err := parseMessageParams(msg, nil, &online); err != nil {
+			return err
+		}
+		uc.handleISON(online)
+	case irc.RPL_UNAWAY, irc.RPL_NOWAWAY:
+		uc.away = msg.Command == irc.RPL_NOWAWAY
+	case irc.RPL_YOURHOST, irc.RPL_CREATED, rpl_liststart:
 		// Ignore
 	case irc.RPL_LUSERCLIENT, irc.RPL_LUSEROP, irc.RPL_LUSERUNKNOWN, irc.RPL_LUSERCHANNELS, irc.RPL_LUSERME:
 		// Ignore
-	case irc.RPL_MOTDSTART, irc.RPL_MOTD, irc.RPL_ENDOFMOTD:
+	case irc.RPL_MOTDSTART, irc.RPL_MOTD:
 		// Ignore
 	case rpl_localusers, rpl_globalusers:
 		// Ignore
-	case irc.RPL_STATSVLINE, rpl_statsping, irc.RPL_STATSBLINE, irc.RPL_STATSDLINE:
-		// Ignore
+	case irc.RPL_STATSLINKINFO, irc.RPL_STATSCOMMANDS, irc.RPL_STATSCLINE, irc.RPL_STATSNLINE, irc.RPL_STATSILINE, irc.RPL_STATSKLINE, irc.RPL_STATSQLINE, irc.RPL_STATSYLINE, irc.RPL_STATSLLINE, irc.RPL_STATSUPTIME, irc.RPL_STATSOLINE, irc.RPL_STATSHLINE, irc.RPL_STATSVLINE, rpl_statsping, irc.RPL_STATSBLINE, irc.RPL_STATSDLINE, rpl_statsdebug, irc.RPL_ENDOFSTATS:
+		// Some servers send STATS replies on their own, e.g. on connection:
+		// only forward replies to queries sent by downstream connections
+		if len(uc.pendingSTATS) == 0 {
+			break
+		}
+		dc := uc.pendingSTATS[0]
+		if msg.Command == irc.RPL_ENDOFSTATS {
+			uc.pendingSTATS = uc.pendingSTATS[1:]
+		}
+		if dc.isClosed() {
+			break
+		}
+
+		params := append([]string{dc.nick}, msg.Params[1:]...)
+		dc.SendMessage(dc.marshalMessage(&irc.Message{
+			Prefix:  dc.srv.prefix(),
+			Command: msg.Command,
+			Params:  params,
+		}, uc))
 	default:
 		uc.logger.Printf("unhandled message: %v", msg)
 	}
 	return nil
 }
 
+// handleClosed is called from the user goroutine once the connection has
+// been closed and the messages received on it have been handled.
+func (uc *upstreamConn) handleClosed() {
+	net := uc.network
+	uc.abortPendingLISTs()
+
+	// Channels of an earlier connection which haven't been rejoined are
+	// still known to downstream connections
+	for name, ch := range net.prevChannels {
+		if _, ok := uc.channels[name]; !ok {
+			uc.channels[name] = ch
+		}
+	}
+	net.prevChannels = uc.channels
+	net.prevDownstreams = make(map[*downstreamConn]struct{})
+	uc.forEachDownstream(func(dc *downstreamConn) {
+		net.prevDownstreams[dc] = struct{}{}
+	})
+
+	uc.resetMonitors()
+
+	if net.isStopped() {
+		// The network has been removed, its channels won't be rejoined
+		for name := range net.prevChannels {
+			uc.partPrevChannel(name)
+		}
+		net.prevDownstreams = nil
+		return
+	}
+
+	net.setState(bouncerNetworkDisconnected)
+}
+
+// partPrevChannel sends a PART to the downstream connections which know about
+// a channel of the previous connection, if it won't be rejoined.
+func (uc *upstreamConn) partPrevChannel(name string) {
+	net := uc.network
+	if _, ok := net.prevChannels[name]; !ok {
+		return
+	}
+	delete(net.prevChannels, name)
+
+	uc.forEachDownstream(func(dc *downstreamConn) {
+		if _, ok := net.prevDownstreams[dc]; !ok {
+			return
+		}
+		dc.SendMessage(&irc.Message{
+			Prefix:  dc.prefix(),
+			Command: "PART",
+			Params:  []string{dc.marshalChannel(uc, name)},
+		})
+	})
+}
+
 func (uc *upstreamConn) register() {
 	uc.nick = uc.network.Nick
 	uc.username = uc.network.Username
@@ -589,10 +2050,9 @@ func (uc *upstreamConn) register() {
 		uc.realname = uc.nick
 	}
 
-	uc.SendMessage(&irc.Message{
-		Command: "CAP",
-		Params:  []string{"LS", "302"},
-	})
+	if uc.network.CapNegotiation == "" {
+		uc.sendCapLS()
+	}
 
 	if uc.network.Pass != "" {
 		uc.SendMessage(&irc.Message{
@@ -609,6 +2069,18 @@ func (uc *upstreamConn) register() {
 		Command: "USER",
 		Params:  []string{uc.username, "0", "*", uc.realname},
 	})
+
+	// Some legacy servers choke on CAP before NICK/USER
+	if uc.network.CapNegotiation == "late" {
+		uc.sendCapLS()
+	}
+}
+
+func (uc *upstreamConn) sendCapLS() {
+	uc.SendMessage(&irc.Message{
+		Command: "CAP",
+		Params:  []string{"LS", "302"},
+	})
 }
 
 func (uc *upstreamConn) requestSASL() bool {
@@ -616,57 +2088,107 @@ func (uc *upstreamConn) requestSASL() bool {
 		return false
 	}
 
-	v, ok := uc.caps["sasl"]
-	if !ok {
+	if _, ok := uc.caps["sasl"]; !ok {
 		return false
 	}
-	if v != "" {
-		mechanisms := strings.Split(v, ",")
-		found := false
-		for _, mech := range mechanisms {
-			if strings.EqualFold(mech, uc.network.SASL.Mechanism) {
-				found = true
-				break
-			}
-		}
-		if !found {
-			return false
+	return uc.supportsSASLMechanism(uc.network.SASL.Mechanism)
+}
+
+// supportsSASLMechanism checks whether the server advertises a SASL mechanism.
+// If the server didn't advertise its mechanisms, all are assumed to be
+// supported.
+func (uc *upstreamConn) supportsSASLMechanism(mech string) bool {
+	v := uc.caps["sasl"]
+	if v == "" {
+		return true
+	}
+	for _, m := range strings.Split(v, ",") {
+		if strings.EqualFold(m, mech) {
+			return true
 		}
 	}
-
-	return true
+	return false
 }
 
 func (uc *upstreamConn) handleCapAck(name string, ok bool) error {
-	auth := &uc.network.SASL
+	if strings.HasPrefix(name, "-") {
+		delete(uc.enabledCaps, strings.TrimPrefix(name, "-"))
+		return nil
+	}
+	if ok {
+		uc.enabledCaps[name] = true
+	}
+
 	switch name {
 	case "sasl":
 		if !ok {
 			uc.logger.Printf("server refused to acknowledge the SASL capability")
 			return nil
 		}
+		return uc.startSASL(uc.network.SASL.Mechanism)
+	}
+	return nil
+}
 
-		switch auth.Mechanism {
-		case "PLAIN":
-			uc.logger.Printf("starting SASL PLAIN authentication with username %q", auth.Plain.Username)
-			uc.saslClient = sasl.NewPlainClient("", auth.Plain.Username, auth.Plain.Password)
-		default:
-			return fmt.Errorf("unsupported SASL mechanism %q", name)
-		}
-
-		uc.SendMessage(&irc.Message{
-			Command: "AUTHENTICATE",
-			Params:  []string{auth.Mechanism},
-		})
+// startSASL starts authenticating with a SASL mechanism. PLAIN and
+// SCRAM-SHA-256 use the same credentials.
+func (uc *upstreamConn) startSASL(mech string) error {
+	auth := &uc.network.SASL
+	switch mech {
+	case "PLAIN":
+		uc.logger.Printf("starting SASL PLAIN authentication with username %q", auth.Plain.Username)
+		uc.saslClient = sasl.NewPlainClient("", auth.Plain.Username, auth.Plain.Password)
+	case "SCRAM-SHA-256":
+		uc.logger.Printf("starting SASL SCRAM-SHA-256 authentication with username %q", auth.Plain.Username)
+		uc.saslClient = newSCRAMSHA256Client(auth.Plain.Username, auth.Plain.Password)
+	default:
+		return fmt.Errorf("unsupported SASL mechanism %q", mech)
 	}
+	uc.saslMechanism = mech
+
+	uc.SendMessage(&irc.Message{
+		Command: "AUTHENTICATE",
+		Params:  []string{mech},
+	})
 	return nil
 }
 
+// Token of the PINGs sent by sendPings.
+const keepAlivePingToken = "soju-keepalive"
+
+// sendPings periodically sends PINGs to the server until done is closed, so
+// that readMessages can detect dead connections.
+func (uc *upstreamConn) sendPings(done <-chan struct{}) {
+	ticker := time.NewTicker(uc.srv.UpstreamPingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			uc.SendMessage(&irc.Message{
+				Command: "PING",
+				Params:  []string{keepAlivePingToken},
+			})
+		case <-done:
+			return
+		}
+	}
+}
+
 func (uc *upstreamConn) readMessages(ch chan<- upstreamIncomingMessage) error {
 	for {
+		if interval := uc.srv.UpstreamPingInterval; interval > 0 {
+			deadline := time.Now().Add(interval + uc.srv.UpstreamPingTimeout)
+			if err := uc.net.SetReadDeadline(deadline); err != nil {
+				return fmt.Errorf("failed to set read deadline: %v", err)
+			}
+		}
+
 		msg, err := uc.irc.ReadMessage()
 		if err == io.EOF {
 			break
+		} else if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			return fmt.Errorf("ping timeout")
 		} else if err != nil {
 			return fmt.Errorf("failed to read IRC command: %v", err)
 		}
@@ -681,6 +2203,34 @@ func (uc *upstreamConn) readMessages(ch chan<- upstreamIncomingMessage) error {
 	return nil
 }
 
+// SendMessage queues a message for the server. Messages sent after the
+// connection has been closed are dropped.
 func (uc *upstreamConn) SendMessage(msg *irc.Message) {
+	uc.closeLock.Lock()
+	defer uc.closeLock.Unlock()
+
+	if uc.closed {
+		uc.logger.Printf("dropping message sent after close: %v", msg.Command)
+		return
+	}
 	uc.outgoing <- msg
 }
+
+// SendMessageLimited sends a message relayed from a downstream connection.
+// The message is delayed according to the flood limit, and
+// errUpstreamFlooded is returned if too many messages are already queued.
+func (uc *upstreamConn) SendMessageLimited(msg *irc.Message) error {
+	uc.closeLock.Lock()
+	defer uc.closeLock.Unlock()
+
+	if uc.closed {
+		uc.logger.Printf("dropping message sent after close: %v", msg.Command)
+		return nil
+	}
+	select {
+	case uc.floodQueue <- msg:
+		return nil
+	default:
+		return errUpstreamFlooded
+	}
+}
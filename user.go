@@ -1,6 +1,8 @@
 package soju
 
 import (
+	"fmt"
+	"strings"
 	"sync"
 	"time"
 
@@ -8,7 +10,7 @@ import (
 )
 
 type upstreamIncomingMessage struct {
-	msg *irc.Message
+	msg *irc.Message // nil once the connection is closed, see handleClosed
 	uc  *upstreamConn
 }
 
@@ -17,32 +19,294 @@ type downstreamIncomingMessage struct {
 	dc  *downstreamConn
 }
 
+// networkStateChange is sent by a network goroutine when the connection state
+// of the network changes.
+type networkStateChange struct {
+	net   *network
+	state string
+}
+
+// pendingLIST is a LIST command sent by a downstream connection, forwarded to
+// one or more upstream connections. Upstream servers process one LIST at a
+// time, and replies can't be matched to commands: LIST commands are queued per
+// upstream connection, the replies belong to the first pending LIST.
+type pendingLIST struct {
+	downstream *downstreamConn // nil if the downstream connection was closed
+	// LIST commands not yet completed, per upstream connection. The command
+	// has been sent if this is the first pending LIST for the connection.
+	pendingCommands map[*upstreamConn]*irc.Message
+	// Conditions applied to the replies, nil if none
+	filter *listFilter
+}
+
 type network struct {
 	Network
 	user *user
 	conn *upstreamConn
+
+	downstreamsChanged chan struct{}
+	stopped            chan struct{} // closed when the network is removed
+
+	// Channels which failed to be joined, with the error message sent by the
+	// server. Only accessed from the user goroutine.
+	joinErrors map[string]string
+	// Last auto-reply sent to each nick, used for rate-limiting. Only accessed
+	// from the user goroutine.
+	autoReplies map[string]time.Time
+	// Normalized masks of the users whose messages aren't forwarded. Only
+	// accessed from the user goroutine.
+	ignoreMasks []string
+	// Connection state reported to clients, see setState. Protected by the
+	// user lock.
+	state string
+	// Channels of the previous connection not rejoined yet, and downstream
+	// connections which were attached to it. Used to only send state changes
+	// to these downstream connections when rejoining. Only accessed from the
+	// user goroutine.
+	prevChannels    map[string]*upstreamChannel
+	prevDownstreams map[*downstreamConn]struct{}
 }
 
 func newNetwork(user *user, record *Network) *network {
 	return &network{
-		Network: *record,
-		user:    user,
+		Network:            *record,
+		user:               user,
+		downstreamsChanged: make(chan struct{}, 1),
+		stopped:            make(chan struct{}),
+		joinErrors:         make(map[string]string),
+		autoReplies:        make(map[string]time.Time),
+		state:              bouncerNetworkDisconnected,
+	}
+}
+
+// forwardsTag checks whether a message tag sent by the server should be
+// forwarded to downstream connections. By default, standard tags are
+// forwarded and vendor tags are dropped.
+func (net *network) forwardsTag(name string) bool {
+	if matchTagPatterns(net.DropTags, name) {
+		return false
+	}
+	if matchTagPatterns(net.ForwardTags, name) {
+		return true
+	}
+	return !isVendorTag(name)
+}
+
+// isIgnored checks whether messages sent by a user match an ignore mask.
+func (net *network) isIgnored(prefix *irc.Prefix) bool {
+	if prefix == nil {
+		return false
+	}
+	for _, mask := range net.ignoreMasks {
+		if matchMask(mask, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// loadIgnoreMasks populates the ignore masks of the network from the database.
+func (net *network) loadIgnoreMasks() {
+	masks, err := net.user.srv.db.ListIgnoreMasks(net.ID)
+	if err != nil {
+		net.user.srv.Logger.Printf("failed to list ignore masks for network %q: %v", net.Addr, err)
+		return
+	}
+	net.ignoreMasks = masks
+}
+
+// notifyDownstreamsChanged signals that a downstream connection has been
+// attached to or detached from the user.
+func (net *network) notifyDownstreamsChanged() {
+	select {
+	case net.downstreamsChanged <- struct{}{}:
+		// This space is intentionally left blank
+	default:
+		// The channel already has a pending notification
+	}
+}
+
+// updateRecord changes the network record, and stores it in the database. It
+// must be called from the user goroutine.
+func (net *network) updateRecord(f func(record *Network)) error {
+	net.user.lock.Lock()
+	f(&net.Network)
+	record := net.Network
+	net.user.lock.Unlock()
+
+	return net.user.srv.db.StoreNetwork(net.user.Username, &record)
+}
+
+// notifyState reports a change of the connection state to the user goroutine,
+// which notifies downstream connections. It must not be called from the user
+// goroutine.
+func (net *network) notifyState(state string) {
+	net.user.networkStates <- networkStateChange{net, state}
+}
+
+// stop disconnects from the network and stops reconnecting to it.
+func (net *network) stop() {
+	select {
+	case <-net.stopped:
+		return
+	default:
+		close(net.stopped)
+	}
+	net.quit("Network removed")
+}
+
+func (net *network) isStopped() bool {
+	select {
+	case <-net.stopped:
+		return true
+	default:
+		return false
+	}
+}
+
+// quit disconnects the current upstream connection, if any. Unless the network
+// is stopped, it will reconnect.
+func (net *network) quit(reason string) {
+	net.user.lock.Lock()
+	uc := net.conn
+	net.user.lock.Unlock()
+
+	if uc != nil && !uc.closed {
+		uc.SendMessage(&irc.Message{
+			Command: "QUIT",
+			Params:  []string{reason},
+		})
+	}
+}
+
+// hasDownstreams returns true if at least one downstream connection is
+// attached to the network.
+func (net *network) hasDownstreams() bool {
+	net.user.lock.Lock()
+	defer net.user.lock.Unlock()
+
+	for _, dc := range net.user.downstreamConns {
+		if dc.network == nil || dc.network == net {
+			return true
+		}
+	}
+	return false
+}
+
+// wantsConnection returns true if the network should be connected: either it
+// is always-on, or at least one downstream connection is attached to it.
+func (net *network) wantsConnection() bool {
+	net.user.lock.Lock()
+	onDemand := net.OnDemand
+	net.user.lock.Unlock()
+
+	return !onDemand || net.hasDownstreams()
+}
+
+// Away message set when no downstream connection is attached.
+const autoAwayMessage = "Auto away"
+
+// autoAway checks whether the user should be marked as away while no
+// downstream connection is attached to the network.
+func (net *network) autoAway() bool {
+	return net.user.boolSetting(net.ID, "", "auto-away", net.user.srv.AutoAway)
+}
+
+// watchDownstreams reacts to downstream connections being attached to or
+// detached from the network: it disconnects from on-demand networks when the
+// last downstream connection is detached, and handles auto-away.
+func (net *network) watchDownstreams(uc *upstreamConn, done <-chan struct{}) {
+	srv := net.user.srv
+
+	// Without downstream connections, the away status is set on
+	// registration, see RPL_WELCOME
+	away := net.autoAway() && !net.hasDownstreams()
+	var awayTimer *time.Timer
+	var awayTimerC <-chan time.Time
+	defer func() {
+		if awayTimer != nil {
+			awayTimer.Stop()
+		}
+	}()
+
+	for {
+		select {
+		case <-net.downstreamsChanged:
+		case <-awayTimerC:
+			awayTimerC = nil
+			if !away && net.autoAway() && !net.hasDownstreams() {
+				uc.SendMessage(&irc.Message{
+					Command: "AWAY",
+					Params:  []string{autoAwayMessage},
+				})
+				away = true
+			}
+			continue
+		case <-done:
+			return
+		}
+
+		if !net.wantsConnection() {
+			uc.logger.Printf("no downstream connection attached, disconnecting")
+			uc.SendMessage(&irc.Message{
+				Command: "QUIT",
+				Params:  []string{"Detached"},
+			})
+			return
+		}
+
+		if !net.autoAway() || net.hasDownstreams() {
+			// A client has reconnected or auto-away has been disabled:
+			// cancel the pending away status
+			if awayTimer != nil {
+				awayTimer.Stop()
+				awayTimerC = nil
+			}
+			if away {
+				uc.SendMessage(&irc.Message{Command: "AWAY"})
+				away = false
+			}
+		} else if !away && awayTimerC == nil {
+			awayTimer = time.NewTimer(srv.AutoAwayDelay)
+			awayTimerC = awayTimer.C
+		}
 	}
 }
 
 func (net *network) run() {
 	var lastTry time.Time
 	for {
+		if net.isStopped() {
+			return
+		}
+
+		if !net.wantsConnection() {
+			net.user.srv.Logger.Printf("waiting for a downstream connection before connecting to %q", net.Addr)
+			for !net.wantsConnection() {
+				select {
+				case <-net.downstreamsChanged:
+				case <-net.stopped:
+					return
+				}
+			}
+		}
+
 		if dur := time.Now().Sub(lastTry); dur < retryConnectMinDelay {
 			delay := retryConnectMinDelay - dur
 			net.user.srv.Logger.Printf("waiting %v before trying to reconnect to %q", delay.Truncate(time.Second), net.Addr)
-			time.Sleep(delay)
+			select {
+			case <-time.After(delay):
+			case <-net.stopped:
+				return
+			}
 		}
 		lastTry = time.Now()
 
+		net.notifyState(bouncerNetworkConnecting)
 		uc, err := connectToUpstream(net)
 		if err != nil {
 			net.user.srv.Logger.Printf("failed to connect to upstream server %q: %v", net.Addr, err)
+			net.notifyState(bouncerNetworkDisconnected)
 			continue
 		}
 
@@ -52,14 +316,46 @@ func (net *network) run() {
 		net.conn = uc
 		net.user.lock.Unlock()
 
+		if net.isStopped() {
+			// The network was removed while connecting
+			net.quit("Network removed")
+		}
+
+		done := make(chan struct{})
+		watcherDone := make(chan struct{})
+		go func() {
+			net.watchDownstreams(uc, done)
+			close(watcherDone)
+		}()
+		pingerDone := make(chan struct{})
+		go func() {
+			if net.user.srv.UpstreamPingInterval > 0 {
+				uc.sendPings(done)
+			}
+			close(pingerDone)
+		}()
+
 		if err := uc.readMessages(net.user.upstreamIncoming); err != nil {
 			uc.logger.Printf("failed to handle messages: %v", err)
 		}
+		close(done)
+		<-watcherDone
+		<-pingerDone
 		uc.Close()
 
 		net.user.lock.Lock()
 		net.conn = nil
 		net.user.lock.Unlock()
+
+		// Handled by the user goroutine after the messages already received
+		// on the connection
+		net.user.upstreamIncoming <- upstreamIncomingMessage{nil, uc}
+
+		if !net.wantsConnection() {
+			// We disconnected on purpose, reconnect as soon as a downstream
+			// connection is attached
+			lastTry = time.Time{}
+		}
 	}
 }
 
@@ -69,10 +365,20 @@ type user struct {
 
 	upstreamIncoming   chan upstreamIncomingMessage
 	downstreamIncoming chan downstreamIncomingMessage
+	broadcasts         chan string // service notices for all downstreams
+	netsplitFlushes    chan *upstreamConn
+	monitorPolls       chan *upstreamConn
+	networkStates      chan networkStateChange
+	downstreamsClosed  chan struct{}
+	reloads            chan struct{}
 
 	lock            sync.Mutex
 	networks        []*network
 	downstreamConns []*downstreamConn
+	settings        map[settingKey]string // see getSetting
+
+	pendingLISTsLock sync.Mutex
+	pendingLISTs     []*pendingLIST
 }
 
 func newUser(srv *Server, record *User) *user {
@@ -81,6 +387,13 @@ func newUser(srv *Server, record *User) *user {
 		srv:                srv,
 		upstreamIncoming:   make(chan upstreamIncomingMessage, 64),
 		downstreamIncoming: make(chan downstreamIncomingMessage, 64),
+		broadcasts:         make(chan string, 64),
+		netsplitFlushes:    make(chan *upstreamConn, 64),
+		monitorPolls:       make(chan *upstreamConn, 64),
+		networkStates:      make(chan networkStateChange, 64),
+		downstreamsClosed:  make(chan struct{}, 1),
+		reloads:            make(chan struct{}, 1),
+		settings:           make(map[settingKey]string),
 	}
 }
 
@@ -113,6 +426,9 @@ func (u *user) forEachDownstream(f func(dc *downstreamConn)) {
 }
 
 func (u *user) getNetwork(name string) *network {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
 	for _, network := range u.networks {
 		if network.Addr == name {
 			return network
@@ -121,7 +437,23 @@ func (u *user) getNetwork(name string) *network {
 	return nil
 }
 
+func (u *user) getNetworkByID(id int64) *network {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	for _, network := range u.networks {
+		if network.ID == id {
+			return network
+		}
+	}
+	return nil
+}
+
 func (u *user) run() {
+	if err := u.loadSettings(); err != nil {
+		u.srv.Logger.Printf("failed to load settings for user %q: %v", u.Username, err)
+	}
+
 	networks, err := u.srv.db.ListNetworks(u.Username)
 	if err != nil {
 		u.srv.Logger.Printf("failed to list networks for user %q: %v", u.Username, err)
@@ -131,6 +463,7 @@ func (u *user) run() {
 	u.lock.Lock()
 	for _, record := range networks {
 		network := newNetwork(u, &record)
+		network.loadIgnoreMasks()
 		u.networks = append(u.networks, network)
 
 		go network.run()
@@ -141,6 +474,10 @@ func (u *user) run() {
 		select {
 		case upstreamMsg := <-u.upstreamIncoming:
 			msg, uc := upstreamMsg.msg, upstreamMsg.uc
+			if msg == nil {
+				uc.handleClosed()
+				break
+			}
 			if err := uc.handleMessage(msg); err != nil {
 				uc.logger.Printf("failed to handle message %q: %v", msg, err)
 			}
@@ -154,15 +491,236 @@ func (u *user) run() {
 				dc.logger.Printf("failed to handle message %q: %v", msg, err)
 				dc.Close()
 			}
+		case uc := <-u.netsplitFlushes:
+			uc.flushNetsplit()
+		case uc := <-u.monitorPolls:
+			uc.pollMonitor()
+		case sc := <-u.networkStates:
+			// Deleted networks have already been reported
+			if !sc.net.isStopped() {
+				sc.net.setState(sc.state)
+			}
+		case <-u.downstreamsClosed:
+			u.handleDownstreamsClosed()
+		case <-u.reloads:
+			u.reload()
+		case text := <-u.broadcasts:
+			u.forEachDownstream(func(dc *downstreamConn) {
+				sendServiceNOTICE(dc, text)
+			})
 		}
 	}
 }
 
-func (u *user) createNetwork(addr, nick string) (*network, error) {
-	network := newNetwork(u, &Network{
-		Addr: addr,
-		Nick: nick,
+// notifyDownstreamClosed signals the user goroutine that a downstream
+// connection has been closed.
+func (u *user) notifyDownstreamClosed() {
+	select {
+	case u.downstreamsClosed <- struct{}{}:
+		// This space is intentionally left blank
+	default:
+		// The channel already has a pending notification
+	}
+}
+
+// handleDownstreamsClosed forgets about closed downstream connections, and
+// stops monitoring the nicks they were monitoring.
+func (u *user) handleDownstreamsClosed() {
+	u.forEachNetwork(func(net *network) {
+		for dc := range net.prevDownstreams {
+			if dc.isClosed() {
+				delete(net.prevDownstreams, dc)
+			}
+		}
 	})
+	u.updateMonitors()
+}
+
+// cancelPendingLISTs stops forwarding LIST replies to a closed downstream
+// connection. LIST commands already sent upstream still need to complete.
+func (u *user) cancelPendingLISTs(dc *downstreamConn) {
+	u.pendingLISTsLock.Lock()
+	for _, pl := range u.pendingLISTs {
+		if pl.downstream != dc {
+			continue
+		}
+		pl.downstream = nil
+		for uc := range pl.pendingCommands {
+			if uc.getPendingLIST() != pl {
+				delete(pl.pendingCommands, uc)
+			}
+		}
+	}
+	completed := u.removeCompletedLISTs()
+	u.pendingLISTsLock.Unlock()
+
+	sendListEnd(completed)
+}
+
+// removeCompletedLISTs removes pending LISTs with no pending command left, and
+// returns their downstream connections. The caller must hold
+// pendingLISTsLock, and send RPL_LISTEND with sendListEnd once it's released.
+func (u *user) removeCompletedLISTs() []*downstreamConn {
+	var completed []*downstreamConn
+	pendingLISTs := u.pendingLISTs[:0]
+	for _, pl := range u.pendingLISTs {
+		if len(pl.pendingCommands) > 0 {
+			pendingLISTs = append(pendingLISTs, pl)
+			continue
+		}
+		if pl.downstream != nil {
+			completed = append(completed, pl.downstream)
+		}
+	}
+	u.pendingLISTs = pendingLISTs
+	return completed
+}
+
+// sendListEnd sends RPL_LISTEND to downstream connections whose LIST has
+// completed.
+func sendListEnd(dcs []*downstreamConn) {
+	for _, dc := range dcs {
+		dc.SendMessage(&irc.Message{
+			Prefix:  dc.srv.prefix(),
+			Command: irc.RPL_LISTEND,
+			Params:  []string{dc.nick, "End of /LIST"},
+		})
+	}
+}
+
+// sameConnectionParams checks whether two network records would result in the
+// same upstream connection.
+func sameConnectionParams(a, b *Network) bool {
+	return a.Addr == b.Addr && a.Nick == b.Nick && a.Username == b.Username &&
+		a.Realname == b.Realname && a.Pass == b.Pass && a.SASL == b.SASL &&
+		a.CapNegotiation == b.CapNegotiation
+}
+
+// reload reconciles the networks of the user with the database, after it has
+// been edited out-of-band. Networks whose connection parameters have changed
+// are reconnected, the others keep their connection.
+func (u *user) reload() {
+	if record, err := u.srv.db.GetUser(u.Username); err != nil {
+		u.srv.Logger.Printf("failed to get user %q: %v", u.Username, err)
+	} else if record != nil {
+		u.lock.Lock()
+		u.User = *record
+		u.lock.Unlock()
+	}
+
+	if err := u.loadSettings(); err != nil {
+		u.srv.Logger.Printf("failed to load settings for user %q: %v", u.Username, err)
+	}
+
+	records, err := u.srv.db.ListNetworks(u.Username)
+	if err != nil {
+		u.srv.Logger.Printf("failed to list networks for user %q: %v", u.Username, err)
+		return
+	}
+
+	byID := make(map[int64]Network, len(records))
+	for _, record := range records {
+		byID[record.ID] = record
+	}
+
+	var kept, removed, reconnected, added []*network
+	u.lock.Lock()
+	var networks []*network
+	for _, net := range u.networks {
+		record, ok := byID[net.ID]
+		if !ok {
+			removed = append(removed, net)
+			continue
+		}
+		delete(byID, net.ID)
+
+		if sameConnectionParams(&net.Network, &record) {
+			kept = append(kept, net)
+		} else {
+			reconnected = append(reconnected, net)
+		}
+		net.Network = record
+		networks = append(networks, net)
+	}
+	for _, record := range records {
+		if _, ok := byID[record.ID]; !ok {
+			continue
+		}
+		net := newNetwork(u, &record)
+		networks = append(networks, net)
+		added = append(added, net)
+	}
+	u.networks = networks
+	u.lock.Unlock()
+
+	for _, net := range networks {
+		net.loadIgnoreMasks()
+	}
+
+	for _, net := range removed {
+		u.stopNetwork(net)
+		u.notifyBouncerNetwork(net.ID, nil)
+	}
+	for _, net := range reconnected {
+		net.quit("Reconnecting")
+		u.notifyBouncerNetwork(net.ID, bouncerNetworkAttrs(&net.Network, net.bouncerState()))
+	}
+	for _, net := range added {
+		go net.run()
+		u.notifyBouncerNetwork(net.ID, bouncerNetworkAttrs(&net.Network, bouncerNetworkDisconnected))
+	}
+
+	for _, net := range kept {
+		// The on-demand setting may have changed
+		net.notifyDownstreamsChanged()
+		u.notifyBouncerNetwork(net.ID, bouncerNetworkAttrs(&net.Network, net.bouncerState()))
+
+		// Join the channels added to the database, and leave the ones
+		// removed from it
+		u.lock.Lock()
+		uc := net.conn
+		u.lock.Unlock()
+		if uc == nil || !uc.registered || uc.closed {
+			continue
+		}
+		channels, err := u.srv.db.ListChannels(net.ID)
+		if err != nil {
+			uc.logger.Printf("failed to list channels from database: %v", err)
+			continue
+		}
+		stored := make(map[string]struct{}, len(channels))
+		for _, ch := range channels {
+			// TODO: use the server casemapping
+			stored[strings.ToLower(ch.Name)] = struct{}{}
+			if _, ok := uc.channels[ch.Name]; ok {
+				continue
+			}
+			params := []string{ch.Name}
+			if ch.Key != "" {
+				params = append(params, ch.Key)
+			}
+			uc.SendMessage(&irc.Message{
+				Command: "JOIN",
+				Params:  params,
+			})
+			uc.addPendingJoins(ch.Name)
+		}
+		for name := range uc.channels {
+			if _, ok := stored[strings.ToLower(name)]; ok {
+				continue
+			}
+			uc.SendMessage(&irc.Message{
+				Command: "PART",
+				Params:  []string{name},
+			})
+		}
+	}
+
+	u.srv.Logger.Printf("reloaded user %q: %v networks added, %v removed, %v reconnected", u.Username, len(added), len(removed), len(reconnected))
+}
+
+func (u *user) createNetwork(record *Network) (*network, error) {
+	network := newNetwork(u, record)
 	err := u.srv.db.StoreNetwork(u.Username, &network.Network)
 	if err != nil {
 		return nil, err
@@ -171,5 +729,74 @@ func (u *user) createNetwork(addr, nick string) (*network, error) {
 	u.networks = append(u.networks, network)
 	u.lock.Unlock()
 	go network.run()
+
+	u.notifyBouncerNetwork(network.ID, bouncerNetworkAttrs(&network.Network, bouncerNetworkDisconnected))
 	return network, nil
 }
+
+// updateNetwork stores new parameters for a network. The network is
+// reconnected if the connection parameters have changed.
+func (u *user) updateNetwork(record *Network) error {
+	net := u.getNetworkByID(record.ID)
+	if net == nil {
+		return fmt.Errorf("unknown network ID %v", record.ID)
+	}
+
+	if err := u.srv.db.StoreNetwork(u.Username, record); err != nil {
+		return err
+	}
+
+	u.lock.Lock()
+	reconnect := !sameConnectionParams(&net.Network, record)
+	net.Network = *record
+	u.lock.Unlock()
+
+	if reconnect {
+		net.quit("Reconnecting")
+	}
+
+	u.notifyBouncerNetwork(net.ID, bouncerNetworkAttrs(&net.Network, net.bouncerState()))
+	return nil
+}
+
+// deleteNetwork removes a network, and closes the downstream connections bound
+// to it.
+func (u *user) deleteNetwork(id int64) error {
+	net := u.getNetworkByID(id)
+	if net == nil {
+		return fmt.Errorf("unknown network ID %v", id)
+	}
+
+	if err := u.srv.db.DeleteNetwork(id); err != nil {
+		return err
+	}
+
+	u.lock.Lock()
+	for i, other := range u.networks {
+		if other == net {
+			u.networks = append(u.networks[:i], u.networks[i+1:]...)
+			break
+		}
+	}
+	u.lock.Unlock()
+
+	u.stopNetwork(net)
+	u.notifyBouncerNetwork(id, nil)
+	return nil
+}
+
+// stopNetwork stops a network removed from the user, and closes the downstream
+// connections bound to it.
+func (u *user) stopNetwork(net *network) {
+	net.stop()
+
+	var dcs []*downstreamConn
+	u.forEachDownstream(func(dc *downstreamConn) {
+		if dc.network == net {
+			dcs = append(dcs, dc)
+		}
+	})
+	for _, dc := range dcs {
+		dc.Close()
+	}
+}